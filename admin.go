@@ -1,53 +1,463 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
 )
 
-func adminresp(log *zap.SugaredLogger, w http.ResponseWriter, code, content string) {
+type AdminResp struct {
+	Code string      `json:"code"`
+	Data interface{} `json:"data"`
+}
+
+func adminresp(log *zap.SugaredLogger, w http.ResponseWriter, code string, content interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Write([]byte(`{"code":"` + code + `","data":"` + content + `"}`))
+	json.NewEncoder(w).Encode(AdminResp{Code: code, Data: content})
 	log.Info("[ADMINRESP]", code, content)
 }
 
-func (n *Node) adminPush(w http.ResponseWriter, r *http.Request) {
-	log := zap.S().With("method", "adminpush")
+// adminBody 读取请求数据并校验签名
+func adminBody(log *zap.SugaredLogger, w http.ResponseWriter, r *http.Request) ([]byte, bool) {
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		adminresp(log, w, C_FAIL, "读取数据错误")
-		return
+		return nil, false
 	}
 	log.Info("[Admin]新的请求:", string(body))
 
 	s := r.URL.Query().Get("sign")
 	if s == "" {
 		adminresp(log, w, C_FAIL, "sign")
-		return
+		return nil, false
 	}
 	ts := r.URL.Query().Get("ts")
 	if ts == "" {
 		adminresp(log, w, C_FAIL, "ts")
-		return
+		return nil, false
 	}
 
 	if !CheckSignMD5(DefConfig.AdminSecret, string(body), ts, s) {
 		adminresp(log, w, C_FAIL, "sign")
-		return
+		return nil, false
 	}
+	return body, true
+}
 
+// adminPushMessage 读取并校验推送数据
+func adminPushMessage(log *zap.SugaredLogger, w http.ResponseWriter, r *http.Request) (AdminPushMessage, bool) {
 	pm := AdminPushMessage{}
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return pm, false
+	}
+
 	if err := json.Unmarshal(body, &pm); err != nil {
 		adminresp(log, w, C_FAIL, "data format")
+		return pm, false
+	}
+	if !validPolicy(pm.Policy) {
+		adminresp(log, w, C_FAIL, "policy")
+		return pm, false
+	}
+	if !validPriority(pm.Priority) {
+		adminresp(log, w, C_FAIL, "priority")
+		return pm, false
+	}
+	for _, t := range pm.Tags {
+		if err := validTagPattern(t); err != nil {
+			adminresp(log, w, C_FAIL, "tags: "+t+": "+err.Error())
+			return pm, false
+		}
+	}
+	if pm.Expr != "" {
+		if _, err := parseTagExpr(pm.Expr); err != nil {
+			code := C_FAIL
+			if errors.Is(err, errExprLimit) {
+				code = C_PARAM
+			}
+			adminresp(log, w, code, "expression: "+err.Error())
+			return pm, false
+		}
+	}
+	for u, ms := range pm.Devices {
+		if u == "" {
+			adminresp(log, w, C_FAIL, "ms: user must not be empty")
+			return pm, false
+		}
+		for _, m := range ms {
+			if m == "" {
+				adminresp(log, w, C_FAIL, "ms: clientid must not be empty")
+				return pm, false
+			}
+		}
+	}
+	if string(pm.Ext) == "null" {
+		pm.Ext = nil
+	}
+	for i, p := range pm.Platforms {
+		pm.Platforms[i] = strings.ToLower(strings.TrimSpace(p))
+	}
+	if pm.AppVersion != "" {
+		if err := validVersionConstraint(pm.AppVersion); err != nil {
+			adminresp(log, w, C_FAIL, "av: "+err.Error())
+			return pm, false
+		}
+	}
+	return pm, true
+}
+
+func (n *Node) adminPush(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminpush")
+	pm, ok := adminPushMessage(log, w, r)
+	if !ok {
 		return
 	}
 	pm.MessageID = fmt.Sprint(time.Now().UnixNano())
-	n.Publish(pm, false, 0)
+	pm.From = ""
+	pm.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	if pm.IdempotencyKey != "" {
+		if len(pm.IdempotencyKey) > maxIdempotencyKey {
+			adminresp(log, w, C_PARAM, "idempotency key too long")
+			return
+		}
+		// 临时消息不保存, 无法去重
+		if pm.Ephemeral {
+			adminresp(log, w, C_PARAM, "idempotency key not supported for ephemeral message")
+			return
+		}
+		id, ok, err := n.idempotent(pm)
+		if err != nil {
+			log.Error("db:idempotency key:", err)
+			adminresp(log, w, C_FAIL, "db")
+			return
+		}
+		if ok {
+			log.Info("idempotent:", pm.IdempotencyKey, id)
+			adminresp(log, w, C_OK, id)
+			return
+		}
+	}
+	n.Publish(pm)
 	adminresp(log, w, C_OK, pm.MessageID)
 }
+
+// maxIdempotencyKey 幂等键的最大长度
+const maxIdempotencyKey = 128
+
+// idempotent 先保存带幂等键的消息, 由唯一索引保证多个节点只有一个推送;
+// 键已存在时返回已推送的消息id
+func (n *Node) idempotent(m AdminPushMessage) (string, bool, error) {
+	dm := messageRow(m)
+	r := n.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "idem_key"}},
+		DoNothing: true,
+	}).Create(&dm)
+	if r.Error != nil {
+		return "", false, r.Error
+	}
+	if r.RowsAffected > 0 {
+		return "", false, nil
+	}
+	old := Message{}
+	if err := n.db.Unscoped().Select("messageid").Where("idem_key = ?", m.IdempotencyKey).Take(&old).Error; err != nil {
+		return "", false, err
+	}
+	return old.MessagesID, true, nil
+}
+
+type AdminAudience struct {
+	Count int `json:"count"`
+	// 只发送给部分设备的用户数
+	Limited int `json:"limited"`
+}
+
+// adminAudience 按推送数据计算接收者数量, 不推送
+func (n *Node) adminAudience(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminaudience")
+	pm, ok := adminPushMessage(log, w, r)
+	if !ok {
+		return
+	}
+	users, devices, err := n.Audience(pm)
+	if err != nil {
+		log.Error("db:audience:", err)
+		adminresp(log, w, C_FAIL, "db")
+		return
+	}
+	adminresp(log, w, C_OK, AdminAudience{Count: len(users), Limited: len(devices)})
+}
+
+type AdminReceiptsReq struct {
+	// 消息id
+	ID string `json:"id"`
+	// 是否返回每个接收者的回执
+	Detail bool `json:"detail"`
+	Offset int  `json:"offset"`
+	Limit  int  `json:"limit"`
+}
+
+type AdminReceipts struct {
+	ID            string    `json:"id"`
+	Total         int64     `json:"total"`
+	Delivered     int64     `json:"delivered"`
+	Read          int64     `json:"read"`
+	DeliveredRate float64   `json:"delivered_rate"`
+	ReadRate      float64   `json:"read_rate"`
+	Receipts      []Receipt `json:"receipts,omitempty"`
+}
+
+type Receipt struct {
+	UsersID     string     `json:"u" gorm:"column:userid"`
+	DeliveredAt *time.Time `json:"delivered_at" gorm:"column:delivered_at"`
+	ReadAt      *time.Time `json:"read_at" gorm:"column:read_at"`
+}
+
+func (n *Node) adminReceipts(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminreceipts")
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return
+	}
+
+	req := AdminReceiptsReq{}
+	if err := json.Unmarshal(body, &req); err != nil || req.ID == "" {
+		adminresp(log, w, C_FAIL, "data format")
+		return
+	}
+	rs, err := n.Receipts(req)
+	if err != nil {
+		log.Error("db:receipts:", err)
+		adminresp(log, w, C_FAIL, "db")
+		return
+	}
+	adminresp(log, w, C_OK, rs)
+}
+
+// AdminTagsReq 批量修改用户的订阅
+type AdminTagsReq struct {
+	UserIDs []string `json:"us"`
+	// 只修改该设备的订阅, 为空时修改用户的订阅
+	ClientID string `json:"m"`
+	// 添加的订阅, 已有的订阅会更新过期时间和属性
+	Add map[string]*TagOptions `json:"add"`
+	// 删除的订阅
+	Del []string `json:"del"`
+}
+
+// maxAdminTagUsers 单次修改的最大用户数
+const maxAdminTagUsers = 1000
+
+func (n *Node) adminTags(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "admintags")
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return
+	}
+
+	req := AdminTagsReq{}
+	if err := json.Unmarshal(body, &req); err != nil || len(req.UserIDs) == 0 || len(req.Add)+len(req.Del) == 0 {
+		adminresp(log, w, C_FAIL, "data format")
+		return
+	}
+	if len(req.UserIDs) > maxAdminTagUsers {
+		adminresp(log, w, C_FAIL, "too many users")
+		return
+	}
+	tags := req.Del
+	for t, o := range req.Add {
+		if o != nil && o.TTL < 0 {
+			adminresp(log, w, C_FAIL, "tags: "+t+": ttl must not be negative")
+			return
+		}
+		tags = append(tags, t)
+	}
+	for _, t := range tags {
+		if err := validTag(t); err != nil {
+			adminresp(log, w, C_FAIL, "tags: "+t+": "+err.Error())
+			return
+		}
+	}
+	for _, u := range req.UserIDs {
+		if u == "" {
+			adminresp(log, w, C_FAIL, "us: user must not be empty")
+			return
+		}
+	}
+	// 用户 -> 标签 -> 状态码
+	rs := map[string]map[string]int{}
+	for _, u := range req.UserIDs {
+		add := map[string]*TagOptions{}
+		for t, o := range req.Add {
+			// 没有选项时也要覆盖已有的过期时间
+			if o == nil {
+				o = &TagOptions{}
+			}
+			add[t] = o
+		}
+		rs[u] = n.setTags(log, u, req.ClientID, add, req.Del)
+	}
+	adminresp(log, w, C_OK, rs)
+}
+
+type AdminUserTagsReq struct {
+	UserID string `json:"u"`
+}
+
+type AdminUserTag struct {
+	Tag string `json:"tag"`
+	// 设备的订阅
+	ClientID  string            `json:"m,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+// adminUserTags 查询用户的订阅
+func (n *Node) adminUserTags(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminusertags")
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return
+	}
+
+	req := AdminUserTagsReq{}
+	if err := json.Unmarshal(body, &req); err != nil || req.UserID == "" {
+		adminresp(log, w, C_FAIL, "data format")
+		return
+	}
+	tags, err := n.userTags(req.UserID)
+	if err != nil {
+		log.Error("db:user tags:", err)
+		adminresp(log, w, C_FAIL, "db")
+		return
+	}
+	rs := []AdminUserTag{}
+	for _, t := range tags {
+		ut := AdminUserTag{Tag: t.Tag, ClientID: t.ClientID, ExpiresAt: t.ExpiresAt}
+		if t.Attrs != "" {
+			json.Unmarshal([]byte(t.Attrs), &ut.Attrs)
+		}
+		rs = append(rs, ut)
+	}
+	adminresp(log, w, C_OK, rs)
+}
+
+type AdminRPCReq struct {
+	UserID   string `json:"u"`
+	ClientID string `json:"m"`
+	// 请求类型, 由业务方定义
+	Kind string `json:"k"`
+	Data string `json:"d"`
+	// 等待回复的时间, 秒, 默认 10 最大 60
+	Timeout int `json:"timeout"`
+}
+
+// AdminRPCResp 客户端的回复
+type AdminRPCResp struct {
+	C int    `json:"c"`
+	D string `json:"d"`
+	M string `json:"m"`
+}
+
+// adminRPC 发送请求给在线的客户端并同步返回客户端的回复
+func (n *Node) adminRPC(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminrpc")
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return
+	}
+
+	req := AdminRPCReq{}
+	if err := json.Unmarshal(body, &req); err != nil || req.UserID == "" || req.ClientID == "" {
+		adminresp(log, w, C_FAIL, "data format")
+		return
+	}
+	if req.Timeout <= 0 {
+		req.Timeout = rpcDefaultTimeout
+	}
+	if req.Timeout > rpcMaxTimeout {
+		req.Timeout = rpcMaxTimeout
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.Timeout)*time.Second)
+	defer cancel()
+	rp, err := n.RPC(ctx, RPCRequest{
+		User:     req.UserID,
+		ClientID: req.ClientID,
+		Kind:     req.Kind,
+		Data:     req.Data,
+	})
+	switch {
+	case err == errRPCOffline:
+		adminresp(log, w, C_OFFLINE, "offline")
+	case errors.Is(err, context.DeadlineExceeded):
+		adminresp(log, w, C_TIMEOUT, "timeout")
+	case err != nil:
+		log.Error("rpc:", err)
+		adminresp(log, w, C_FAIL, err.Error())
+	default:
+		adminresp(log, w, C_OK, AdminRPCResp{C: rp.C, D: rp.D, M: rp.M})
+	}
+}
+
+type AdminOnlineReq struct {
+	UserID string `json:"u"`
+}
+
+// adminOnline 查询用户在线的设备
+func (n *Node) adminOnline(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminonline")
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return
+	}
+
+	req := AdminOnlineReq{}
+	if err := json.Unmarshal(body, &req); err != nil || req.UserID == "" {
+		adminresp(log, w, C_FAIL, "data format")
+		return
+	}
+	ds, err := n.Online(r.Context(), req.UserID)
+	if err != nil {
+		log.Error("online:", err)
+		adminresp(log, w, C_FAIL, err.Error())
+		return
+	}
+	adminresp(log, w, C_OK, ds)
+}
+
+type AdminKickReq struct {
+	UserID string `json:"u"`
+	// 为空时踢掉用户的所有设备
+	ClientID string `json:"m"`
+}
+
+// adminKick 踢掉用户的设备, 返回被踢掉的设备
+func (n *Node) adminKick(w http.ResponseWriter, r *http.Request) {
+	log := zap.S().With("method", "adminkick")
+	body, ok := adminBody(log, w, r)
+	if !ok {
+		return
+	}
+
+	req := AdminKickReq{}
+	if err := json.Unmarshal(body, &req); err != nil || req.UserID == "" {
+		adminresp(log, w, C_FAIL, "data format")
+		return
+	}
+	ds, err := n.Kick(r.Context(), req.UserID, req.ClientID)
+	if err != nil {
+		log.Error("kick:", err)
+		adminresp(log, w, C_FAIL, err.Error())
+		return
+	}
+	adminresp(log, w, C_OK, ds)
+}
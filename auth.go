@@ -12,7 +12,11 @@ func CheckTokenMD5(secret, user, m, timestamp, pk string) bool {
 }
 
 func CheckSignMD5(secret, data, timestamp, pk string) bool {
+	return SignMD5(secret, data, timestamp) == pk
+}
+
+func SignMD5(secret, data, timestamp string) string {
 	h := md5.New()
 	h.Write([]byte(secret + data + timestamp))
-	return hex.EncodeToString(h.Sum(nil)) == pk
+	return hex.EncodeToString(h.Sum(nil))
 }
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nzlov/sw/swadmin"
+	"github.com/nzlov/sw/swclient"
+)
+
+// benchPayload 压测消息的内容, 接收时按 ts 计算延迟
+type benchPayload struct {
+	Ts  int64  `json:"ts"`
+	Pad string `json:"pad,omitempty"`
+}
+
+// benchRecorder 记录一类操作的次数和耗时
+type benchRecorder struct {
+	mu     sync.Mutex
+	ds     []time.Duration
+	failed int64
+	// 第一个错误
+	err error
+}
+
+func (r *benchRecorder) ok(d time.Duration) {
+	r.mu.Lock()
+	r.ds = append(r.ds, d)
+	r.mu.Unlock()
+}
+
+func (r *benchRecorder) fail(err error) {
+	atomic.AddInt64(&r.failed, 1)
+	r.mu.Lock()
+	if r.err == nil {
+		r.err = err
+	}
+	r.mu.Unlock()
+}
+
+// BenchStat 一类操作的结果, 耗时为毫秒
+type BenchStat struct {
+	Count  int     `json:"count"`
+	Failed int64   `json:"failed"`
+	Rate   float64 `json:"rate"`
+	P50    float64 `json:"p50"`
+	P90    float64 `json:"p90"`
+	P99    float64 `json:"p99"`
+	Max    float64 `json:"max"`
+}
+
+// stat 计算次数、速率和耗时的分位数
+func (r *benchRecorder) stat(elapsed time.Duration) BenchStat {
+	r.mu.Lock()
+	ds := append([]time.Duration(nil), r.ds...)
+	r.mu.Unlock()
+	s := BenchStat{Count: len(ds), Failed: atomic.LoadInt64(&r.failed)}
+	if elapsed > 0 {
+		s.Rate = float64(len(ds)) / elapsed.Seconds()
+	}
+	if len(ds) == 0 {
+		return s
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	p := func(q float64) float64 {
+		return float64(ds[int(q*float64(len(ds)-1))]) / float64(time.Millisecond)
+	}
+	s.P50, s.P90, s.P99, s.Max = p(0.5), p(0.9), p(0.99), p(1)
+	return s
+}
+
+// BenchReport 压测结果
+type BenchReport struct {
+	Clients  int     `json:"clients"`
+	Tags     int     `json:"tags"`
+	Duration float64 `json:"duration"`
+	// 连接并登录
+	Connect BenchStat `json:"connect"`
+	// Admin 推送的请求
+	Push BenchStat `json:"push"`
+	// 推送到客户端收到的延迟, Failed 为没有收到的消息数
+	Delivery BenchStat `json:"delivery"`
+	// 回执到收到 resp 的往返
+	Ack BenchStat `json:"ack"`
+	// 连接后断开的次数
+	Disconnects int64 `json:"disconnects"`
+}
+
+func cmdBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	o := outputFlag(fs)
+	urls := fs.String("url", localAddr("ws", "/ws"), "websocket 地址, 集群时以,分隔, 客户端轮流连接")
+	addr := fs.String("addr", localAddr("http", ""), "Admin 地址")
+	secret := fs.String("secret", DefConfig.Secret, "secret")
+	adminSecret := fs.String("adminsecret", DefConfig.AdminSecret, "adminsecret")
+	n := fs.Int("n", 100, "客户端数")
+	connectRate := fs.Int("connect-rate", 100, "每秒新建的连接数, 0 不限制")
+	connectTimeout := fs.Duration("connect-timeout", 10*time.Second, "连接并登录的超时时间")
+	tags := fs.Int("tags", 10, "标签数, 标签为 <prefix>.t<i>")
+	per := fs.Int("per", 1, "每个客户端订阅的标签数")
+	dist := fs.String("dist", "uniform", "标签的分布 uniform|zipf")
+	target := fs.String("target", "tag", "推送目标 tag|user, tag 时随机推送给一个标签, user 时随机推送给一个用户")
+	rate := fs.Float64("rate", 10, "每秒推送数")
+	duration := fs.Duration("duration", 30*time.Second, "推送的时长")
+	wait := fs.Duration("wait", 5*time.Second, "推送结束后等待消息送达的时间")
+	size := fs.Int("size", 64, "消息的填充字节数")
+	prefix := fs.String("prefix", "bench", "用户id和标签的前缀")
+	noAck := fs.Bool("noack", false, "不回执, 不统计回执往返")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if *n <= 0 || *rate <= 0 {
+		return errors.New("-n and -rate must be positive")
+	}
+	if *target != "tag" && *target != "user" {
+		return errors.New("-target must be tag or user")
+	}
+	if *target == "tag" && (*tags <= 0 || *per <= 0) {
+		return errors.New("-tags and -per must be positive when -target is tag")
+	}
+	if *per > *tags {
+		*per = *tags
+	}
+	endpoints := splitList(*urls)
+	if len(endpoints) == 0 {
+		return errors.New("-url is required")
+	}
+	admin, err := swadmin.New(swadmin.Config{Addr: *addr, Secret: *adminSecret, Retries: -1})
+	if err != nil {
+		return err
+	}
+
+	// 为每个客户端分配标签
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	pick := func() int { return rnd.Intn(*tags) }
+	if *dist == "zipf" && *tags > 1 {
+		z := rand.NewZipf(rnd, 1.1, 1, uint64(*tags-1))
+		pick = func() int { return int(z.Uint64()) }
+	} else if *dist != "uniform" && *dist != "zipf" {
+		return errors.New("-dist must be uniform or zipf")
+	}
+	tagName := func(i int) string { return *prefix + ".t" + strconv.Itoa(i) }
+	subs := make([][]string, *n)
+	if *target == "tag" {
+		for i := range subs {
+			seen := map[int]bool{}
+			for len(seen) < *per {
+				seen[pick()] = true
+			}
+			for t := range seen {
+				subs[i] = append(subs[i], tagName(t))
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var (
+		connect, push, delivery, ack, unsub benchRecorder
+		disconnects, expected               int64
+		// 压测结束后的断开不计入
+		closing int32
+		clients []*swclient.Client
+		// 每个客户端订阅的标签, 与 clients 对应
+		clientTags [][]string
+		// 连接并订阅成功的客户端, 只有它们计入期望收到的消息数
+		ready = make([]bool, *n)
+		cmu   sync.Mutex
+		wg    sync.WaitGroup
+	)
+
+	// 按速率建立连接
+	fmt.Fprintf(os.Stderr, "connecting %d clients to %s\n", *n, strings.Join(endpoints, ","))
+	start := time.Now()
+	var interval time.Duration
+	if *connectRate > 0 {
+		interval = time.Second / time.Duration(*connectRate)
+	}
+	for i := 0; i < *n; i++ {
+		if interval > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(i) * interval)))
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := *prefix + strconv.Itoa(i)
+			connected := make(chan struct{})
+			var once sync.Once
+			var c *swclient.Client
+			c, err := swclient.New(swclient.Config{
+				URL:       endpoints[i%len(endpoints)],
+				User:      user,
+				ClientID:  user + "-m",
+				Signer:    swclient.MD5Signer(*secret),
+				ManualAck: true,
+				Handler: func(m swclient.Message) {
+					p := benchPayload{}
+					if json.Unmarshal([]byte(m.Data), &p) == nil && p.Ts > 0 {
+						delivery.ok(time.Since(time.Unix(0, p.Ts)))
+					}
+					if *noAck {
+						return
+					}
+					// 回执在单独的 goroutine 中等待 resp, 不阻塞接收
+					go func() {
+						t := time.Now()
+						if err := c.Ack(ctx, m.ID); err != nil {
+							ack.fail(err)
+							return
+						}
+						ack.ok(time.Since(t))
+					}()
+				},
+				OnConnect: func(swclient.LoginResult) {
+					once.Do(func() { close(connected) })
+				},
+				OnDisconnect: func(error) {
+					select {
+					case <-connected:
+						if atomic.LoadInt32(&closing) == 0 {
+							atomic.AddInt64(&disconnects, 1)
+						}
+					default:
+					}
+				},
+			})
+			if err != nil {
+				connect.fail(err)
+				return
+			}
+			t := time.Now()
+			go c.Run(ctx)
+			select {
+			case <-connected:
+			case <-time.After(*connectTimeout):
+				connect.fail(errors.New("connect timeout"))
+				c.Close()
+				return
+			}
+			connect.ok(time.Since(t))
+			subscribed := true
+			if len(subs[i]) > 0 {
+				if _, err := c.Subscribe(ctx, subs[i]...); err != nil {
+					connect.fail(err)
+					subscribed = false
+				}
+			}
+			cmu.Lock()
+			clients = append(clients, c)
+			clientTags = append(clientTags, subs[i])
+			ready[i] = subscribed
+			cmu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	connectElapsed := time.Since(start)
+	subscribers := map[string]int{}
+	for i, tags := range subs {
+		for _, t := range tags {
+			if ready[i] {
+				subscribers[t]++
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "connected %d/%d in %s, pushing %.1f/s for %s\n", len(clients), *n, connectElapsed.Round(time.Millisecond), *rate, *duration)
+
+	// 按速率推送
+	pad := strings.Repeat("x", *size)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	deadline := time.After(*duration)
+	pushStart := time.Now()
+push:
+	for {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			break push
+		}
+		m := swadmin.PushRequest{}
+		var receivers int64
+		if *target == "tag" {
+			t := tagName(rnd.Intn(*tags))
+			m.Tags = []string{t}
+			receivers = int64(subscribers[t])
+		} else {
+			i := rnd.Intn(*n)
+			m.UserIDs = []string{*prefix + strconv.Itoa(i)}
+			if ready[i] {
+				receivers = 1
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t := time.Now()
+			d, _ := json.Marshal(benchPayload{Ts: t.UnixNano(), Pad: pad})
+			m.Data = string(d)
+			if _, err := admin.Push(ctx, m); err != nil {
+				push.fail(err)
+				return
+			}
+			push.ok(time.Since(t))
+			atomic.AddInt64(&expected, receivers)
+		}()
+	}
+	ticker.Stop()
+	pushElapsed := time.Since(pushStart)
+	wg.Wait()
+	time.Sleep(*wait)
+	atomic.StoreInt32(&closing, 1)
+	// 订阅保存在服务端, 断开前取消, 否则会计入下次压测的标签接收者
+	uctx, ucancel := context.WithTimeout(context.Background(), *connectTimeout)
+	for i, c := range clients {
+		if len(clientTags[i]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(c *swclient.Client, tags []string) {
+			defer wg.Done()
+			t := time.Now()
+			if _, err := c.Unsubscribe(uctx, tags...); err != nil {
+				unsub.fail(err)
+				return
+			}
+			unsub.ok(time.Since(t))
+		}(c, clientTags[i])
+	}
+	wg.Wait()
+	ucancel()
+	cancel()
+	for _, c := range clients {
+		c.Close()
+	}
+
+	r := BenchReport{
+		Clients:     len(clients),
+		Tags:        *tags,
+		Duration:    pushElapsed.Seconds(),
+		Connect:     connect.stat(connectElapsed),
+		Push:        push.stat(pushElapsed),
+		Delivery:    delivery.stat(pushElapsed),
+		Ack:         ack.stat(pushElapsed),
+		Disconnects: atomic.LoadInt64(&disconnects),
+	}
+	for name, rc := range map[string]*benchRecorder{"connect": &connect, "push": &push, "ack": &ack, "unsubscribe": &unsub} {
+		if rc.err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %d failed, first error: %v\n", name, rc.failed, rc.err)
+		}
+	}
+	if missing := atomic.LoadInt64(&expected) - int64(r.Delivery.Count); missing > 0 {
+		r.Delivery.Failed = missing
+	}
+	row := func(name string, s BenchStat) []string {
+		f := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+		return []string{name, strconv.Itoa(s.Count), strconv.FormatInt(s.Failed, 10), f(s.Rate), f(s.P50), f(s.P90), f(s.P99), f(s.Max)}
+	}
+	return output(*o, r, []string{"METRIC", "COUNT", "FAILED", "RATE/S", "P50(MS)", "P90(MS)", "P99(MS)", "MAX(MS)"}, [][]string{
+		row("connect", r.Connect),
+		row("push", r.Push),
+		row("delivery", r.Delivery),
+		row("ack", r.Ack),
+	})
+}
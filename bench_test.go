@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// runBench 对测试节点压测, 返回 json 格式的报告
+func runBench(t *testing.T, tn *testNode, args ...string) BenchReport {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	err = cmdBench(append([]string{
+		"-url", tn.wsURL(), "-addr", tn.srv.URL,
+		"-secret", DefConfig.Secret, "-adminsecret", DefConfig.AdminSecret,
+		"-o", "json",
+	}, args...))
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal("bench:", err)
+	}
+	r := BenchReport{}
+	if _, err := out.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.NewDecoder(out).Decode(&r); err != nil {
+		t.Fatal("bench report:", err)
+	}
+	return r
+}
+
+// TestBenchUnsubscribe 压测结束后取消订阅, 不影响下次压测
+func TestBenchUnsubscribe(t *testing.T) {
+	tn := newTestNode(t)
+
+	runBench(t, tn, "-n", "3", "-tags", "2", "-per", "2", "-rate", "20",
+		"-duration", "200ms", "-wait", "200ms", "-prefix", "bt")
+	for _, u := range []string{"bt0", "bt1", "bt2"} {
+		if n := countTags(t, tn, u); n != 0 {
+			t.Fatalf("%s: %d tags left", u, n)
+		}
+	}
+}
+
+// TestBenchConnectFailure 连接失败的客户端只计入连接失败, 不计入送达失败
+func TestBenchConnectFailure(t *testing.T) {
+	withLimit(t, 2, 0)
+	tn := newTestNode(t)
+
+	r := runBench(t, tn, "-n", "3", "-tags", "1", "-per", "1", "-rate", "20",
+		"-duration", "200ms", "-wait", "200ms", "-prefix", "bf", "-connect-timeout", "300ms")
+	if r.Clients != 2 || r.Connect.Failed != 1 {
+		t.Fatalf("connect: %d clients, %+v", r.Clients, r.Connect)
+	}
+	if r.Delivery.Count == 0 || r.Delivery.Failed != 0 {
+		t.Fatalf("delivery: %+v", r.Delivery)
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nzlov/sw/swadmin"
+	"github.com/nzlov/sw/swclient"
+)
+
+type command struct {
+	run  func(args []string) error
+	help string
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":   {serve, "启动服务, 默认命令"},
+		"push":    {cmdPush, "推送消息"},
+		"listen":  {cmdListen, "以客户端登录并打印收到的消息, 可以输入命令订阅标签和回执"},
+		"status":  {cmdStatus, "查询消息的回执: status <msgid>"},
+		"online":  {cmdOnline, "查询用户在线的设备: online <user>"},
+		"kick":    {cmdKick, "踢掉用户的设备: kick <user> [clientid]"},
+		"token":   {cmdToken, "生成登录的 token"},
+		"migrate": {cmdMigrate, "创建和更新表结构"},
+		"bench":   {cmdBench, "压测: 建立大量客户端, 按速率推送并统计连接、送达延迟和回执往返"},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sw <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, name := range []string{"serve", "push", "listen", "status", "online", "kick", "token", "migrate", "bench"} {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "默认值读取当前目录的 config.yaml, 使用 sw <command> -h 查看参数")
+}
+
+// parseArgs 解析参数, 允许参数和位置参数混合, 返回位置参数
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	pos := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// splitList 以 , 分隔的列表
+func splitList(s string) []string {
+	rs := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			rs = append(rs, v)
+		}
+	}
+	return rs
+}
+
+// parseDevices 解析 用户:clientid 列表
+func parseDevices(s string) (map[string][]string, error) {
+	ds := map[string][]string{}
+	for _, v := range splitList(s) {
+		i := strings.Index(v, ":")
+		if i <= 0 || i == len(v)-1 {
+			return nil, fmt.Errorf("%q: expect user:clientid", v)
+		}
+		ds[v[:i]] = append(ds[v[:i]], v[i+1:])
+	}
+	return ds, nil
+}
+
+// localAddr 本机服务的地址
+func localAddr(scheme, path string) string {
+	host := DefConfig.Host
+	if host == "" {
+		host = ":8000"
+	}
+	if strings.HasPrefix(host, ":") {
+		host = "127.0.0.1" + host
+	}
+	return scheme + "://" + host + path
+}
+
+// outputFlag 输出格式, json 或 table
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("o", "table", "输出格式 json|table")
+}
+
+// output 按格式输出结果, table 时输出 header 和 rows
+func output(format string, v interface{}, header []string, rows [][]string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "table":
+		printTable(header, rows)
+		return nil
+	}
+	return errors.New("unknown output format: " + format)
+}
+
+func printTable(header []string, rows [][]string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	w.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// adminFlags Admin 命令共用的参数
+func adminFlags(fs *flag.FlagSet) func() (*swadmin.Client, context.Context, context.CancelFunc, error) {
+	addr := fs.String("addr", localAddr("http", ""), "服务地址")
+	secret := fs.String("secret", DefConfig.AdminSecret, "adminsecret")
+	timeout := fs.Duration("timeout", 30*time.Second, "超时时间")
+	return func() (*swadmin.Client, context.Context, context.CancelFunc, error) {
+		c, err := swadmin.New(swadmin.Config{Addr: *addr, Secret: *secret})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		return c, ctx, cancel, nil
+	}
+}
+
+func cmdPush(args []string) error {
+	fs := flag.NewFlagSet("push", flag.ContinueOnError)
+	connect := adminFlags(fs)
+	o := outputFlag(fs)
+	file := fs.String("f", "", "从 json 文件读取推送数据, - 为标准输入; 命令行参数会覆盖文件中的字段")
+	us := fs.String("us", "", "目标用户, 以,分隔")
+	ts := fs.String("ts", "", "目标标签, 以,分隔")
+	x := fs.String("x", "", "标签表达式")
+	ex := fs.String("ex", "", "排除的用户, 以,分隔")
+	ms := fs.String("ms", "", "目标设备, 用户:clientid 以,分隔")
+	ps := fs.String("ps", "", "平台, 以,分隔")
+	av := fs.String("av", "", "应用版本条件, 例如 >=2.3.0")
+	p := fs.String("p", "", "确认策略 any|each")
+	ep := fs.Bool("ep", false, "临时消息")
+	pr := fs.Int("pr", 0, "优先级 -1|0|1")
+	d := fs.String("d", "", "内容")
+	e := fs.String("e", "", "扩展数据, json")
+	key := fs.String("key", "", "幂等键, 默认自动生成")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	m := swadmin.PushRequest{}
+	if *file != "" {
+		var r io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &m); err != nil {
+			return fmt.Errorf("%s: %w", *file, err)
+		}
+	}
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "us":
+			m.UserIDs = splitList(*us)
+		case "ts":
+			m.Tags = splitList(*ts)
+		case "x":
+			m.Expr = *x
+		case "ex":
+			m.Exclude = splitList(*ex)
+		case "ms":
+			if m.Devices, err = parseDevices(*ms); err != nil {
+				err = fmt.Errorf("-ms: %w", err)
+			}
+		case "ps":
+			m.Platforms = splitList(*ps)
+		case "av":
+			m.AppVersion = *av
+		case "p":
+			m.Policy = *p
+		case "ep":
+			m.Ephemeral = *ep
+		case "pr":
+			m.Priority = *pr
+		case "d":
+			m.Data = *d
+		case "e":
+			if !json.Valid([]byte(*e)) {
+				err = errors.New("-e: invalid json")
+			}
+			m.Ext = json.RawMessage(*e)
+		case "key":
+			m.IdempotencyKey = *key
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(m.UserIDs)+len(m.Tags)+len(m.Devices) == 0 && m.Expr == "" {
+		return errors.New("no target, use -us, -ts, -ms or -x")
+	}
+
+	c, ctx, cancel, err := connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	id, err := c.Push(ctx, m)
+	if err != nil {
+		return err
+	}
+	return output(*o, map[string]string{"id": id}, []string{"ID"}, [][]string{{id}})
+}
+
+func cmdStatus(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	connect := adminFlags(fs)
+	o := outputFlag(fs)
+	detail := fs.Bool("detail", false, "输出每个接收者的回执")
+	offset := fs.Int("offset", 0, "回执的偏移")
+	limit := fs.Int("limit", 100, "回执的数量")
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return errors.New("usage: sw status <msgid>")
+	}
+
+	c, ctx, cancel, err := connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	rs, err := c.Receipts(ctx, swadmin.ReceiptsRequest{ID: pos[0], Detail: *detail, Offset: *offset, Limit: *limit})
+	if err != nil {
+		return err
+	}
+	if *o != "table" {
+		return output(*o, rs, nil, nil)
+	}
+	printTable([]string{"ID", "TOTAL", "DELIVERED", "READ", "DELIVERED_RATE", "READ_RATE"}, [][]string{{
+		rs.ID,
+		strconv.FormatInt(rs.Total, 10),
+		strconv.FormatInt(rs.Delivered, 10),
+		strconv.FormatInt(rs.Read, 10),
+		strconv.FormatFloat(rs.DeliveredRate, 'f', 2, 64),
+		strconv.FormatFloat(rs.ReadRate, 'f', 2, 64),
+	}})
+	if *detail {
+		rows := [][]string{}
+		for _, r := range rs.Receipts {
+			rows = append(rows, []string{r.UserID, formatTime(r.DeliveredAt), formatTime(r.ReadAt)})
+		}
+		fmt.Println()
+		printTable([]string{"USER", "DELIVERED_AT", "READ_AT"}, rows)
+	}
+	return nil
+}
+
+// devicesOutput 输出设备列表
+func devicesOutput(format string, ds []swadmin.OnlineDevice) error {
+	rows := [][]string{}
+	for _, d := range ds {
+		rows = append(rows, []string{d.ClientID, d.Node, d.Transport, d.Platform, d.AppVersion, formatTime(&d.LoginAt)})
+	}
+	return output(format, ds, []string{"CLIENTID", "NODE", "TRANSPORT", "PLATFORM", "APP_VERSION", "LOGIN_AT"}, rows)
+}
+
+func cmdOnline(args []string) error {
+	fs := flag.NewFlagSet("online", flag.ContinueOnError)
+	connect := adminFlags(fs)
+	o := outputFlag(fs)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 {
+		return errors.New("usage: sw online <user>")
+	}
+
+	c, ctx, cancel, err := connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	ds, err := c.Online(ctx, pos[0])
+	if err != nil {
+		return err
+	}
+	return devicesOutput(*o, ds)
+}
+
+func cmdKick(args []string) error {
+	fs := flag.NewFlagSet("kick", flag.ContinueOnError)
+	connect := adminFlags(fs)
+	o := outputFlag(fs)
+	pos, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(pos) != 1 && len(pos) != 2 {
+		return errors.New("usage: sw kick <user> [clientid]")
+	}
+	clientid := ""
+	if len(pos) == 2 {
+		clientid = pos[1]
+	}
+
+	c, ctx, cancel, err := connect()
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	ds, err := c.Kick(ctx, pos[0], clientid)
+	if err != nil {
+		return err
+	}
+	return devicesOutput(*o, ds)
+}
+
+func cmdToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ContinueOnError)
+	o := outputFlag(fs)
+	u := fs.String("u", "", "用户id")
+	m := fs.String("m", "", "clientid")
+	secret := fs.String("secret", DefConfig.Secret, "secret")
+	ts := fs.Int64("ts", 0, "时间戳, 默认当前时间")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if *u == "" || *m == "" {
+		return errors.New("-u and -m are required")
+	}
+	if *ts == 0 {
+		*ts = time.Now().Unix()
+	}
+	t := strconv.FormatInt(*ts, 10)
+	tk := SignMD5(*secret, *u+*m, t)
+	return output(*o, map[string]interface{}{"u": *u, "m": *m, "ts": *ts, "tk": tk},
+		[]string{"USER", "CLIENTID", "TS", "TOKEN"}, [][]string{{*u, *m, t, tk}})
+}
+
+func cmdMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	db := fs.String("db", DefConfig.DB, "数据库连接")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	DefConfig.DB = *db
+	d, err := openDB()
+	if err != nil {
+		return err
+	}
+	if err := migrateDB(d); err != nil {
+		return err
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+func cmdListen(args []string) error {
+	fs := flag.NewFlagSet("listen", flag.ContinueOnError)
+	o := outputFlag(fs)
+	url := fs.String("url", localAddr("ws", "/ws"), "websocket 地址")
+	u := fs.String("u", "", "用户id")
+	m := fs.String("m", "", "clientid")
+	secret := fs.String("secret", DefConfig.Secret, "secret")
+	p := fs.String("p", "", "平台")
+	av := fs.String("av", "", "应用版本")
+	tags := fs.String("tags", "", "登录后订阅的标签, 以,分隔, 以-开头为取消订阅")
+	manual := fs.Bool("manual", false, "不自动回执, 使用 ack 命令回执")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if *u == "" || *m == "" {
+		return errors.New("-u and -m are required")
+	}
+	if *o != "json" && *o != "table" {
+		return errors.New("unknown output format: " + *o)
+	}
+
+	print := func(kind string, v interface{}, line string) {
+		if *o == "json" {
+			b, _ := json.Marshal(map[string]interface{}{"event": kind, "data": v})
+			fmt.Println(string(b))
+			return
+		}
+		fmt.Println(kind + "\t" + line)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		select {
+		case <-sig:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var c *swclient.Client
+	var err error
+	c, err = swclient.New(swclient.Config{
+		URL:        *url,
+		User:       *u,
+		ClientID:   *m,
+		Signer:     swclient.MD5Signer(*secret),
+		Platform:   *p,
+		AppVersion: *av,
+		ManualAck:  *manual,
+		Handler: func(msg swclient.Message) {
+			print("message", msg, fmt.Sprintf("%s\tsq=%d\tf=%s\t%s", msg.ID, msg.Seq, msg.From, msg.Data))
+		},
+		OnRequest: func(q swclient.Request) swclient.Reply {
+			print("request", q, q.ID+"\t"+q.Kind+"\t"+q.Data)
+			return swclient.Reply{Code: swclient.CodeOK}
+		},
+		OnConnect: func(r swclient.LoginResult) {
+			print("connect", r, fmt.Sprintf("v=%d sv=%s cs=%v ls=%d", r.Version, r.ServerVersion, r.Caps, r.LastSeq))
+			if *tags != "" {
+				go listenTag(ctx, c, strings.Join(splitList(*tags), " "), print)
+			}
+		},
+		OnDisconnect: func(err error) {
+			print("disconnect", fmt.Sprint(err), fmt.Sprint(err))
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "命令: +tag -tag 订阅/取消订阅, ack <id...>, read <id...>, quit")
+	go func() {
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			line := strings.TrimSpace(s.Text())
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			var err error
+			switch fields[0] {
+			case "quit", "exit":
+				cancel()
+				return
+			case "ack":
+				err = c.Ack(ctx, fields[1:]...)
+			case "read":
+				err = c.Read(ctx, fields[1:]...)
+			default:
+				if !strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "-") {
+					err = errors.New("unknown command: " + fields[0])
+					break
+				}
+				listenTag(ctx, c, line, print)
+				continue
+			}
+			if err != nil {
+				print("error", err.Error(), err.Error())
+			} else {
+				print("ok", line, line)
+			}
+		}
+	}()
+	err = c.Run(ctx)
+	if err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+// listenTag 执行 +tag -tag 命令
+func listenTag(ctx context.Context, c *swclient.Client, line string, print func(string, interface{}, string)) {
+	tags := map[string]bool{}
+	for _, f := range strings.Fields(line) {
+		switch {
+		case strings.HasPrefix(f, "+"):
+			tags[f[1:]] = true
+		case strings.HasPrefix(f, "-"):
+			tags[f[1:]] = false
+		default:
+			tags[f] = true
+		}
+	}
+	rs, err := c.Tag(ctx, tags, false)
+	if err != nil {
+		print("error", err.Error(), err.Error())
+		return
+	}
+	print("tag", rs, fmt.Sprint(rs))
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"bytes"
-	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -25,6 +26,21 @@ var (
 	space   = []byte{' '}
 )
 
+// 客户端的传输方式
+const (
+	TransportWS   = "ws"
+	TransportSSE  = "sse"
+	TransportPoll = "poll"
+	TransportMQTT = "mqtt"
+)
+
+// recv 的结果
+const (
+	recvFrame = iota
+	recvTick
+	recvDone
+)
+
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	node *Node
@@ -34,14 +50,141 @@ type Client struct {
 	clientid string
 	user     string
 	tags     []string
+	// 登录时上报的平台和应用版本
+	platform   string
+	appVersion string
+
+	// 连接时间
+	connected time.Time
+	// 登录时间
+	logined time.Time
 
 	log *zap.SugaredLogger
 
-	// The websocket connection.
+	// 传输方式
+	transport string
+	// 非 websocket 传输的会话id, 用于之后的请求
+	sid string
+	// 长轮询的状态, 其他传输方式为 nil
+	poll *pollState
+	// MQTT 的连接和状态, 其他传输方式为 nil
+	mqtt *mqttState
+	// The websocket connection, nil for other transports.
 	conn *websocket.Conn
+	// 协商出的编解码
+	codec Codec
+	// 协议版本
+	version int
+	// 协商出的能力
+	caps []string
+	// 合并发送, writePump 读取
+	batch int32
+	// 写压缩, 登录时按协商结果修改, writePump 在每个消息前应用
+	compress int32
+	// 未确认的消息, 未开启重发时为 nil
+	pending *pending
+	// 上行消息限流
+	limiter *limiter
+
+	// Buffered channels of outbound frames, one per priority.
+	send [lanes]chan interface{}
+
+	// Closed when the client is shut down.
+	done      chan struct{}
+	closeOnce sync.Once
+	unregOnce sync.Once
+}
+
+// write queues a frame for the writePump. It returns false if the client is
+// already closed.
+func (c *Client) write(frame interface{}) bool {
+	if c.poll != nil {
+		// 长轮询不阻塞发送, 缓存满时下次轮询从数据库补发
+		select {
+		case c.send[laneOf(frame)] <- frame:
+			return true
+		case <-c.done:
+			return false
+		default:
+			atomic.StoreInt32(&c.poll.dropped, 1)
+			return false
+		}
+	}
+	select {
+	case c.send[laneOf(frame)] <- frame:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// next 按优先级从高到低取一个已入队的帧, 不阻塞
+func (c *Client) next() (interface{}, bool) {
+	for i := lanes - 1; i >= 0; i-- {
+		select {
+		case frame := <-c.send[i]:
+			return frame, true
+		default:
+		}
+	}
+	return nil, false
+}
+
+// recv 按优先级取一个帧, 没有时等待新的帧、tick 或结束.
+// stop 为 nil 时只在客户端关闭时结束
+func (c *Client) recv(tick <-chan time.Time, stop <-chan struct{}) (interface{}, int) {
+	if frame, ok := c.next(); ok {
+		return frame, recvFrame
+	}
+	select {
+	case <-c.done:
+		return nil, recvDone
+	case <-stop:
+		return nil, recvDone
+	case frame := <-c.send[PriorityHigh-PriorityLow]:
+		return frame, recvFrame
+	case frame := <-c.send[PriorityNormal-PriorityLow]:
+		return frame, recvFrame
+	case frame := <-c.send[0]:
+		return frame, recvFrame
+	case <-tick:
+		return nil, recvTick
+	}
+}
+
+// close stops the writePump. It is safe to call more than once.
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// sent 记录已发送的消息, 用于重发
+func (c *Client) sent(ms []PushMessage) {
+	if c.pending != nil {
+		c.pending.add(ms)
+	}
+}
 
-	// Buffered channel of outbound messages.
-	send chan []byte
+// kick 发送关闭帧并断开连接
+func (c *Client) kick(code int, text string) {
+	c.log.Info("kick:", code, text)
+	if c.conn == nil {
+		// 其他传输方式在关闭前发送 close 帧
+		c.write(&CloseFrame{T: T_CLOSE, C: code, M: text})
+		c.close()
+		return
+	}
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// readDeadline 未登录的连接必须在登录超时前完成登录
+func (c *Client) readDeadline() time.Time {
+	if c.user == "" && DefConfig.Limit.LoginTimeout > 0 {
+		return c.connected.Add(time.Duration(DefConfig.Limit.LoginTimeout) * time.Second)
+	}
+	return time.Now().Add(pongWait)
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -52,11 +195,12 @@ type Client struct {
 func (c *Client) readPump() {
 	defer func() {
 		c.node.UnRegister(c)
+		c.close()
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(DefConfig.Client.ReadMessageSizeLimit)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetReadDeadline(c.readDeadline())
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(c.readDeadline()); return nil })
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
@@ -65,23 +209,14 @@ func (c *Client) readPump() {
 			}
 			break
 		}
-		message = bytes.TrimSpace(bytes.ReplaceAll(message, newline, space))
+		if c.codec.MessageType() == websocket.TextMessage {
+			message = bytes.TrimSpace(bytes.ReplaceAll(message, newline, space))
+		}
 		c.node.ClientHandler(c, message)
+		c.conn.SetReadDeadline(c.readDeadline())
 	}
 }
 
-func istoss(v []interface{}) []string {
-	ss := []string{}
-	for _, vv := range v {
-		ss = append(ss, fmt.Sprint(vv))
-	}
-	return ss
-}
-
-func resp(rt, i, c, m string) []byte {
-	return []byte(`{"t":"r","rt":"` + rt + `","i":"` + i + `","c":` + c + `,"m":"` + m + `"}`)
-}
-
 // writePump pumps messages from the hub to the websocket connection.
 //
 // A goroutine running writePump is started for each connection. The
@@ -94,42 +229,64 @@ func (c *Client) writePump() {
 		c.conn.Close()
 	}()
 	for {
-		select {
-		case message, ok := <-c.send:
+		// Higher priority lanes are drained first; block only when all are empty.
+		frame, r := c.recv(ticker.C, nil)
+		switch r {
+		case recvDone:
+			// The hub closed the client.
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				c.log.Errorf("NextWriter:%v\n", err.Error())
-				return
-			}
-			c.log.Infof("Write:%v\n", string(message))
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			// n := len(c.send)
-			// for i := 0; i < n; i++ {
-			//     w.Write(newline)
-			//     message = <-c.send
-			//     c.log.Infof("Write:%v\n", string(message))
-			//     w.Write(message)
-			// }
-
-			if err := w.Close(); err != nil {
-				c.log.Errorf("NextWriter Close:%v\n", err.Error())
-				return
-			}
-		case <-ticker.C:
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case recvTick:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				c.log.Errorf("WriteMessage PingMessage:%v\n", err.Error())
 				return
 			}
+			continue
+		}
+
+		message, err := c.codec.Marshal(frame)
+		if err != nil {
+			c.log.Errorf("Marshal:%v\n", err.Error())
+			continue
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+		c.conn.EnableWriteCompression(atomic.LoadInt32(&c.compress) == 1)
+		w, err := c.conn.NextWriter(c.codec.MessageType())
+		if err != nil {
+			c.log.Errorf("NextWriter:%v\n", err.Error())
+			return
+		}
+		c.log.Infof("Write:%v %+v\n", c.codec.Name(), frame)
+		w.Write(message)
+
+		// Add queued frames to the current websocket message.
+		if atomic.LoadInt32(&c.batch) == 1 {
+			n := 0
+			for i := range c.send {
+				n += len(c.send[i])
+			}
+			for i := 0; i < n; i++ {
+				frame, ok := c.next()
+				if !ok {
+					break
+				}
+				message, err := c.codec.Marshal(frame)
+				if err != nil {
+					c.log.Errorf("Marshal:%v\n", err.Error())
+					continue
+				}
+				c.log.Infof("Write:%v %+v\n", c.codec.Name(), frame)
+				w.Write(newline)
+				w.Write(message)
+			}
+		}
+
+		if err := w.Close(); err != nil {
+			c.log.Errorf("NextWriter Close:%v\n", err.Error())
+			return
 		}
 	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"go.uber.org/zap"
+)
+
+// Cluster 节点间的广播, 消息发给所有订阅的节点
+type Cluster interface {
+	Publish(ctx context.Context, data []byte) error
+	// Subscribe 接收广播的消息, 关闭后 channel 关闭
+	Subscribe() <-chan []byte
+	Close() error
+}
+
+// newCluster 按配置创建集群, 没有开启时返回 nil
+func newCluster() (Cluster, error) {
+	if !DefConfig.Redis.Enable {
+		return nil, nil
+	}
+	if DefConfig.Redis.Name == "" {
+		DefConfig.Redis.Name = time.Now().Format("Node-20060102150405")
+	}
+	if DefConfig.Redis.Channel == "" {
+		DefConfig.Redis.Channel = DefConfig.Redis.Name
+	}
+	rdb := redis.NewClient(&redis.Options{
+		Addr:         DefConfig.Redis.Host,
+		DialTimeout:  10 * time.Second,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		PoolSize:     10,
+		PoolTimeout:  30 * time.Second,
+	})
+	if err := rdb.Ping(context.Background()).Err(); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return &redisCluster{rdb: rdb, channel: DefConfig.Redis.Channel}, nil
+}
+
+// redisCluster 通过 redis pub/sub 广播
+type redisCluster struct {
+	rdb     *redis.Client
+	channel string
+	rpub    *redis.PubSub
+}
+
+func (c *redisCluster) Publish(ctx context.Context, data []byte) error {
+	return c.rdb.Publish(ctx, c.channel, string(data)).Err()
+}
+
+func (c *redisCluster) Subscribe() <-chan []byte {
+	if c.rpub != nil {
+		c.rpub.Close()
+	}
+	c.rpub = c.rdb.Subscribe(context.Background(), c.channel)
+	ch := make(chan []byte)
+	go func(msgs <-chan *redis.Message) {
+		defer close(ch)
+		for msg := range msgs {
+			ch <- []byte(msg.Payload)
+		}
+	}(c.rpub.Channel())
+	return ch
+}
+
+func (c *redisCluster) Close() error {
+	if c.rpub != nil {
+		c.rpub.Close()
+	}
+	return c.rdb.Close()
+}
+
+// broadcast 把消息发给集群内的其他节点
+func (n *Node) broadcast(ctx context.Context, m ClusterMessage) error {
+	m.NodeName = n.name
+	d, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return n.cluster.Publish(ctx, d)
+}
+
+// clusterRev 处理其他节点的消息
+func (n *Node) clusterRev() {
+	log := zap.S().With("method", "clusterRev", "node", n.name)
+	defer func() {
+		if err := recover(); err != nil {
+			log.Error("ClusterRev err:", err)
+			go n.clusterRev()
+		}
+	}()
+
+	for data := range n.cluster.Subscribe() {
+		m := ClusterMessage{}
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Error("ClusterRev Json Error:", string(data), err)
+			continue
+		}
+		if m.NodeName == n.name {
+			continue
+		}
+		log.Info("ClusterRev:", m.NodeName, m.Message)
+
+		switch {
+		case m.RPC != nil:
+			// 客户端的发送队列满时会阻塞, 不能卡住集群消息
+			go n.request(*m.RPC)
+			continue
+		case m.Reply != nil:
+			if m.Reply.Node == n.name {
+				n.reply(m.Reply)
+			}
+			continue
+		case m.Query != nil:
+			go n.answerCluster(*m.Query)
+			continue
+		case m.Answer != nil:
+			if m.Answer.To == n.name {
+				n.gather(m.Answer)
+			}
+			continue
+		}
+		go n.deliver(m.Message, m.Timestamp, m.Seqs, m.Devices)
+	}
+}
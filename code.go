@@ -1,7 +1,25 @@
 package main
 
 const (
-	C_OK   = "0"
-	C_FAIL = "1000"
-	C_AUTH = "1001"
+	C_OK    = "0"
+	C_FAIL  = "1000"
+	C_AUTH  = "1001"
+	C_LIMIT = "1002"
+
+	// 帧不是合法的json对象
+	C_FORMAT = "1003"
+	// 字段缺失或类型错误
+	C_PARAM = "1004"
+	// 未知的帧类型
+	C_TYPE = "1005"
+	// 不支持的协议版本
+	C_VERSION = "1006"
+	// 没有权限
+	C_FORBIDDEN = "1007"
+	// 等待超时
+	C_TIMEOUT = "1008"
+	// 客户端不在线
+	C_OFFLINE = "1009"
+	// 消息不存在或不是发给该用户的
+	C_NOTFOUND = "1010"
 )
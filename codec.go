@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Codec 客户端帧的编解码, 通过 Sec-WebSocket-Protocol 协商
+type Codec interface {
+	Name() string
+	// MessageType websocket.TextMessage 或 websocket.BinaryMessage
+	MessageType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+const (
+	CodecJSON    = "sw.json"
+	CodecMsgpack = "sw.msgpack"
+	CodecProto   = "sw.proto"
+)
+
+// codecs 按服务端偏好排序
+var codecs = []Codec{
+	jsonCodec{},
+	msgpackCodec{},
+	protoCodec{},
+}
+
+// getCodec 未协商出子协议时使用json
+func getCodec(name string) Codec {
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return jsonCodec{}
+}
+
+func codecNames() []string {
+	names := []string{}
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string     { return CodecJSON }
+func (jsonCodec) MessageType() int { return websocket.TextMessage }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// msgpackCodec 复用json标签
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string     { return CodecMsgpack }
+func (msgpackCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// protoCodec 按结构体的 proto 标签编码, 消息定义见 schema/sw.proto
+type protoCodec struct{}
+
+func (protoCodec) Name() string     { return CodecProto }
+func (protoCodec) MessageType() int { return websocket.BinaryMessage }
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("proto: unsupported type %s", rv.Type())
+	}
+	return protoAppendStruct(nil, rv)
+}
+
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("proto: unmarshal requires a non-nil pointer")
+	}
+	rv = rv.Elem()
+	if rv.Kind() != reflect.Struct {
+		return fmt.Errorf("proto: unsupported type %s", rv.Type())
+	}
+	return protoConsumeStruct(data, rv)
+}
+
+type protoField struct {
+	num   protowire.Number
+	index []int
+	name  string
+}
+
+var protoFieldCache sync.Map
+
+// protoFields 收集结构体(含匿名嵌入结构体)中带 proto 标签的字段
+func protoFields(t reflect.Type) []protoField {
+	if v, ok := protoFieldCache.Load(t); ok {
+		return v.([]protoField)
+	}
+	fs := []protoField{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			for _, f := range protoFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fs = append(fs, f)
+			}
+			continue
+		}
+		tag := sf.Tag.Get("proto")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		num, err := strconv.Atoi(tag)
+		if err != nil {
+			panic(fmt.Sprintf("proto: bad tag on %s.%s: %q", t, sf.Name, tag))
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = sf.Name
+		}
+		fs = append(fs, protoField{num: protowire.Number(num), index: []int{i}, name: name})
+	}
+	sort.Slice(fs, func(i, j int) bool { return fs[i].num < fs[j].num })
+	protoFieldCache.Store(t, fs)
+	return fs
+}
+
+func protoAppendStruct(b []byte, rv reflect.Value) ([]byte, error) {
+	var err error
+	for _, f := range protoFields(rv.Type()) {
+		b, err = protoAppendField(b, f.num, rv.FieldByIndex(f.index))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func protoAppendField(b []byte, num protowire.Number, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		// 指针字段有显式存在性, 零值也写入
+		if v.IsNil() {
+			return b, nil
+		}
+		return protoAppendValue(b, num, v.Elem())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if v.Len() == 0 {
+				return b, nil
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			return protowire.AppendBytes(b, v.Bytes()), nil
+		}
+		var err error
+		for i := 0; i < v.Len(); i++ {
+			if b, err = protoAppendValue(b, num, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		for _, k := range keys {
+			var entry []byte
+			var err error
+			if entry, err = protoAppendValue(entry, 1, k); err != nil {
+				return nil, err
+			}
+			if entry, err = protoAppendValue(entry, 2, v.MapIndex(k)); err != nil {
+				return nil, err
+			}
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+		return b, nil
+	}
+	if v.IsZero() {
+		return b, nil
+	}
+	return protoAppendValue(b, num, v)
+}
+
+// protoAppendValue 编码单个值, 零值也会写入(用于 repeated 和 map)
+func protoAppendValue(b []byte, num protowire.Number, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v = reflect.New(v.Type().Elem())
+		}
+		return protoAppendValue(b, num, v.Elem())
+	case reflect.String:
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, v.String()), nil
+	case reflect.Bool:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v.Bool())), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, v.Uint()), nil
+	case reflect.Float32:
+		b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+		return protowire.AppendFixed32(b, math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(v.Float())), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			return protowire.AppendBytes(b, v.Bytes()), nil
+		}
+	case reflect.Struct:
+		m, err := protoAppendStruct(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, m), nil
+	}
+	return nil, fmt.Errorf("proto: unsupported type %s", v.Type())
+}
+
+func protoConsumeStruct(b []byte, rv reflect.Value) error {
+	fs := protoFields(rv.Type())
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var field *protoField
+		for i := range fs {
+			if fs[i].num == num {
+				field = &fs[i]
+				break
+			}
+		}
+		if field == nil {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		n, err := protoConsumeField(b, typ, rv.FieldByIndex(field.index))
+		if err != nil {
+			return fmt.Errorf("field %s: %v", field.name, err)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func protoConsumeField(b []byte, typ protowire.Type, v reflect.Value) (int, error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return protoConsumeField(b, typ, v.Elem())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		// packed repeated scalar
+		if typ == protowire.BytesType && isProtoScalar(elem.Kind()) {
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			for len(data) > 0 {
+				elem = reflect.New(v.Type().Elem()).Elem()
+				m, err := protoConsumeValue(data, protoScalarType(elem.Kind()), elem)
+				if err != nil {
+					return 0, err
+				}
+				v.Set(reflect.Append(v, elem))
+				data = data[m:]
+			}
+			return n, nil
+		}
+		n, err := protoConsumeValue(b, typ, elem)
+		if err != nil {
+			return 0, err
+		}
+		v.Set(reflect.Append(v, elem))
+		return n, nil
+	case reflect.Map:
+		if typ != protowire.BytesType {
+			return 0, errors.New("expect map entry")
+		}
+		entry, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		val := reflect.New(v.Type().Elem()).Elem()
+		for len(entry) > 0 {
+			num, etyp, m := protowire.ConsumeTag(entry)
+			if m < 0 {
+				return 0, protowire.ParseError(m)
+			}
+			entry = entry[m:]
+			switch num {
+			case 1:
+				m, err := protoConsumeValue(entry, etyp, key)
+				if err != nil {
+					return 0, err
+				}
+				entry = entry[m:]
+			case 2:
+				m, err := protoConsumeValue(entry, etyp, val)
+				if err != nil {
+					return 0, err
+				}
+				entry = entry[m:]
+			default:
+				m = protowire.ConsumeFieldValue(num, etyp, entry)
+				if m < 0 {
+					return 0, protowire.ParseError(m)
+				}
+				entry = entry[m:]
+			}
+		}
+		v.SetMapIndex(key, val)
+		return n, nil
+	}
+	return protoConsumeValue(b, typ, v)
+}
+
+func isProtoScalar(k reflect.Kind) bool {
+	switch k {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// protoScalarType 标量的 wire type, float 为 fixed32, double 为 fixed64
+func protoScalarType(k reflect.Kind) protowire.Type {
+	switch k {
+	case reflect.Float32:
+		return protowire.Fixed32Type
+	case reflect.Float64:
+		return protowire.Fixed64Type
+	}
+	return protowire.VarintType
+}
+
+func protoConsumeValue(b []byte, typ protowire.Type, v reflect.Value) (int, error) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return protoConsumeValue(b, typ, v.Elem())
+	case reflect.String:
+		if typ != protowire.BytesType {
+			return 0, errors.New("expect string")
+		}
+		s, n := protowire.ConsumeString(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		v.SetString(s)
+		return n, nil
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if typ != protowire.VarintType {
+			return 0, fmt.Errorf("expect %s", v.Kind())
+		}
+		x, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(protowire.DecodeBool(x))
+		case reflect.Uint, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			v.SetUint(x)
+		default:
+			v.SetInt(int64(x))
+		}
+		return n, nil
+	case reflect.Float32:
+		if typ != protowire.Fixed32Type {
+			return 0, errors.New("expect float")
+		}
+		x, n := protowire.ConsumeFixed32(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		v.SetFloat(float64(math.Float32frombits(x)))
+		return n, nil
+	case reflect.Float64:
+		if typ != protowire.Fixed64Type {
+			return 0, errors.New("expect double")
+		}
+		x, n := protowire.ConsumeFixed64(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		v.SetFloat(math.Float64frombits(x))
+		return n, nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if typ != protowire.BytesType {
+				return 0, errors.New("expect bytes")
+			}
+			data, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return 0, protowire.ParseError(n)
+			}
+			v.SetBytes(append([]byte{}, data...))
+			return n, nil
+		}
+	case reflect.Struct:
+		if typ != protowire.BytesType {
+			return 0, errors.New("expect message")
+		}
+		data, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		return n, protoConsumeStruct(data, v)
+	}
+	return 0, fmt.Errorf("unsupported type %s", v.Type())
+}
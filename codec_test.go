@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// protoScalars .proto 标量类型到描述符类型
+var protoScalars = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"int32":  descriptorpb.FieldDescriptorProto_TYPE_INT32,
+	"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"uint32": descriptorpb.FieldDescriptorProto_TYPE_UINT32,
+	"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	"float":  descriptorpb.FieldDescriptorProto_TYPE_FLOAT,
+	"double": descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+}
+
+var (
+	protoMessageRe = regexp.MustCompile(`(?s)message\s+(\w+)\s*\{(.*?)\}`)
+	protoFieldRe   = regexp.MustCompile(`^(repeated\s+|optional\s+)?(map<\s*(\w+)\s*,\s*(\w+)\s*>|\w+)\s+(\w+)\s*=\s*(\d+)\s*;$`)
+	protoCommentRe = regexp.MustCompile(`//[^\n]*`)
+)
+
+// parseProto 解析 schema/sw.proto 用到的 proto3 子集, 由官方运行时构建描述符,
+// 用来代替 protoc 生成的代码校验手写编码器的兼容性
+func parseProto(t *testing.T, src string) protoreflect.FileDescriptor {
+	t.Helper()
+	src = protoCommentRe.ReplaceAllString(src, "")
+	pkg := regexp.MustCompile(`package\s+(\w+)\s*;`).FindStringSubmatch(src)[1]
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String(pkg + ".proto"),
+		Package: proto.String(pkg),
+		Syntax:  proto.String("proto3"),
+	}
+	typ := func(m *descriptorpb.DescriptorProto, f *descriptorpb.FieldDescriptorProto, name string) {
+		if st, ok := protoScalars[name]; ok {
+			f.Type = st.Enum()
+			return
+		}
+		f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+		f.TypeName = proto.String("." + pkg + "." + name)
+	}
+	for _, mm := range protoMessageRe.FindAllStringSubmatch(src, -1) {
+		m := &descriptorpb.DescriptorProto{Name: proto.String(mm[1])}
+		for _, line := range strings.Split(mm[2], "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			fm := protoFieldRe.FindStringSubmatch(line)
+			if fm == nil {
+				t.Fatalf("%s: unsupported line %q", mm[1], line)
+			}
+			num, _ := strconv.Atoi(fm[6])
+			f := &descriptorpb.FieldDescriptorProto{
+				Name:     proto.String(fm[5]),
+				JsonName: proto.String(fm[5]),
+				Number:   proto.Int32(int32(num)),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			}
+			switch {
+			case fm[3] != "":
+				entry := &descriptorpb.DescriptorProto{
+					Name:    proto.String(strings.Title(fm[5]) + "Entry"),
+					Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+				}
+				for i, name := range []string{"key", "value"} {
+					ef := &descriptorpb.FieldDescriptorProto{
+						Name:     proto.String(name),
+						JsonName: proto.String(name),
+						Number:   proto.Int32(int32(i + 1)),
+						Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					}
+					typ(entry, ef, fm[3+i])
+					entry.Field = append(entry.Field, ef)
+				}
+				m.NestedType = append(m.NestedType, entry)
+				f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				f.Type = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum()
+				f.TypeName = proto.String("." + pkg + "." + mm[1] + "." + entry.GetName())
+			case strings.HasPrefix(fm[1], "repeated"):
+				f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+				typ(m, f, fm[2])
+			case strings.HasPrefix(fm[1], "optional"):
+				// proto3 optional 对应一个合成的 oneof
+				f.Proto3Optional = proto.Bool(true)
+				f.OneofIndex = proto.Int32(int32(len(m.OneofDecl)))
+				m.OneofDecl = append(m.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + fm[5])})
+				typ(m, f, fm[2])
+			default:
+				typ(m, f, fm[2])
+			}
+			m.Field = append(m.Field, f)
+		}
+		fd.MessageType = append(fd.MessageType, m)
+	}
+	file, err := protodesc.NewFile(fd, nil)
+	if err != nil {
+		t.Fatal("descriptor:", err)
+	}
+	return file
+}
+
+// compareProto 校验 proto 标签字段与 .proto 中的定义同名同号, 且值相同
+func compareProto(t *testing.T, path string, rv reflect.Value, m protoreflect.Message) {
+	t.Helper()
+	for _, f := range protoFields(rv.Type()) {
+		fd := m.Descriptor().Fields().ByNumber(f.num)
+		name := path + "." + f.name
+		if fd == nil || string(fd.Name()) != f.name {
+			t.Errorf("%s: field %d is not defined as %s in sw.proto", name, f.num, f.name)
+			continue
+		}
+		gv := rv.FieldByIndex(f.index)
+		switch {
+		case gv.Kind() == reflect.Ptr:
+			if gv.IsNil() != !m.Has(fd) {
+				t.Errorf("%s: presence differs", name)
+			} else if !gv.IsNil() {
+				compareProtoValue(t, name, gv.Elem(), m.Get(fd), fd)
+			}
+		case fd.IsMap():
+			pm := m.Get(fd).Map()
+			if pm.Len() != gv.Len() {
+				t.Errorf("%s: %d entries, proto has %d", name, gv.Len(), pm.Len())
+				continue
+			}
+			for _, k := range gv.MapKeys() {
+				key := protoreflect.ValueOf(k.Interface()).MapKey()
+				compareProtoValue(t, name+"["+k.String()+"]", gv.MapIndex(k), pm.Get(key), fd.MapValue())
+			}
+		case fd.IsList():
+			pl := m.Get(fd).List()
+			if pl.Len() != gv.Len() {
+				t.Errorf("%s: %d items, proto has %d", name, gv.Len(), pl.Len())
+				continue
+			}
+			for i := 0; i < gv.Len(); i++ {
+				compareProtoValue(t, fmt.Sprintf("%s[%d]", name, i), gv.Index(i), pl.Get(i), fd)
+			}
+		default:
+			compareProtoValue(t, name, gv, m.Get(fd), fd)
+		}
+	}
+}
+
+func compareProtoValue(t *testing.T, name string, gv reflect.Value, pv protoreflect.Value, fd protoreflect.FieldDescriptor) {
+	t.Helper()
+	if fd.Kind() == protoreflect.MessageKind {
+		compareProto(t, name, gv, pv.Message())
+		return
+	}
+	if fd.Kind() == protoreflect.BytesKind {
+		if !bytes.Equal(gv.Bytes(), pv.Bytes()) {
+			t.Errorf("%s: %q, proto has %q", name, gv.Bytes(), pv.Bytes())
+		}
+		return
+	}
+	if a, b := fmt.Sprint(gv.Interface()), fmt.Sprint(pv.Interface()); a != b {
+		t.Errorf("%s: %s, proto has %s", name, a, b)
+	}
+}
+
+// testFrames 每种帧一个字段全部非零的样例, 对应 sw.proto 中的消息
+func testFrames() map[string]interface{} {
+	zero := int64(0)
+	return map[string]interface{}{
+		"Frame": &Frame{T: T_LOGIN, I: "1"},
+		"Login": &LoginFrame{
+			Frame: Frame{T: T_LOGIN, I: "1"},
+			U:     "u1", M: "m1", Tk: "tk", Ts: 1600000000, V: 2,
+			Cs: []string{CapResume, CapCodec},
+			// 显式的 0 也要保留
+			S: &zero,
+			P: "ios", Av: "2.3.0",
+		},
+		"Tag":      &TagFrame{Frame: Frame{T: T_TAG, I: "2"}, D: map[string]bool{"a": true, "b": false}, Dv: true},
+		"Ack":      &AckFrame{Frame: Frame{T: T_ACK, I: "3"}, ID: []string{"x", "y"}, K: AckRead},
+		"Upstream": &UpstreamFrame{Frame: Frame{T: T_UPSTREAM, I: "4"}, K: "k", D: "d"},
+		"Send":     &SendFrame{Frame: Frame{T: T_SEND, I: "5"}, Us: []string{"u2"}, Ts: []string{"t1"}, D: "d", Ep: true},
+		"Reply":    &ReplyFrame{Frame: Frame{T: T_REPLY, I: "6"}, C: -1, D: "d", M: "m"},
+		"Resp": &LoginRespFrame{
+			RespFrame: RespFrame{T: T_RESP, Rt: T_LOGIN, I: "1", C: 1004, M: "m"},
+			V:         2, Sv: Version, Cs: []string{CapResume}, Cd: []string{CodecProto},
+			Ls: 42, Rs: true, Sid: "sid",
+		},
+		"Close":    &CloseFrame{T: T_CLOSE, C: 1008, M: "kicked"},
+		"Messages": &PushMessageClient{T: "m", Ms: []PushMessage{{ID: "1", Ts: 1, Data: "d", Seq: 2, From: "u2", Ep: true, Pr: 9, Ext: json.RawMessage(`{"k":1}`)}, {ID: "2"}}},
+		"Request":  &RequestFrame{T: "q", I: "7", K: "k", D: "d"},
+	}
+}
+
+func TestProtoCodecCompat(t *testing.T) {
+	src, err := ioutil.ReadFile("schema/sw.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := parseProto(t, string(src))
+	frames := testFrames()
+	frames["Resp"] = &TagRespFrame{RespFrame: RespFrame{T: T_RESP, Rt: T_TAG, I: "2", C: 1000}, R: map[string]int{"a": 0, "b": 1004}}
+	for name, v := range testFrames() {
+		if name == "Resp" {
+			name = "Resp/login"
+		}
+		frames[name] = v
+	}
+	for name, v := range frames {
+		md := file.Messages().ByName(protoreflect.Name(strings.Split(name, "/")[0]))
+		if md == nil {
+			t.Fatalf("%s: not defined in sw.proto", name)
+		}
+		data, err := protoCodec{}.Marshal(v)
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", name, err)
+		}
+		m := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(data, m); err != nil {
+			t.Fatalf("%s: official unmarshal: %v", name, err)
+		}
+		if len(m.GetUnknown()) > 0 {
+			t.Errorf("%s: unknown fields %x", name, m.GetUnknown())
+		}
+		compareProto(t, name, reflect.ValueOf(v).Elem(), m)
+
+		back, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+		if err != nil {
+			t.Fatalf("%s: official marshal: %v", name, err)
+		}
+		out := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := (protoCodec{}).Unmarshal(back, out); err != nil {
+			t.Fatalf("%s: unmarshal: %v", name, err)
+		}
+		if !reflect.DeepEqual(v, out) {
+			t.Errorf("%s: round trip\n got %+v\nwant %+v", name, out, v)
+		}
+	}
+}
+
+func TestProtoCodecFloat(t *testing.T) {
+	type floats struct {
+		F  float32   `json:"f" proto:"1"`
+		D  float64   `json:"d" proto:"2"`
+		Fs []float32 `json:"fs" proto:"3"`
+		Ds []float64 `json:"ds" proto:"4"`
+	}
+	file := parseProto(t, `syntax = "proto3"; package t;
+message Floats {
+  float f = 1;
+  double d = 2;
+  repeated float fs = 3;
+  repeated double ds = 4;
+}`)
+	v := &floats{F: 1.5, D: -2.25, Fs: []float32{0.5, -3}, Ds: []float64{1e100, 0}}
+	data, err := protoCodec{}.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := dynamicpb.NewMessage(file.Messages().ByName("Floats"))
+	if err := proto.Unmarshal(data, m); err != nil {
+		t.Fatal("official unmarshal:", err)
+	}
+	compareProto(t, "Floats", reflect.ValueOf(v).Elem(), m)
+	// 官方编码的 repeated float 是 packed
+	back, err := proto.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &floats{}
+	if err := (protoCodec{}).Unmarshal(back, out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, out) {
+		t.Fatalf("round trip: got %+v, want %+v", out, v)
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	for name, v := range testFrames() {
+		data, err := msgpackCodec{}.Marshal(v)
+		if err != nil {
+			t.Fatalf("%s: marshal: %v", name, err)
+		}
+		out := reflect.New(reflect.TypeOf(v).Elem()).Interface()
+		if err := (msgpackCodec{}).Unmarshal(data, out); err != nil {
+			t.Fatalf("%s: unmarshal: %v", name, err)
+		}
+		if !reflect.DeepEqual(v, out) {
+			t.Errorf("%s: round trip\n got %+v\nwant %+v", name, out, v)
+		}
+		// 键与 json 相同
+		mk := map[string]interface{}{}
+		if err := (msgpackCodec{}).Unmarshal(data, &mk); err != nil {
+			t.Fatalf("%s: unmarshal map: %v", name, err)
+		}
+		jd, _ := json.Marshal(v)
+		jk := map[string]interface{}{}
+		json.Unmarshal(jd, &jk)
+		if a, b := mapKeys(mk), mapKeys(jk); !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: msgpack keys %v, json keys %v", name, a, b)
+		}
+	}
+}
+
+// TestDecodeFrameCodecs 各编码的客户端帧解析结果相同
+func TestDecodeFrameCodecs(t *testing.T) {
+	for name, v := range testFrames() {
+		want, ok := v.(validator)
+		if !ok || name == "Frame" {
+			continue
+		}
+		for _, codec := range codecs {
+			data, err := codec.Marshal(v)
+			if err != nil {
+				t.Fatalf("%s %s: marshal: %v", codec.Name(), name, err)
+			}
+			_, f, ferr := decodeFrame(codec, data)
+			if ferr != nil {
+				t.Fatalf("%s %s: decode: %v", codec.Name(), name, ferr)
+			}
+			if !reflect.DeepEqual(f, want) {
+				t.Errorf("%s %s:\n got %+v\nwant %+v", codec.Name(), name, f, want)
+			}
+		}
+	}
+}
+
+func mapKeys(m map[string]interface{}) []string {
+	ks := []string{}
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
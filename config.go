@@ -13,6 +13,14 @@ type Config struct {
 
 	Redis  RedisConfig  `json:"redis" yaml:"redis" mapstructure:"redis"`
 	Client ClientConfig `json:"client" yaml:"client" mapstructure:"client"`
+	Limit  LimitConfig  `json:"limit" yaml:"limit" mapstructure:"limit"`
+	Device DeviceConfig `json:"device" yaml:"device" mapstructure:"device"`
+
+	Redelivery RedeliveryConfig `json:"redelivery" yaml:"redelivery" mapstructure:"redelivery"`
+	Upstream   UpstreamConfig   `json:"upstream" yaml:"upstream" mapstructure:"upstream"`
+	Direct     DirectConfig     `json:"direct" yaml:"direct" mapstructure:"direct"`
+	Poll       PollConfig       `json:"poll" yaml:"poll" mapstructure:"poll"`
+	MQTT       MQTTConfig       `json:"mqtt" yaml:"mqtt" mapstructure:"mqtt"`
 }
 
 type RedisConfig struct {
@@ -29,3 +37,87 @@ type ClientConfig struct {
 	ReadBufferSize       int   `json:"read_buffer_size" yaml:"read_buffer_size" mapstructure:"read_buffer_size"`
 	WriteBufferSize      int   `json:"write_buffer_size" yaml:"write_buffer_size" mapstructure:"write_buffer_size"`
 }
+
+const (
+	// 设备数超限时踢掉最早登录的设备
+	DevicePolicyEvict = "evict"
+	// 设备数超限时拒绝新设备登录
+	DevicePolicyReject = "reject"
+)
+
+type LimitConfig struct {
+	MaxDevices     int    `json:"max_devices" yaml:"max_devices" mapstructure:"max_devices"`
+	DevicePolicy   string `json:"device_policy" yaml:"device_policy" mapstructure:"device_policy"`
+	MaxConnections int64  `json:"max_connections" yaml:"max_connections" mapstructure:"max_connections"`
+	MaxUnauth      int64  `json:"max_unauth" yaml:"max_unauth" mapstructure:"max_unauth"`
+	LoginTimeout   int    `json:"login_timeout" yaml:"login_timeout" mapstructure:"login_timeout"`
+}
+
+type DeviceConfig struct {
+	// 设备多久没有登录或收到消息后不再计入 each 策略的确认, 秒, 默认 7 天
+	ActiveTTL int `json:"active_ttl" yaml:"active_ttl" mapstructure:"active_ttl"`
+}
+
+type RedeliveryConfig struct {
+	Enable bool `json:"enable" yaml:"enable" mapstructure:"enable"`
+	// 第一次重发前等待的秒数
+	Interval int `json:"interval" yaml:"interval" mapstructure:"interval"`
+	// 每次重发后等待时间的倍数
+	Backoff float64 `json:"backoff" yaml:"backoff" mapstructure:"backoff"`
+	// 最长等待秒数
+	MaxInterval int `json:"max_interval" yaml:"max_interval" mapstructure:"max_interval"`
+	// 最多重发次数, 之后等下次登录时补发
+	MaxAttempts int `json:"max_attempts" yaml:"max_attempts" mapstructure:"max_attempts"`
+}
+
+// 上行消息的转发目标
+const (
+	SinkWebhook = "webhook"
+	SinkRedis   = "redis"
+)
+
+type UpstreamConfig struct {
+	Enable bool   `json:"enable" yaml:"enable" mapstructure:"enable"`
+	Sink   string `json:"sink" yaml:"sink" mapstructure:"sink"`
+	// webhook 地址, 请求按 Admin 的方式签名
+	Webhook string `json:"webhook" yaml:"webhook" mapstructure:"webhook"`
+	// redis stream 名称, 使用 redis.host
+	Stream string `json:"stream" yaml:"stream" mapstructure:"stream"`
+	// 每个连接每秒允许的消息数和突发数
+	Rate  float64 `json:"rate" yaml:"rate" mapstructure:"rate"`
+	Burst int     `json:"burst" yaml:"burst" mapstructure:"burst"`
+	// d 的最大字节数
+	MaxSize int `json:"max_size" yaml:"max_size" mapstructure:"max_size"`
+	// 转发超时秒数
+	Timeout int `json:"timeout" yaml:"timeout" mapstructure:"timeout"`
+}
+
+type DirectConfig struct {
+	Enable bool `json:"enable" yaml:"enable" mapstructure:"enable"`
+	// 是否允许发送给标签
+	AllowTags bool `json:"allow_tags" yaml:"allow_tags" mapstructure:"allow_tags"`
+	// 单条消息最多的目标用户和标签数, 0 不限制
+	MaxTargets int `json:"max_targets" yaml:"max_targets" mapstructure:"max_targets"`
+	// 发送权限检查的 webhook 地址, 为空时不检查
+	Checker string `json:"checker" yaml:"checker" mapstructure:"checker"`
+	// webhook 超时秒数
+	Timeout int `json:"timeout" yaml:"timeout" mapstructure:"timeout"`
+}
+
+type PollConfig struct {
+	// 没有消息时最长等待的秒数
+	Wait int `json:"wait" yaml:"wait" mapstructure:"wait"`
+	// 两次轮询之间会话保留的秒数, 超过后视为离线
+	SessionTTL int `json:"session_ttl" yaml:"session_ttl" mapstructure:"session_ttl"`
+	// 会话缓存的帧数, 缓存满后下次轮询从数据库补发
+	Buffer int `json:"buffer" yaml:"buffer" mapstructure:"buffer"`
+	// 每次最多返回的消息数
+	MaxBatch int `json:"max_batch" yaml:"max_batch" mapstructure:"max_batch"`
+}
+
+type MQTTConfig struct {
+	Enable bool   `json:"enable" yaml:"enable" mapstructure:"enable"`
+	Host   string `json:"host" yaml:"host" mapstructure:"host"`
+	// 每个连接最多等待 PUBACK 的消息数, 超过时等待 PUBACK 后再发布, 0 为 100
+	Inflight int `json:"inflight" yaml:"inflight" mapstructure:"inflight"`
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 消息确认策略
+const (
+	// 任一设备确认即视为已确认
+	PolicyAny = "any"
+	// 每个设备都需要确认
+	PolicyEach = "each"
+)
+
+func validPolicy(p string) bool {
+	return p == "" || p == PolicyAny || p == PolicyEach
+}
+
+// touchDevice 记录用户登录的设备
+func (n *Node) touchDevice(c *Client) {
+	now := time.Now()
+	if err := n.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "userid"}, {Name: "clientid"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"last_seen":   now,
+			"updated_at":  now,
+			"platform":    c.platform,
+			"app_version": c.appVersion,
+		}),
+	}).Create(&UserDevice{
+		UsersID:    c.user,
+		ClientID:   c.clientid,
+		LastSeen:   now,
+		Platform:   c.platform,
+		AppVersion: c.appVersion,
+	}).Error; err != nil {
+		c.log.Error("db:save user device:", err)
+	}
+}
+
+const (
+	// 设备发送记录的队列长度, 满时丢弃, 发送记录只用于统计
+	sentQueue = 4096
+	// 每批最多写入的记录数和最长等待时间
+	sentBatch    = 500
+	sentInterval = 200 * time.Millisecond
+)
+
+func (d DeviceConfig) activeTTL() time.Duration {
+	if d.ActiveTTL <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(d.ActiveTTL) * time.Second
+}
+
+// markSent 记录消息已发送到设备, 由 sentWriter 异步批量写入
+func (n *Node) markSent(c *Client, ms []PushMessage) {
+	for _, m := range ms {
+		select {
+		case n.sents <- DeviceMessage{
+			MessagesID: m.ID,
+			UsersID:    c.user,
+			ClientID:   c.clientid,
+			Sent:       true,
+		}:
+		default:
+			c.log.Warn("sent queue full, drop:", m.ID)
+		}
+	}
+}
+
+// sentWriter 批量写入设备发送记录, 节点关闭时写完队列中剩余的记录
+func (n *Node) sentWriter() {
+	defer close(n.sentDone)
+	ticker := time.NewTicker(sentInterval)
+	defer ticker.Stop()
+	dms := []DeviceMessage{}
+	for {
+		select {
+		case dm := <-n.sents:
+			if dms = append(dms, dm); len(dms) < sentBatch {
+				continue
+			}
+		case <-ticker.C:
+		case <-n.done:
+			for len(n.sents) > 0 {
+				dms = append(dms, <-n.sents)
+			}
+			n.writeSent(dms)
+			return
+		}
+		n.writeSent(dms)
+		dms = dms[:0]
+	}
+}
+
+// writeSent 写入一批设备发送记录, 同时更新设备的最后活跃时间
+func (n *Node) writeSent(dms []DeviceMessage) {
+	if len(dms) == 0 {
+		return
+	}
+	log := zap.S().With("method", "writeSent")
+	now := time.Now()
+	type device struct{ user, clientid string }
+	sent := map[DeviceMessage]bool{}
+	seen := map[device]bool{}
+	uniq := make([]DeviceMessage, 0, len(dms))
+	devices := []UserDevice{}
+	for _, dm := range dms {
+		if sent[dm] {
+			continue
+		}
+		sent[dm] = true
+		uniq = append(uniq, dm)
+		if d := (device{dm.UsersID, dm.ClientID}); !seen[d] {
+			seen[d] = true
+			devices = append(devices, UserDevice{UsersID: dm.UsersID, ClientID: dm.ClientID, LastSeen: now})
+		}
+	}
+	if err := n.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "messageid"}, {Name: "userid"}, {Name: "clientid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"sent", "updated_at"}),
+	}).Create(&uniq).Error; err != nil {
+		log.Error("db:save device message:", err)
+	}
+	if err := n.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "userid"}, {Name: "clientid"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_seen", "updated_at"}),
+	}).Create(&devices).Error; err != nil {
+		log.Error("db:save user device last seen:", err)
+	}
+}
+
+// deviceAck 记录设备回执, 并按消息的确认策略更新用户消息的确认状态.
+// 送达回执即确认, 已读回执同时视为送达. 只处理发给该用户的消息, 返回忽略的消息id
+func (n *Node) deviceAck(a ClientAck) ([]string, error) {
+	log := zap.S().With("method", "deviceAck", "user", a.User, "clientid", a.ClientID)
+	found := []string{}
+	if err := n.db.Model(new(UserMessage)).
+		Where("userid = ? and messageid in (?)", a.User, a.IDs).
+		Pluck("messageid", &found).Error; err != nil {
+		log.Error("db:find user message:", err)
+		return nil, err
+	}
+	exists := map[string]bool{}
+	for _, id := range found {
+		exists[id] = true
+	}
+	ids, dropped := []string{}, []string{}
+	seen := map[string]bool{}
+	for _, id := range a.IDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if exists[id] {
+			ids = append(ids, id)
+		} else {
+			dropped = append(dropped, id)
+		}
+	}
+	if len(ids) == 0 {
+		return dropped, nil
+	}
+	a.IDs = ids
+
+	now := time.Now()
+	dms := []DeviceMessage{}
+	for _, id := range a.IDs {
+		dm := DeviceMessage{
+			MessagesID:  id,
+			UsersID:     a.User,
+			ClientID:    a.ClientID,
+			Sent:        true,
+			Ack:         true,
+			DeliveredAt: &now,
+		}
+		if a.Read {
+			dm.ReadAt = &now
+		}
+		dms = append(dms, dm)
+	}
+	if err := n.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "messageid"}, {Name: "userid"}, {Name: "clientid"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"sent":         true,
+			"ack":          true,
+			"updated_at":   now,
+			"delivered_at": gorm.Expr("coalesce(device_messages.delivered_at, excluded.delivered_at)"),
+			"read_at":      gorm.Expr("coalesce(device_messages.read_at, excluded.read_at)"),
+		}),
+	}).Create(&dms).Error; err != nil {
+		log.Error("db:save device message ack:", err)
+		return nil, err
+	}
+
+	// 用户的回执时间取第一个设备的回执时间
+	if err := n.db.Model(new(UserMessage)).
+		Where("userid = ? and messageid in (?) and delivered_at is null", a.User, a.IDs).
+		Update("delivered_at", now).Error; err != nil {
+		log.Error("db:update user message delivered:", err)
+		return nil, err
+	}
+	if a.Read {
+		if err := n.db.Model(new(UserMessage)).
+			Where("userid = ? and messageid in (?) and read_at is null", a.User, a.IDs).
+			Update("read_at", now).Error; err != nil {
+			log.Error("db:update user message read:", err)
+			return nil, err
+		}
+	}
+
+	if err := n.db.Model(new(UserMessage)).
+		Where("userid = ? and messageid in (?) and policy <> ?", a.User, a.IDs, PolicyEach).
+		Update("ack", true).Error; err != nil {
+		log.Error("db:update user message ack:", err)
+		return nil, err
+	}
+	// 活跃的设备都确认后才算确认, 长期不活跃的设备不再阻塞确认
+	if err := n.db.Model(new(UserMessage)).
+		Where("userid = ? and messageid in (?) and policy = ? and devices = ?", a.User, a.IDs, PolicyEach, false).
+		Where(`not exists (select 1 from user_devices d where d.userid = user_messages.userid and d.deleted_at is null
+			and d.last_seen >= ?
+			and not exists (select 1 from device_messages dm where dm.messageid = user_messages.messageid
+			and dm.userid = d.userid and dm.clientid = d.clientid and dm.ack = ?))`, now.Add(-DefConfig.Device.activeTTL()), true).
+		Update("ack", true).Error; err != nil {
+		log.Error("db:update user message each ack:", err)
+		return nil, err
+	}
+	// 只发送给部分设备的消息, 目标设备都确认后才算确认
+	if err := n.db.Model(new(UserMessage)).
+		Where("userid = ? and messageid in (?) and policy = ? and devices = ?", a.User, a.IDs, PolicyEach, true).
+		Where(`not exists (select 1 from device_messages dm where dm.messageid = user_messages.messageid
+			and dm.userid = user_messages.userid and dm.ack = ?)`, false).
+		Update("ack", true).Error; err != nil {
+		log.Error("db:update user message device ack:", err)
+		return nil, err
+	}
+	return dropped, nil
+}
+
+// Receipts 汇总消息的送达和已读回执
+func (n *Node) Receipts(req AdminReceiptsReq) (*AdminReceipts, error) {
+	rs := &AdminReceipts{ID: req.ID}
+	q := n.db.Model(new(UserMessage)).Where("messageid = ?", req.ID)
+	if err := q.Session(&gorm.Session{}).Count(&rs.Total).Error; err != nil {
+		return nil, err
+	}
+	if err := q.Session(&gorm.Session{}).Where("delivered_at is not null").Count(&rs.Delivered).Error; err != nil {
+		return nil, err
+	}
+	if err := q.Session(&gorm.Session{}).Where("read_at is not null").Count(&rs.Read).Error; err != nil {
+		return nil, err
+	}
+	if rs.Total > 0 {
+		rs.DeliveredRate = float64(rs.Delivered) / float64(rs.Total)
+		rs.ReadRate = float64(rs.Read) / float64(rs.Total)
+	}
+	if req.Detail {
+		limit := req.Limit
+		if limit <= 0 || limit > 1000 {
+			limit = 1000
+		}
+		if err := q.Session(&gorm.Session{}).
+			Select("userid, delivered_at, read_at").
+			Order("userid").
+			Offset(req.Offset).
+			Limit(limit).
+			Scan(&rs.Receipts).Error; err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nzlov/sw/swadmin"
+)
+
+// userAcked 用户消息是否已确认
+func userAcked(t *testing.T, tn *testNode, user, id string) bool {
+	t.Helper()
+	um := UserMessage{}
+	if err := tn.db.Where("userid = ? and messageid = ?", user, id).First(&um).Error; err != nil {
+		t.Fatal("db:", err)
+	}
+	return um.Ack
+}
+
+func TestAckPolicyEach(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u1", "m2")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x", Policy: PolicyEach})
+	a.messages(1)
+	b.messages(1)
+	a.ack(id)
+	if userAcked(t, tn, "u1", id) {
+		t.Fatal("acked before every device acked")
+	}
+	// 未确认的设备重连后仍会补发
+	b.close(tn)
+	b = connect(t, tn, "u1", "m2")
+	b.messages(1)
+	b.ack(id)
+	if !userAcked(t, tn, "u1", id) {
+		t.Fatal("not acked after every device acked")
+	}
+}
+
+func TestAckPolicyEachInactiveDevice(t *testing.T) {
+	tn := newTestNode(t)
+
+	// 很久没有登录的设备不阻塞确认
+	old := connect(t, tn, "u1", "old")
+	old.close(tn)
+	if err := tn.db.Model(new(UserDevice)).Where("userid = ? and clientid = ?", "u1", "old").
+		Update("last_seen", time.Now().Add(-DefConfig.Device.activeTTL()-time.Hour)).Error; err != nil {
+		t.Fatal("db:", err)
+	}
+
+	a := connect(t, tn, "u1", "m1")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x", Policy: PolicyEach})
+	a.messages(1)
+	a.ack(id)
+	if !userAcked(t, tn, "u1", id) {
+		t.Fatal("inactive device blocks ack")
+	}
+}
+
+func TestMarkSent(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	before := time.Now()
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	a.messages(1)
+	// 发送记录异步批量写入, 同时刷新设备的活跃时间
+	waitFor(t, func() bool {
+		var n int64
+		tn.db.Model(new(DeviceMessage)).Where("messageid = ? and userid = ? and clientid = ? and sent = ?", id, "u1", "m1", true).Count(&n)
+		return n == 1
+	})
+	d := UserDevice{}
+	if err := tn.db.Where("userid = ? and clientid = ?", "u1", "m1").First(&d).Error; err != nil {
+		t.Fatal("db:", err)
+	}
+	if d.LastSeen.Before(before) {
+		t.Fatalf("last seen %v not refreshed", d.LastSeen)
+	}
+}
+
+// TestReceipts 送达和已读回执分开统计, 已读视为送达
+func TestReceipts(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u2", "m1")
+	connect(t, tn, "u3", "m1")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1", "u2", "u3"}, Data: "x"})
+	a.ack(ids(a.messages(1))...)
+	b.messages(1)
+	if r := b.call(map[string]interface{}{"t": T_ACK, "id": []string{id}, "k": "r"}); r.C != 0 {
+		t.Fatalf("read: %+v", r)
+	}
+
+	rs, err := adminClient(t, tn).Receipts(contextTimeout(t), swadmin.ReceiptsRequest{ID: id, Detail: true})
+	if err != nil {
+		t.Fatal("receipts:", err)
+	}
+	if rs.Total != 3 || rs.Delivered != 2 || rs.Read != 1 {
+		t.Fatalf("receipts: %+v", rs)
+	}
+	got := map[string][2]bool{}
+	for _, r := range rs.Receipts {
+		got[r.UserID] = [2]bool{r.DeliveredAt != nil, r.ReadAt != nil}
+	}
+	want := map[string][2]bool{"u1": {true, false}, "u2": {true, true}, "u3": {false, false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("receipts detail %v, want %v", got, want)
+	}
+}
+
+// TestAckOtherUser 回执不是发给该用户的消息时忽略, 并返回每个被忽略的消息id
+func TestAckOtherUser(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u2", "m1")
+	own := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	other := tn.publish(AdminPushMessage{UserIDs: []string{"u2"}, Data: "y"})
+	a.messages(1)
+	b.messages(1)
+
+	r := a.call(map[string]interface{}{"t": T_ACK, "id": []string{own, other, "none", own}})
+	want := map[string]int{other: codeInt(C_NOTFOUND), "none": codeInt(C_NOTFOUND)}
+	if r.C != codeInt(C_FAIL) || !reflect.DeepEqual(r.R, want) {
+		t.Fatalf("ack: %+v", r)
+	}
+	if !userAcked(t, tn, "u1", own) {
+		t.Fatal("own message not acked")
+	}
+	if userAcked(t, tn, "u2", other) {
+		t.Fatal("other user's message acked")
+	}
+	var n int64
+	tn.db.Model(new(DeviceMessage)).Where("userid = ? and messageid in (?)", "u1", []string{other, "none"}).Count(&n)
+	if n != 0 {
+		t.Fatalf("%d receipts written for dropped ids", n)
+	}
+	if r := a.call(map[string]interface{}{"t": T_ACK, "id": []string{own}}); r.C != 0 || r.R != nil {
+		t.Fatalf("ack own: %+v", r)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SendCheck 发给权限检查 webhook 的内容
+type SendCheck struct {
+	From  string   `json:"f"`
+	Users []string `json:"us"`
+	Tags  []string `json:"ts"`
+}
+
+// sendLimits 检查配置的目标限制
+func sendLimits(users, tags []string) error {
+	if len(tags) > 0 && !DefConfig.Direct.AllowTags {
+		return errors.New("tags not allowed")
+	}
+	if max := DefConfig.Direct.MaxTargets; max > 0 && len(users)+len(tags) > max {
+		return fmt.Errorf("too many targets, max %d", max)
+	}
+	return nil
+}
+
+// checkSend 由业务方的 webhook 检查发送权限: 2xx 允许, 4xx 拒绝并回复响应中的 m, 其他情况为检查失败
+func checkSend(ctx context.Context, c SendCheck) (string, string) {
+	status, body, err := postSigned(ctx, http.DefaultClient, DefConfig.Direct.Checker, &c)
+	if err != nil {
+		zap.S().Error("send checker:", err)
+		return C_FAIL, "send checker error"
+	}
+	switch {
+	case status/100 == 2:
+		return C_OK, ""
+	case status/100 == 4:
+		r := struct {
+			M string `json:"m"`
+		}{}
+		if json.Unmarshal(body, &r) != nil || r.M == "" {
+			r.M = strings.TrimSpace(string(body))
+		}
+		if r.M == "" {
+			r.M = "forbidden"
+		}
+		return C_FORBIDDEN, r.M
+	}
+	zap.S().Error("send checker: status ", status)
+	return C_FAIL, "send checker error"
+}
+
+// Send 客户端发送消息给其他用户, 与 Admin 推送走相同的 Publish.
+// 配置了 checker 时在单独的协程中检查权限和推送, 不阻塞连接的读取
+func (n *Node) Send(c *Client, f *SendFrame) {
+	log := zap.S().With("method", "send", "user", c.user, "clientid", c.clientid)
+	cfg := DefConfig.Direct
+	if !cfg.Enable {
+		c.write(resp(f.T, f.I, C_FAIL, "direct message disabled"))
+		return
+	}
+	if err := sendLimits(f.Us, f.Ts); err != nil {
+		log.Info("send:forbidden:", f.Us, f.Ts, err)
+		c.write(resp(f.T, f.I, C_FORBIDDEN, err.Error()))
+		return
+	}
+	if cfg.Checker == "" {
+		n.send(c, f)
+		return
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if code, msg := checkSend(ctx, SendCheck{From: c.user, Users: f.Us, Tags: f.Ts}); code != C_OK {
+			log.Info("send:checker:", f.Us, f.Ts, code, msg)
+			c.write(resp(f.T, f.I, code, msg))
+			return
+		}
+		n.send(c, f)
+	}()
+}
+
+func (n *Node) send(c *Client, f *SendFrame) {
+	pm := AdminPushMessage{
+		MessageID: fmt.Sprint(time.Now().UnixNano()),
+		From:      c.user,
+		UserIDs:   f.Us,
+		Tags:      f.Ts,
+		Data:      f.D,
+		Ephemeral: f.Ep,
+	}
+	n.Publish(pm)
+	c.write(resp(f.T, f.I, C_OK, pm.MessageID))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withDirect 开启客户端发送消息, 需在创建节点前调用
+func withDirect(t *testing.T, cfg DirectConfig) {
+	old := DefConfig.Direct
+	cfg.Enable = true
+	DefConfig.Direct = cfg
+	t.Cleanup(func() { DefConfig.Direct = old })
+}
+
+func TestSendToUser(t *testing.T) {
+	withDirect(t, DirectConfig{MaxTargets: 2})
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u2", "m1")
+	r := a.call(map[string]interface{}{"t": T_SEND, "us": []string{"u2"}, "d": "hi"})
+	if r.C != 0 || r.M == "" {
+		t.Fatalf("send: %+v", r)
+	}
+	ms := b.messages(1)
+	if ms[0].ID != r.M || ms[0].From != "u1" || ms[0].Data != "hi" {
+		t.Fatalf("received %+v", ms[0])
+	}
+	if r := a.call(map[string]interface{}{"t": T_SEND, "ts": []string{"vip"}, "d": "hi"}); r.C != codeInt(C_FORBIDDEN) {
+		t.Fatalf("send to tag: %+v", r)
+	}
+	if r := a.call(map[string]interface{}{"t": T_SEND, "us": []string{"u2", "u3", "u4"}, "d": "hi"}); r.C != codeInt(C_FORBIDDEN) {
+		t.Fatalf("too many targets: %+v", r)
+	}
+	b.silent(100 * time.Millisecond)
+}
+
+func TestSendChecker(t *testing.T) {
+	checks := make(chan SendCheck, 10)
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		q := r.URL.Query()
+		if q.Get("sign") != SignMD5(DefConfig.AdminSecret, string(data), q.Get("ts")) {
+			http.Error(w, "bad sign", http.StatusUnauthorized)
+			return
+		}
+		c := SendCheck{}
+		json.Unmarshal(data, &c)
+		checks <- c
+		switch c.Users[0] {
+		case "blocked":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"m":"blocked by u2"}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer checker.Close()
+	withDirect(t, DirectConfig{Checker: checker.URL})
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u2", "m1")
+	if r := a.call(map[string]interface{}{"t": T_SEND, "us": []string{"u2"}, "d": "hi"}); r.C != 0 {
+		t.Fatalf("allowed: %+v", r)
+	}
+	if c := <-checks; c.From != "u1" || len(c.Users) != 1 || c.Users[0] != "u2" {
+		t.Fatalf("checker got %+v", c)
+	}
+	b.messages(1)
+	if r := a.call(map[string]interface{}{"t": T_SEND, "us": []string{"blocked"}, "d": "hi"}); r.C != codeInt(C_FORBIDDEN) || r.M != "blocked by u2" {
+		t.Fatalf("forbidden: %+v", r)
+	}
+	if r := a.call(map[string]interface{}{"t": T_SEND, "us": []string{"broken"}, "d": "hi"}); r.C != codeInt(C_FAIL) {
+		t.Fatalf("checker error: %+v", r)
+	}
+}
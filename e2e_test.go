@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nzlov/sw/swadmin"
+)
+
+func TestLogin(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := dial(t, tn, "u1", "m1")
+	if r := c.login(map[string]interface{}{"tk": "bad"}); r.Rt != T_LOGIN || r.C != codeInt(C_AUTH) {
+		t.Fatalf("bad token: %+v", r)
+	}
+	if r := c.login(map[string]interface{}{"v": ProtoVersionMax + 1}); r.C != codeInt(C_VERSION) {
+		t.Fatalf("bad version: %+v", r)
+	}
+	r := c.login(map[string]interface{}{"v": 2, "cs": []string{CapResume}})
+	if r.C != 0 || r.M != "m1" {
+		t.Fatalf("login: %+v", r)
+	}
+	if r := c.login(nil); r.C != codeInt(C_FAIL) {
+		t.Fatalf("login twice: %+v", r)
+	}
+	if len(tn.userClients("u1")) != 1 {
+		t.Fatal("client is not registered")
+	}
+}
+
+func TestLoginSameClientID(t *testing.T) {
+	tn := newTestNode(t)
+
+	old := connect(t, tn, "u1", "m1")
+	c := connect(t, tn, "u1", "m1")
+	if code := old.closed(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("old connection close code %d", code)
+	}
+	cs := tn.userClients("u1")
+	if len(cs) != 1 {
+		t.Fatalf("%d clients registered", len(cs))
+	}
+
+	tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	c.messages(1)
+}
+
+func TestPublishToUser(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u1", "m2")
+	other := connect(t, tn, "u2", "m1")
+
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "hello"})
+	for _, c := range []*fakeClient{a, b} {
+		ms := c.messages(1)
+		if ms[0].ID != id || ms[0].Data != "hello" || ms[0].Seq != 1 {
+			t.Fatalf("%s: %+v", c.m, ms[0])
+		}
+	}
+	other.silent(100 * time.Millisecond)
+
+	id2 := tn.publish(AdminPushMessage{UserIDs: []string{"u1", "u2"}, Data: "all"})
+	if ms := a.messages(1); ms[0].ID != id2 || ms[0].Seq != 2 {
+		t.Fatalf("second message: %+v", ms[0])
+	}
+	if ms := other.messages(1); ms[0].ID != id2 || ms[0].Seq != 1 {
+		t.Fatalf("u2 message: %+v", ms[0])
+	}
+}
+
+func TestPublishToTag(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u2", "m1")
+	if r := a.tag(map[string]bool{"city.sh": true, "vip": true}); !reflect.DeepEqual(r, map[string]int{"city.sh": 0, "vip": 0}) {
+		t.Fatalf("tag: %v", r)
+	}
+	b.tag(map[string]bool{"city.bj": true})
+
+	id := tn.publish(AdminPushMessage{Tags: []string{"vip"}, Data: "x"})
+	if ms := a.messages(1); ms[0].ID != id {
+		t.Fatalf("vip: %+v", ms)
+	}
+	b.silent(100 * time.Millisecond)
+
+	id = tn.publish(AdminPushMessage{Tags: []string{"city.*"}, Data: "x"})
+	a.messages(1)
+	if ms := b.messages(1); ms[0].ID != id {
+		t.Fatalf("wildcard: %+v", ms)
+	}
+
+	a.tag(map[string]bool{"vip": false})
+	tn.publish(AdminPushMessage{Tags: []string{"vip"}, Data: "x"})
+	a.silent(100 * time.Millisecond)
+}
+
+func TestOfflineReplay(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	c.close(tn)
+
+	want := []string{}
+	for i := 0; i < offlineBatch+2; i++ {
+		want = append(want, tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"}))
+	}
+
+	c = connect(t, tn, "u1", "m1")
+	ms := c.messages(len(want))
+	if got := ids(ms); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay %v, want %v", got, want)
+	}
+	c.ack(want[:3]...)
+	c.close(tn)
+
+	// 只补发未确认的消息
+	c = connect(t, tn, "u1", "m1")
+	if got := ids(c.messages(len(want) - 3)); !reflect.DeepEqual(got, want[3:]) {
+		t.Fatalf("replay after ack %v, want %v", got, want[3:])
+	}
+	c.ack(want[3:]...)
+	c.close(tn)
+
+	c = connect(t, tn, "u1", "m1")
+	c.silent(100 * time.Millisecond)
+}
+
+func TestResume(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	c.close(tn)
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		ids = append(ids, tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"}))
+	}
+
+	// 其他设备确认了序号 1 和 3
+	tn.Acker(ClientAck{User: "u1", ClientID: "m2", IDs: []string{ids[0], ids[2]}})
+
+	// 已收到序号 1, 补发之后的消息, 不论是否已确认
+	c = dial(t, tn, "u1", "m1")
+	r := c.login(map[string]interface{}{"v": 2, "cs": []string{CapResume}, "s": 1})
+	if r.C != 0 || r.Ls != 3 {
+		t.Fatalf("login: %+v", r)
+	}
+	ms := c.messages(2)
+	if ms[0].ID != ids[1] || ms[0].Seq != 2 || ms[1].ID != ids[2] {
+		t.Fatalf("resume: %+v", ms)
+	}
+	c.silent(100 * time.Millisecond)
+}
+
+// TestResumePriority 补发按优先级乱序, 续传序号之前未确认的消息仍会补发
+func TestResumePriority(t *testing.T) {
+	tn := newTestNode(t)
+
+	low := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x", Priority: PriorityLow})
+	high := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "y", Priority: PriorityHigh})
+	c := dial(t, tn, "u1", "m1")
+	if r := c.login(map[string]interface{}{"v": 2, "cs": []string{CapResume}}); r.C != 0 {
+		t.Fatalf("login: %+v", r)
+	}
+	ms := c.messages(2)
+	if ms[0].ID != high || ms[0].Seq != 2 || ms[1].ID != low {
+		t.Fatalf("offline order: %+v", ms)
+	}
+	// 只回执了序号 2 就断开, 续传序号为 2
+	c.ack(high)
+	c.close(tn)
+
+	c = dial(t, tn, "u1", "m1")
+	if r := c.login(map[string]interface{}{"v": 2, "cs": []string{CapResume}, "s": 2}); r.C != 0 {
+		t.Fatalf("login: %+v", r)
+	}
+	if ms := c.messages(1); ms[0].ID != low || ms[0].Seq != 1 {
+		t.Fatalf("resume: %+v", ms)
+	}
+	c.silent(100 * time.Millisecond)
+}
+
+func TestAckPolicyAny(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	a.messages(1)
+	a.ack(id)
+
+	// 任一设备确认后其他设备不再补发
+	b := connect(t, tn, "u1", "m2")
+	b.silent(100 * time.Millisecond)
+}
+
+func TestCrossNodeDelivery(t *testing.T) {
+	ns := newTestCluster(t, 2)
+
+	a := connect(t, ns[0], "u1", "m1")
+	b := connect(t, ns[1], "u1", "m2")
+	c := connect(t, ns[1], "u2", "m1")
+	c.tag(map[string]bool{"vip": true})
+
+	// 推送到用户, 两个节点上的设备都收到, 序号相同
+	id := ns[0].publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	ma, mb := a.messages(1), b.messages(1)
+	if ma[0].ID != id || mb[0].ID != id || ma[0].Seq != mb[0].Seq {
+		t.Fatalf("user: %+v %+v", ma, mb)
+	}
+
+	// 在其他节点订阅的标签
+	id = ns[0].publish(AdminPushMessage{Tags: []string{"vip"}, Data: "y"})
+	if ms := c.messages(1); ms[0].ID != id || ms[0].Data != "y" {
+		t.Fatalf("tag: %+v", ms)
+	}
+	a.silent(100 * time.Millisecond)
+
+	// 集群内查询在线设备
+	ds, err := ns[0].Online(contextTimeout(t), "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []string{}
+	for _, d := range ds {
+		nodes = append(nodes, d.Node+"/"+d.ClientID)
+	}
+	sort.Strings(nodes)
+	if !reflect.DeepEqual(nodes, []string{"node0/m1", "node1/m2"}) {
+		t.Fatalf("online: %v", nodes)
+	}
+}
+
+func TestCrossNodeOfflineReplay(t *testing.T) {
+	ns := newTestCluster(t, 2)
+
+	c := connect(t, ns[0], "u1", "m1")
+	c.close(ns[0])
+	id := ns[0].publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+
+	// 在另一个节点登录, 从共用的数据库补发
+	c = connect(t, ns[1], "u1", "m1")
+	if ms := c.messages(1); ms[0].ID != id {
+		t.Fatalf("replay: %+v", ms)
+	}
+}
+
+// TestAdminKick 通过管理接口踢掉其他节点上的设备
+func TestAdminKick(t *testing.T) {
+	ns := newTestCluster(t, 2)
+
+	a := connect(t, ns[0], "u1", "m1")
+	b := connect(t, ns[1], "u1", "m2")
+	admin := adminClient(t, ns[0])
+	ds, err := admin.Kick(contextTimeout(t), "u1", "m2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 1 || ds[0].Node != "node1" || ds[0].ClientID != "m2" {
+		t.Fatalf("kick: %+v", ds)
+	}
+	if code := b.closed(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("kicked close code %d", code)
+	}
+	a.silent(100 * time.Millisecond)
+	waitFor(t, func() bool {
+		ds, err := admin.Online(contextTimeout(t), "u1")
+		return err == nil && len(ds) == 1 && ds[0].ClientID == "m1"
+	})
+}
+
+// TestClusterAnswerNode 其他节点的回复带上回复的节点, 只交给发起查询的节点
+func TestClusterAnswerNode(t *testing.T) {
+	ns := newTestCluster(t, 3)
+
+	connect(t, ns[1], "u1", "m1")
+	ch := make(chan *ClusterAnswer, 4)
+	ns[0].queries.Store("q1", ch)
+	other := make(chan *ClusterAnswer, 4)
+	ns[2].queries.Store("q1", other)
+	ns[1].answerCluster(ClusterQuery{ID: "q1", Kind: queryOnline, User: "u1", Node: "node0"})
+	select {
+	case a := <-ch:
+		if a.To != "node0" || a.Node != "node1" || len(a.Devices) != 1 || a.Devices[0].Node != "node1" {
+			t.Fatalf("answer: %+v", a)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("no answer")
+	}
+	select {
+	case a := <-other:
+		t.Fatalf("answer gathered by node2: %+v", a)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestPushExt 扩展数据随消息保存, 在线和离线补发都原样发给客户端
+func TestPushExt(t *testing.T) {
+	tn := newTestNode(t)
+
+	admin := adminClient(t, tn)
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	ext := json.RawMessage(`{"k":1}`)
+	a := connect(t, tn, "u1", "m1")
+	id, err := admin.Push(ctx, swadmin.PushRequest{UserIDs: []string{"u1", "u2"}, Data: "x", Ext: ext})
+	if err != nil {
+		t.Fatal("push:", err)
+	}
+	if ms := a.messages(1); ms[0].ID != id || string(ms[0].Ext) != string(ext) {
+		t.Fatalf("online: %+v", ms)
+	}
+	b := connect(t, tn, "u2", "m1")
+	if ms := b.messages(1); ms[0].ID != id || string(ms[0].Ext) != string(ext) {
+		t.Fatalf("offline: %+v", ms)
+	}
+
+	// 没有扩展数据时不发送 e
+	tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "y"})
+	if ms := a.messages(1); ms[0].Ext != nil {
+		t.Fatalf("without ext: %+v", ms)
+	}
+}
+
+// TestEphemeral 临时消息只发给在线的客户端, 不保存也不补发
+func TestEphemeral(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1", "u2"}, Data: "x", Ephemeral: true})
+	if ms := a.messages(1); ms[0].ID != id || !ms[0].Ep || ms[0].Seq != 0 {
+		t.Fatalf("ephemeral: %+v", ms)
+	}
+	var n int64
+	tn.db.Model(new(UserMessage)).Where("messageid = ?", id).Count(&n)
+	if n != 0 {
+		t.Fatalf("ephemeral stored for %d users", n)
+	}
+	connect(t, tn, "u2", "m1").silent(100 * time.Millisecond)
+}
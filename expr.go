@@ -0,0 +1,254 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 标签表达式, 例如 vip AND city.sh.# AND NOT opted_out.
+// 运算符不区分大小写, 优先级 NOT > AND > OR, 可以使用括号, 标签支持通配符.
+// 表达式按用户求值, 只使用用户的订阅, 不使用设备的订阅.
+
+// 表达式的限制: 最多的标签数、嵌套的括号和 NOT 的层数、字符数
+const (
+	maxExprTerms = 64
+	maxExprDepth = 32
+	maxExprLen   = 4096
+)
+
+// errExprLimit 表达式超过限制
+var errExprLimit = errors.New("expression too complex")
+
+type tagExpr interface {
+	// sql 生成对 u.userid 的查询条件
+	sql(n *Node) (string, []interface{}, error)
+}
+
+type exprTag struct {
+	tag string
+}
+
+type exprNot struct {
+	x tagExpr
+}
+
+type exprBinary struct {
+	op   string
+	l, r tagExpr
+}
+
+func (e *exprTag) sql(n *Node) (string, []interface{}, error) {
+	query, args, err := n.tagMatch(e.tag)
+	if err != nil {
+		return "", nil, err
+	}
+	args = append(args, time.Now())
+	return "exists (select 1 from user_tags where user_tags.userid = u.userid and user_tags.clientid = '' and user_tags.deleted_at is null and " + query + " and " + tagUnexpired + ")", args, nil
+}
+
+func (e *exprNot) sql(n *Node) (string, []interface{}, error) {
+	query, args, err := e.x.sql(n)
+	if err != nil {
+		return "", nil, err
+	}
+	return "not (" + query + ")", args, nil
+}
+
+func (e *exprBinary) sql(n *Node) (string, []interface{}, error) {
+	lq, la, err := e.l.sql(n)
+	if err != nil {
+		return "", nil, err
+	}
+	rq, ra, err := e.r.sql(n)
+	if err != nil {
+		return "", nil, err
+	}
+	return "(" + lq + " " + e.op + " " + rq + ")", append(la, ra...), nil
+}
+
+// tagMatch 标签的精确查询条件, 无法只用 like 表达的通配符先查出匹配的标签
+func (n *Node) tagMatch(p string) (string, []interface{}, error) {
+	query, args, exact := tagCondition(p)
+	if exact {
+		return query, args, nil
+	}
+	tags := []string{}
+	if err := n.db.Model(new(UserTag)).Distinct("tag").Where(query, args...).Where(tagUnexpired, time.Now()).Pluck("tag", &tags).Error; err != nil {
+		return "", nil, err
+	}
+	matched := []string{}
+	for _, t := range tags {
+		if matchTag(p, t) {
+			matched = append(matched, t)
+		}
+	}
+	if len(matched) == 0 {
+		return "1 = 0", nil, nil
+	}
+	return "tag in (?)", []interface{}{matched}, nil
+}
+
+// exprUsers 查询满足表达式的用户, 范围为有标签或登录过的用户
+func (n *Node) exprUsers(e tagExpr) ([]string, error) {
+	query, args, err := e.sql(n)
+	if err != nil {
+		return nil, err
+	}
+	users := []string{}
+	err = n.db.Table(`(select userid from user_tags where deleted_at is null and `+tagUnexpired+`
+		union select userid from user_devices where deleted_at is null) u`, time.Now()).
+		Where(query, args...).
+		Pluck("u.userid", &users).Error
+	return users, err
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+	terms  int
+	depth  int
+}
+
+// parseTagExpr 解析标签表达式, 超过限制时返回的错误包装 errExprLimit
+func parseTagExpr(s string) (tagExpr, error) {
+	if len(s) > maxExprLen {
+		return nil, fmt.Errorf("%w: longer than %d", errExprLimit, maxExprLen)
+	}
+	p := &exprParser{tokens: tokenizeExpr(s)}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("empty expression")
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+func tokenizeExpr(s string) []string {
+	tokens := []string{}
+	cur := strings.Builder{}
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) or() (tagExpr, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "OR") {
+		p.pos++
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = &exprBinary{op: "or", l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) and() (tagExpr, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "AND") {
+		p.pos++
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		l = &exprBinary{op: "and", l: l, r: r}
+	}
+	return l, nil
+}
+
+// nest 进入一层括号或 NOT, 超过最大层数时返回错误
+func (p *exprParser) nest() error {
+	p.depth++
+	if p.depth > maxExprDepth {
+		return fmt.Errorf("%w: nested deeper than %d", errExprLimit, maxExprDepth)
+	}
+	return nil
+}
+
+func (p *exprParser) not() (tagExpr, error) {
+	if strings.EqualFold(p.peek(), "NOT") {
+		p.pos++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{x: x}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (tagExpr, error) {
+	t := p.peek()
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+	case t == "(":
+		p.pos++
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		defer func() { p.depth-- }()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return e, nil
+	case t == ")", strings.EqualFold(t, "AND"), strings.EqualFold(t, "OR"):
+		return nil, fmt.Errorf("unexpected %q", t)
+	}
+	p.pos++
+	if err := validTagPattern(t); err != nil {
+		return nil, fmt.Errorf("%s: %v", t, err)
+	}
+	p.terms++
+	if p.terms > maxExprTerms {
+		return nil, fmt.Errorf("%w: too many tags, max %d", errExprLimit, maxExprTerms)
+	}
+	return &exprTag{tag: t}, nil
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 客户端帧类型
+const (
+	T_LOGIN = "l"
+	T_TAG   = "t"
+	T_ACK   = "a"
+	// 上行消息
+	T_UPSTREAM = "u"
+	// 发送消息给其他用户
+	T_SEND = "s"
+	// 回复服务端的请求
+	T_REPLY = "p"
+)
+
+// 服务端发给客户端的帧类型
+const (
+	// 回复
+	T_RESP = "r"
+	// 关闭非 websocket 的连接
+	T_CLOSE = "c"
+)
+
+// Frame 所有客户端帧的公共字段
+type Frame struct {
+	T string `json:"t" proto:"1"`
+	I string `json:"i" proto:"2"`
+}
+
+func (f *Frame) Validate() *FrameError {
+	if f.I == "" {
+		return paramError("i", "is required")
+	}
+	return nil
+}
+
+type LoginFrame struct {
+	Frame
+	U  string `json:"u" proto:"3"`
+	M  string `json:"m" proto:"4"`
+	Tk string `json:"tk" proto:"5"`
+	Ts int64  `json:"ts" proto:"6"`
+	// 协议版本
+	V int `json:"v,omitempty" proto:"7"`
+	// 客户端能力
+	Cs []string `json:"cs,omitempty" proto:"8"`
+	// 客户端最后收到的消息序号, 协商出 resume 时有效
+	S *int64 `json:"s,omitempty" proto:"9"`
+	// 平台, 例如 ios android web desktop
+	P string `json:"p,omitempty" proto:"10"`
+	// 应用版本, 例如 2.3.0
+	Av string `json:"av,omitempty" proto:"11"`
+}
+
+func (f *LoginFrame) Validate() *FrameError {
+	if err := f.Frame.Validate(); err != nil {
+		return err
+	}
+	f.U = strings.TrimSpace(f.U)
+	f.M = strings.TrimSpace(f.M)
+	f.P = strings.ToLower(strings.TrimSpace(f.P))
+	f.Av = strings.TrimSpace(f.Av)
+	switch {
+	case f.U == "":
+		return paramError("u", "is required")
+	case f.M == "":
+		return paramError("m", "is required")
+	case f.Tk == "":
+		return paramError("tk", "is required")
+	case f.Ts <= 0:
+		return paramError("ts", "must be a positive timestamp")
+	case f.V < 0:
+		return paramError("v", "must not be negative")
+	case f.S != nil && *f.S < 0:
+		return paramError("s", "must not be negative")
+	}
+	if f.Av != "" {
+		if err := validVersion(f.Av); err != nil {
+			return paramError("av", err.Error())
+		}
+	}
+	if f.V == 0 {
+		f.V = ProtoVersionMin
+	}
+	return nil
+}
+
+type TagFrame struct {
+	Frame
+	D map[string]bool `json:"d" proto:"3"`
+	// 只对当前设备生效
+	Dv bool `json:"dv,omitempty" proto:"4"`
+}
+
+func (f *TagFrame) Validate() *FrameError {
+	if err := f.Frame.Validate(); err != nil {
+		return err
+	}
+	if len(f.D) == 0 {
+		return paramError("d", "is required")
+	}
+	for k := range f.D {
+		if strings.TrimSpace(k) == "" {
+			return paramError("d", "tag must not be empty")
+		}
+		if err := validTag(k); err != nil {
+			return paramError("d", k+": "+err.Error())
+		}
+	}
+	return nil
+}
+
+// 回执类型
+const (
+	// 送达, 默认
+	AckDelivered = "d"
+	// 已读
+	AckRead = "r"
+)
+
+type AckFrame struct {
+	Frame
+	ID []string `json:"id" proto:"3"`
+	// 回执类型 d 送达 r 已读
+	K string `json:"k,omitempty" proto:"4"`
+}
+
+func (f *AckFrame) Validate() *FrameError {
+	if err := f.Frame.Validate(); err != nil {
+		return err
+	}
+	if len(f.ID) == 0 {
+		return paramError("id", "is required")
+	}
+	switch f.K {
+	case "":
+		f.K = AckDelivered
+	case AckDelivered, AckRead:
+	default:
+		return paramError("k", "must be d or r")
+	}
+	for _, v := range f.ID {
+		if v == "" {
+			return paramError("id", "message id must not be empty")
+		}
+	}
+	return nil
+}
+
+// UpstreamFrame 客户端发给业务方的消息
+type UpstreamFrame struct {
+	Frame
+	// 消息类型, 由业务方定义
+	K string `json:"k,omitempty" proto:"3"`
+	D string `json:"d" proto:"4"`
+}
+
+func (f *UpstreamFrame) Validate() *FrameError {
+	if err := f.Frame.Validate(); err != nil {
+		return err
+	}
+	if f.D == "" {
+		return paramError("d", "is required")
+	}
+	return nil
+}
+
+// SendFrame 发送消息给其他用户或标签
+type SendFrame struct {
+	Frame
+	Us []string `json:"us,omitempty" proto:"3"`
+	Ts []string `json:"ts,omitempty" proto:"4"`
+	D  string   `json:"d" proto:"5"`
+	// 临时消息
+	Ep bool `json:"ep,omitempty" proto:"6"`
+}
+
+func (f *SendFrame) Validate() *FrameError {
+	if err := f.Frame.Validate(); err != nil {
+		return err
+	}
+	if len(f.Us) == 0 && len(f.Ts) == 0 {
+		return paramError("us", "us or ts is required")
+	}
+	for _, v := range f.Us {
+		if v == "" {
+			return paramError("us", "user must not be empty")
+		}
+	}
+	for _, v := range f.Ts {
+		if v == "" {
+			return paramError("ts", "tag must not be empty")
+		}
+		if err := validTagPattern(v); err != nil {
+			return paramError("ts", v+": "+err.Error())
+		}
+	}
+	if f.D == "" {
+		return paramError("d", "is required")
+	}
+	return nil
+}
+
+// ReplyFrame 客户端对服务端请求的回复, i 为请求的 i
+type ReplyFrame struct {
+	Frame
+	// 状态码, 由业务方定义, 0 成功
+	C int    `json:"c" proto:"3"`
+	D string `json:"d,omitempty" proto:"4"`
+	M string `json:"m,omitempty" proto:"5"`
+}
+
+// RespFrame 服务端对客户端帧的回复
+type RespFrame struct {
+	T  string `json:"t" proto:"1"`
+	Rt string `json:"rt" proto:"3"`
+	I  string `json:"i" proto:"2"`
+	C  int    `json:"c" proto:"4"`
+	M  string `json:"m" proto:"5"`
+}
+
+func resp(rt, i, c, m string) *RespFrame {
+	return &RespFrame{
+		T:  T_RESP,
+		Rt: rt,
+		I:  i,
+		C:  codeInt(c),
+		M:  m,
+	}
+}
+
+// codeInt 帧中的状态码为数字
+func codeInt(c string) int {
+	i, _ := strconv.Atoi(c)
+	return i
+}
+
+// LoginRespFrame 登录成功的回复, 带上协商结果
+type LoginRespFrame struct {
+	RespFrame
+	// 协议版本
+	V int `json:"v" proto:"6"`
+	// 服务端版本
+	Sv string `json:"sv" proto:"7"`
+	// 协商出的能力
+	Cs []string `json:"cs" proto:"8"`
+	// 服务端支持的编码
+	Cd []string `json:"cd,omitempty" proto:"9"`
+	// 服务端最后的消息序号, 协商出 resume 时返回
+	Ls int64 `json:"ls,omitempty" proto:"10"`
+	// 客户端序号超过服务端, 已重新发送全部未确认的消息
+	Rs bool `json:"rs,omitempty" proto:"11"`
+	// 非 websocket 传输的会话id
+	Sid string `json:"sid,omitempty" proto:"13"`
+}
+
+// CloseFrame 非 websocket 的连接被服务端关闭, c 与 websocket 的关闭码相同
+type CloseFrame struct {
+	T string `json:"t" proto:"1"`
+	C int    `json:"c" proto:"4"`
+	M string `json:"m" proto:"5"`
+}
+
+// TagRespFrame 标签帧的回复, 带上每个标签的结果
+type TagRespFrame struct {
+	RespFrame
+	// 标签 -> 状态码
+	R map[string]int `json:"r" proto:"12"`
+}
+
+func tagResp(f *TagFrame, r map[string]int) *TagRespFrame {
+	c, m := C_OK, ""
+	for _, v := range r {
+		if v != codeInt(C_OK) {
+			c, m = C_FAIL, "some tags failed"
+			break
+		}
+	}
+	return &TagRespFrame{RespFrame: *resp(f.T, f.I, c, m), R: r}
+}
+
+// AckRespFrame 回执帧的回复, 带上被忽略的消息id的状态码
+type AckRespFrame struct {
+	RespFrame
+	// 消息id -> 状态码, 只包含被忽略的消息
+	R map[string]int `json:"r,omitempty" proto:"12"`
+}
+
+func ackResp(f *AckFrame, dropped []string) *AckRespFrame {
+	if len(dropped) == 0 {
+		return &AckRespFrame{RespFrame: *resp(f.T, f.I, C_OK, "")}
+	}
+	r := map[string]int{}
+	for _, id := range dropped {
+		r[id] = codeInt(C_NOTFOUND)
+	}
+	return &AckRespFrame{RespFrame: *resp(f.T, f.I, C_FAIL, "some messages not found"), R: r}
+}
+
+// FrameError 帧校验错误, Code 对应 code.go
+type FrameError struct {
+	Code string
+	Msg  string
+}
+
+func (e *FrameError) Error() string {
+	return e.Code + ":" + e.Msg
+}
+
+func paramError(field, msg string) *FrameError {
+	return &FrameError{Code: C_PARAM, Msg: "field " + field + ": " + msg}
+}
+
+type validator interface {
+	Validate() *FrameError
+}
+
+// decodeFrame 解析并校验客户端帧, 出错时返回的 Frame 仍带有能解析出的 t 和 i
+func decodeFrame(codec Codec, data []byte) (Frame, validator, *FrameError) {
+	head := Frame{}
+	if err := unmarshalFrame(codec, data, &head); err != nil {
+		return head, nil, err
+	}
+
+	var f validator
+	switch head.T {
+	case T_LOGIN:
+		f = &LoginFrame{}
+	case T_TAG:
+		f = &TagFrame{}
+	case T_ACK:
+		f = &AckFrame{}
+	case T_UPSTREAM:
+		f = &UpstreamFrame{}
+	case T_SEND:
+		f = &SendFrame{}
+	case T_REPLY:
+		f = &ReplyFrame{}
+	case "":
+		return head, nil, paramError("t", "is required")
+	default:
+		return head, nil, &FrameError{Code: C_TYPE, Msg: "unknown type: " + head.T}
+	}
+	if err := unmarshalFrame(codec, data, f); err != nil {
+		return head, nil, err
+	}
+	if err := f.Validate(); err != nil {
+		return head, nil, err
+	}
+	return head, f, nil
+}
+
+func unmarshalFrame(codec Codec, data []byte, v interface{}) *FrameError {
+	err := codec.Unmarshal(data, v)
+	if err == nil {
+		return nil
+	}
+	if codec.Name() != CodecJSON {
+		return &FrameError{Code: C_FORMAT, Msg: "invalid " + codec.Name() + ": " + err.Error()}
+	}
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		if te.Field == "" {
+			return &FrameError{Code: C_FORMAT, Msg: "frame must be a json object"}
+		}
+		return paramError(te.Field, fmt.Sprintf("expect %s, got %s", te.Type, te.Value))
+	}
+	return &FrameError{Code: C_FORMAT, Msg: "invalid json: " + err.Error()}
+}
@@ -6,8 +6,11 @@ require (
 	github.com/go-redis/redis/v9 v9.0.0-rc.1
 	github.com/gorilla/websocket v1.4.1
 	github.com/spf13/viper v1.4.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
 	go.uber.org/zap v1.13.0
+	google.golang.org/protobuf v1.28.1
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	gorm.io/driver/postgres v1.4.4
+	gorm.io/driver/sqlite v1.4.3
 	gorm.io/gorm v1.24.0
 )
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// waitTimeout 等待帧的最长时间
+const waitTimeout = 3 * time.Second
+
+func TestMain(m *testing.M) {
+	DefConfig.Secret = "secret"
+	DefConfig.AdminSecret = "adminsecret"
+	DefConfig.Limit.LoginTimeout = 10
+	DefConfig.Client.ReadMessageSizeLimit = 4096
+	m.Run()
+}
+
+// memHub 进程内的集群广播, 代替 redis
+type memHub struct {
+	mu   sync.Mutex
+	subs map[*memCluster]struct{}
+}
+
+func newMemHub() *memHub {
+	return &memHub{subs: map[*memCluster]struct{}{}}
+}
+
+// join 加入一个节点
+func (h *memHub) join() *memCluster {
+	c := &memCluster{hub: h, ch: make(chan []byte, 1024)}
+	h.mu.Lock()
+	h.subs[c] = struct{}{}
+	h.mu.Unlock()
+	return c
+}
+
+type memCluster struct {
+	hub *memHub
+	ch  chan []byte
+}
+
+// Publish 不阻塞发送, 订阅方积压时丢弃, 与 redis 订阅通道满时的行为一致.
+// 持锁期间不能阻塞, 否则会卡住 Close
+func (c *memCluster) Publish(ctx context.Context, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	for s := range c.hub.subs {
+		select {
+		case s.ch <- data:
+		default:
+		}
+	}
+	return nil
+}
+
+func (c *memCluster) Subscribe() <-chan []byte {
+	return c.ch
+}
+
+func (c *memCluster) Close() error {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	if _, ok := c.hub.subs[c]; ok {
+		delete(c.hub.subs, c)
+		close(c.ch)
+	}
+	return nil
+}
+
+// testDB 每个测试独立的内存数据库, 集群内的节点共用
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	db, err := gorm.Open(sqlite.Open("file:"+name+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内存数据库在最后一个连接关闭时删除; 单连接避免 sqlite 的表锁
+	sqlDB.SetMaxOpenConns(1)
+	if err := migrateDB(db); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+// testNode 进程内的节点和它的 http 服务
+type testNode struct {
+	*Node
+	srv *httptest.Server
+}
+
+// newTestCluster 启动共用数据库的 n 个节点, n 大于 1 时通过 memHub 组成集群
+func newTestCluster(t *testing.T, n int) []*testNode {
+	t.Helper()
+	db := testDB(t)
+	hub := newMemHub()
+	ns := []*testNode{}
+	for i := 0; i < n; i++ {
+		var cluster Cluster
+		if n > 1 {
+			cluster = hub.join()
+		}
+		node := newNode(fmt.Sprintf("node%d", i), db, cluster)
+		tn := &testNode{Node: node, srv: httptest.NewServer(node.handler())}
+		t.Cleanup(func() {
+			tn.srv.Close()
+			// 等连接都注销, 之后测试恢复的配置不会和仍在运行的连接冲突
+			waitFor(t, func() bool { return atomic.LoadInt64(&tn.conns) == 0 })
+			tn.Close()
+		})
+		ns = append(ns, tn)
+	}
+	return ns
+}
+
+func newTestNode(t *testing.T) *testNode {
+	t.Helper()
+	return newTestCluster(t, 1)[0]
+}
+
+var testMessageSeq int64
+
+// publish 推送消息, 返回消息id
+func (tn *testNode) publish(m AdminPushMessage) string {
+	if m.MessageID == "" {
+		m.MessageID = fmt.Sprintf("msg%d", atomic.AddInt64(&testMessageSeq, 1))
+	}
+	tn.Publish(m)
+	return m.MessageID
+}
+
+// testFrame 服务端发来的帧
+type testFrame struct {
+	T   string         `json:"t"`
+	I   string         `json:"i"`
+	Rt  string         `json:"rt"`
+	V   int            `json:"v"`
+	C   int            `json:"c"`
+	M   string         `json:"m"`
+	Ls  int64          `json:"ls"`
+	Cs  []string       `json:"cs"`
+	K   string         `json:"k"`
+	Sid string         `json:"sid"`
+	D   string         `json:"d"`
+	Rs  bool           `json:"rs"`
+	R   map[string]int `json:"r"`
+	Ms  []PushMessage  `json:"ms"`
+}
+
+// fakeClient 按脚本收发帧的 websocket 客户端
+type fakeClient struct {
+	t    *testing.T
+	user string
+	m    string
+	conn *websocket.Conn
+	// 收到的帧, 连接断开后关闭
+	frames chan *testFrame
+	// 等待 resp 时收到的其他帧, 先于 frames 读取
+	queue []*testFrame
+	// 连接断开的原因
+	err error
+	seq int
+}
+
+// wsURL websocket 接入地址
+func (tn *testNode) wsURL() string {
+	return "ws" + strings.TrimPrefix(tn.srv.URL, "http") + "/ws"
+}
+
+// dial 连接节点, 不登录
+func dial(t *testing.T, tn *testNode, user, m string) *fakeClient {
+	t.Helper()
+	d := websocket.Dialer{EnableCompression: true}
+	conn, _, err := d.Dial(tn.wsURL(), nil)
+	if err != nil {
+		t.Fatal("dial:", err)
+	}
+	c := &fakeClient{t: t, user: user, m: m, conn: conn, frames: make(chan *testFrame, 100)}
+	go c.readLoop()
+	t.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// connect 连接并登录, 登录失败时测试失败
+func connect(t *testing.T, tn *testNode, user, m string) *fakeClient {
+	t.Helper()
+	c := dial(t, tn, user, m)
+	if r := c.login(nil); r.C != 0 {
+		t.Fatalf("%s/%s login: %d %s", user, m, r.C, r.M)
+	}
+	return c
+}
+
+func (c *fakeClient) readLoop() {
+	defer close(c.frames)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			c.err = err
+			return
+		}
+		f := &testFrame{}
+		if err := json.Unmarshal(data, f); err != nil {
+			c.err = err
+			return
+		}
+		c.frames <- f
+	}
+}
+
+// send 发送帧, 没有 i 时自动生成, 返回 i
+func (c *fakeClient) send(f map[string]interface{}) string {
+	c.t.Helper()
+	if _, ok := f["i"]; !ok {
+		c.seq++
+		f["i"] = fmt.Sprint(c.seq)
+	}
+	if err := c.conn.WriteJSON(f); err != nil {
+		c.t.Fatal("write:", err)
+	}
+	return f["i"].(string)
+}
+
+// next 等待下一个帧
+func (c *fakeClient) next() *testFrame {
+	c.t.Helper()
+	if len(c.queue) > 0 {
+		f := c.queue[0]
+		c.queue = c.queue[1:]
+		return f
+	}
+	select {
+	case f, ok := <-c.frames:
+		if !ok {
+			c.t.Fatalf("%s/%s: connection closed: %v", c.user, c.m, c.err)
+		}
+		return f
+	case <-time.After(waitTimeout):
+		c.t.Fatalf("%s/%s: timeout waiting for frame", c.user, c.m)
+	}
+	return nil
+}
+
+// call 发送请求并等待对应的 resp, 期间收到的其他帧留给之后读取
+func (c *fakeClient) call(f map[string]interface{}) *testFrame {
+	c.t.Helper()
+	id := c.send(f)
+	pending := []*testFrame{}
+	defer func() {
+		c.queue = append(pending, c.queue...)
+	}()
+	for {
+		r := c.next()
+		if r.T == T_RESP && r.I == id {
+			return r
+		}
+		pending = append(pending, r)
+	}
+}
+
+// login 登录, extra 覆盖登录帧的字段
+func (c *fakeClient) login(extra map[string]interface{}) *testFrame {
+	c.t.Helper()
+	ts := time.Now().Unix()
+	f := map[string]interface{}{
+		"t":  T_LOGIN,
+		"u":  c.user,
+		"m":  c.m,
+		"ts": ts,
+		"tk": SignMD5(DefConfig.Secret, c.user+c.m, fmt.Sprint(ts)),
+		"v":  ProtoVersionMax,
+	}
+	for k, v := range extra {
+		f[k] = v
+	}
+	return c.call(f)
+}
+
+// tag 订阅(true)或取消订阅(false)标签, 返回每个标签的状态码
+func (c *fakeClient) tag(tags map[string]bool) map[string]int {
+	c.t.Helper()
+	r := c.call(map[string]interface{}{"t": T_TAG, "d": tags})
+	return r.R
+}
+
+// ack 回执消息, 等待服务端的 resp
+func (c *fakeClient) ack(ids ...string) {
+	c.t.Helper()
+	if r := c.call(map[string]interface{}{"t": T_ACK, "id": ids}); r.C != 0 {
+		c.t.Fatalf("%s/%s ack: %d %s", c.user, c.m, r.C, r.M)
+	}
+}
+
+// messages 等待 n 条消息
+func (c *fakeClient) messages(n int) []PushMessage {
+	c.t.Helper()
+	ms := []PushMessage{}
+	for len(ms) < n {
+		f := c.next()
+		if f.T != "m" {
+			c.t.Fatalf("%s/%s: expect message, got %s", c.user, c.m, f.T)
+		}
+		ms = append(ms, f.Ms...)
+	}
+	if len(ms) != n {
+		c.t.Fatalf("%s/%s: expect %d messages, got %d", c.user, c.m, n, len(ms))
+	}
+	return ms
+}
+
+// silent 在 d 内没有收到任何帧
+func (c *fakeClient) silent(d time.Duration) {
+	c.t.Helper()
+	if len(c.queue) > 0 {
+		c.t.Fatalf("%s/%s: unexpected frame %s %+v", c.user, c.m, c.queue[0].T, c.queue[0])
+	}
+	select {
+	case f, ok := <-c.frames:
+		if ok {
+			c.t.Fatalf("%s/%s: unexpected frame %s %+v", c.user, c.m, f.T, f)
+		}
+	case <-time.After(d):
+	}
+}
+
+// closed 等待连接被服务端关闭, 返回关闭码
+func (c *fakeClient) closed() int {
+	c.t.Helper()
+	for {
+		select {
+		case _, ok := <-c.frames:
+			if ok {
+				continue
+			}
+			if ce, ok := c.err.(*websocket.CloseError); ok {
+				return ce.Code
+			}
+			return 0
+		case <-time.After(waitTimeout):
+			c.t.Fatalf("%s/%s: timeout waiting for close", c.user, c.m)
+		}
+	}
+}
+
+// close 断开连接并等待服务端注销
+func (c *fakeClient) close(tn *testNode) {
+	c.t.Helper()
+	c.conn.Close()
+	waitFor(c.t, func() bool {
+		for _, cl := range tn.userClients(c.user) {
+			if cl.clientid == c.m {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor 等待条件成立
+func waitFor(t *testing.T, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func ids(ms []PushMessage) []string {
+	rs := []string{}
+	for _, m := range ms {
+		rs = append(rs, m.ID)
+	}
+	return rs
+}
+
+// contextTimeout 测试结束或超时后取消的 context
+func contextTimeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
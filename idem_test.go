@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nzlov/sw/swadmin"
+)
+
+func adminClient(t *testing.T, tn *testNode) *swadmin.Client {
+	t.Helper()
+	c, err := swadmin.New(swadmin.Config{Addr: tn.srv.URL, Secret: DefConfig.AdminSecret, Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestIdempotentPushCluster 不同节点同时收到相同的幂等键只推送一次
+func TestIdempotentPushCluster(t *testing.T) {
+	ns := newTestCluster(t, 2)
+
+	c := connect(t, ns[1], "u1", "m1")
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	ids := make([]string, 6)
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := adminClient(t, ns[i%2]).Push(ctx, swadmin.PushRequest{UserIDs: []string{"u1"}, Data: "x", IdempotencyKey: "k1"})
+			if err != nil {
+				t.Error("push:", err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	for _, id := range ids[1:] {
+		if id != ids[0] {
+			t.Fatalf("different message ids: %v", ids)
+		}
+	}
+	if ms := c.messages(1); ms[0].ID != ids[0] {
+		t.Fatalf("message: %+v", ms)
+	}
+	c.silent(200 * time.Millisecond)
+	var count int64
+	ns[0].db.Model(new(Message)).Where("idem_key = ?", "k1").Count(&count)
+	if count != 1 {
+		t.Fatalf("messages with key: %d", count)
+	}
+
+	// 不同的键重新推送
+	id, err := adminClient(t, ns[0]).Push(ctx, swadmin.PushRequest{UserIDs: []string{"u1"}, Data: "y", IdempotencyKey: "k2"})
+	if err != nil || id == ids[0] {
+		t.Fatalf("push k2: %s %v", id, err)
+	}
+	c.messages(1)
+}
+
+func TestIdempotentPushEphemeral(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	admin := adminClient(t, tn)
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	_, err := admin.Push(ctx, swadmin.PushRequest{UserIDs: []string{"u1"}, Data: "x", Ephemeral: true, IdempotencyKey: "k1"})
+	if !swadmin.IsCode(err, swadmin.CodeParam) {
+		t.Fatalf("ephemeral with key: %v", err)
+	}
+	if !swadmin.IsCode(fmt.Errorf("push: %w", err), swadmin.CodeParam) {
+		t.Fatalf("wrapped error: %v", err)
+	}
+	// swadmin 不给临时消息生成幂等键
+	if _, err := admin.Push(ctx, swadmin.PushRequest{UserIDs: []string{"u1"}, Data: "y", Ephemeral: true}); err != nil {
+		t.Fatal("ephemeral:", err)
+	}
+	if ms := c.messages(1); !ms[0].Ep || ms[0].Data != "y" {
+		t.Fatalf("message: %+v", ms)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -12,39 +15,109 @@ import (
 )
 
 func main() {
-	log, _ := zap.NewDevelopment()
-	zap.ReplaceGlobals(log)
+	name := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if name != "serve" {
+		// 其他命令的参数默认值来自配置, 没有配置文件时使用参数
+		if err := loadConfig(); err != nil && !errors.As(err, &viper.ConfigFileNotFoundError{}) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := cmd.run(args); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "sw "+name+":", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig 读取当前目录的 config.yaml, 环境变量优先
+func loadConfig() error {
 	viper.SetConfigType("yaml")
 	viper.SetConfigName("config")
 	viper.AddConfigPath("./")
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Sugar().Fatal("init config error:", err)
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("init config error: %w", err)
+	}
+	if err := viper.Unmarshal(&DefConfig); err != nil {
+		return fmt.Errorf("init config unmarshal error: %w", err)
 	}
+	return nil
+}
 
-	err = viper.Unmarshal(&DefConfig)
-	if err != nil {
-		log.Sugar().Fatal("init config unmarshal error:", err)
+func serve(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	log, _ := zap.NewDevelopment()
+	zap.ReplaceGlobals(log)
+	if err := loadConfig(); err != nil {
+		log.Sugar().Fatal(err)
 	}
 
 	go func() {
 		http.ListenAndServe(DefConfig.PprofHost, nil)
 	}()
 
-	node := newNode()
+	db, err := openDB()
+	if err != nil {
+		log.Sugar().Fatal(err)
+	}
+	if err := migrateDB(db); err != nil {
+		log.Sugar().Fatal("db:migrate:", err)
+	}
+	cluster, err := newCluster()
+	if err != nil {
+		log.Sugar().Fatal("redis err:", err)
+	}
+	node := newNode(DefConfig.Redis.Name, db, cluster)
 	defer node.Close()
 
-	m := http.NewServeMux()
-	m.HandleFunc("/", node.adminPush)
-	m.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		node.serveWs(node, w, r)
-	})
+	if DefConfig.MQTT.Enable {
+		go node.serveMQTT()
+	}
 	log.Sugar().Info("Start:", DefConfig.Host)
-	err = http.ListenAndServe(DefConfig.Host, m)
+	err = http.ListenAndServe(DefConfig.Host, node.handler())
 	if err != nil {
 		log.Sugar().Fatal("ListenAndServe: ", err)
 	}
 	fmt.Println("close")
+	return nil
+}
+
+// handler 节点的 http 路由
+func (n *Node) handler() http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/", n.adminPush)
+	m.HandleFunc("/audience", n.adminAudience)
+	m.HandleFunc("/receipts", n.adminReceipts)
+	m.HandleFunc("/tags", n.adminTags)
+	m.HandleFunc("/tags/list", n.adminUserTags)
+	m.HandleFunc("/rpc", n.adminRPC)
+	m.HandleFunc("/online", n.adminOnline)
+	m.HandleFunc("/kick", n.adminKick)
+	m.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		n.serveWs(n, w, r)
+	})
+	m.HandleFunc("/sse", n.serveSSE)
+	m.HandleFunc("/sse/ack", n.serveSessionFrame(T_ACK))
+	m.HandleFunc("/sse/tag", n.serveSessionFrame(T_TAG))
+	m.HandleFunc("/poll", n.servePoll)
+	m.HandleFunc("/poll/ack", n.serveSessionFrame(T_ACK))
+	m.HandleFunc("/poll/tag", n.serveSessionFrame(T_TAG))
+	return m
 }
@@ -1,56 +1,165 @@
 package main
 
-import "gorm.io/gorm"
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type UserTag struct {
 	gorm.Model
 
 	UsersID string `json:"usersid" gorm:"column:userid;index"`
-	Tag     string `json:"tag" gorm:"column:tag;index"`
+	// 只订阅该设备, 为空时订阅用户的所有设备; (userid, tag, clientid) 的唯一索引由 migrateTags 创建
+	ClientID string `json:"clientid" gorm:"column:clientid;default:''"`
+	Tag      string `json:"tag" gorm:"column:tag;index;index:idx_user_tags_depth,priority:2"`
+	// 标签的层数
+	Depth int `json:"depth" gorm:"column:depth;default:0;index:idx_user_tags_depth,priority:1"`
+	// 过期时间, 为空不过期
+	ExpiresAt *time.Time `json:"expires_at" gorm:"column:expires_at;index"`
+	// 订阅的属性, json
+	Attrs string `json:"attrs" gorm:"column:attrs"`
 }
 
 type Message struct {
 	gorm.Model
 
 	MessagesID string `json:"messagesid" gorm:"column:messageid;index"`
+	// 确认策略
+	Policy string `json:"policy" gorm:"column:policy"`
+	// 发送消息的用户, Admin 推送时为空
+	From string `json:"from" gorm:"column:sender"`
+	// 优先级
+	Priority int `json:"priority" gorm:"column:priority;default:0"`
+	// Admin 推送的幂等键, 相同的键只推送一次
+	IdempotencyKey *string `json:"idempotency_key" gorm:"column:idem_key;uniqueIndex"`
 
 	Data string `json:"data" gorm:"column:data"`
+	// 扩展数据 json
+	Ext string `json:"ext" gorm:"column:ext"`
 }
 
 type UserMessage struct {
 	gorm.Model
 
 	MessagesID string `json:"messagesid" gorm:"column:messageid;index"`
-	UsersID    string `json:"usersid" gorm:"column:userid;index"`
-	Ack        bool   `json:"ack" gorm:"column:ack;index"`
+	UsersID    string `json:"usersid" gorm:"column:userid;index;index:idx_user_messages_seq,priority:1"`
+	// 用户内单调递增的消息序号
+	Seq      int64  `json:"seq" gorm:"column:seq;index:idx_user_messages_seq,priority:2"`
+	Ack      bool   `json:"ack" gorm:"column:ack;index"`
+	Policy   string `json:"policy" gorm:"column:policy;default:any"`
+	Priority int    `json:"priority" gorm:"column:priority;default:0"`
+	// 只发送给 device_messages 中的设备
+	Devices bool `json:"devices" gorm:"column:devices;default:false"`
+	// 第一个设备的送达和已读时间
+	DeliveredAt *time.Time `json:"delivered_at" gorm:"column:delivered_at"`
+	ReadAt      *time.Time `json:"read_at" gorm:"column:read_at"`
+}
+
+// UserDevice 用户登录过的设备
+type UserDevice struct {
+	gorm.Model
+
+	UsersID  string    `json:"usersid" gorm:"column:userid;uniqueIndex:idx_user_devices,priority:1"`
+	ClientID string    `json:"clientid" gorm:"column:clientid;uniqueIndex:idx_user_devices,priority:2"`
+	LastSeen time.Time `json:"lastseen" gorm:"column:last_seen"`
+	// 登录时上报的平台和应用版本
+	Platform   string `json:"platform" gorm:"column:platform;index"`
+	AppVersion string `json:"app_version" gorm:"column:app_version"`
+}
+
+// DeviceMessage 消息在设备上的发送和确认状态
+type DeviceMessage struct {
+	gorm.Model
+
+	MessagesID string `json:"messagesid" gorm:"column:messageid;uniqueIndex:idx_device_messages,priority:1"`
+	UsersID    string `json:"usersid" gorm:"column:userid;uniqueIndex:idx_device_messages,priority:2"`
+	ClientID   string `json:"clientid" gorm:"column:clientid;uniqueIndex:idx_device_messages,priority:3"`
+	Sent       bool   `json:"sent" gorm:"column:sent"`
+	Ack        bool   `json:"ack" gorm:"column:ack"`
+	// 客户端回执时间
+	DeliveredAt *time.Time `json:"delivered_at" gorm:"column:delivered_at"`
+	ReadAt      *time.Time `json:"read_at" gorm:"column:read_at"`
+}
+
+// UserSeq 用户当前的消息序号
+type UserSeq struct {
+	UsersID string `json:"usersid" gorm:"column:userid;primaryKey"`
+	Seq     int64  `json:"seq" gorm:"column:seq"`
 }
 
 type AdminPushMessage struct {
 	MessageID string
 	UserIDs   []string `json:"us"`
 	Tags      []string `json:"ts"`
+	// 标签表达式
+	Expr string `json:"x"`
+	// 排除的用户
+	Exclude []string `json:"ex"`
+	// 目标设备, 用户 -> clientid
+	Devices map[string][]string `json:"ms"`
+	// 只发送给这些平台的设备
+	Platforms []string `json:"ps"`
+	// 只发送给满足版本条件的设备, 例如 >=2.3.0 或 >=2.0,<3
+	AppVersion string `json:"av"`
+	// 确认策略 any 或 each
+	Policy string `json:"p"`
+	// 发送消息的用户, 只由客户端发送时设置
+	From string `json:"f"`
+	// 临时消息, 不保存, 只尽力发送给在线的客户端
+	Ephemeral bool `json:"ep"`
+	// 优先级 -1 低 0 普通 1 高
+	Priority int `json:"pr"`
+	// 幂等键, 来自请求头 Idempotency-Key
+	IdempotencyKey string `json:"-"`
 
 	Data string `json:"d"`
+	// 扩展数据, 原样发给客户端
+	Ext json.RawMessage `json:"e,omitempty"`
 }
 
 type PushMessageClient struct {
-	T  string        `json:"t"`
-	Ms []PushMessage `json:"ms"`
+	T  string        `json:"t" proto:"1"`
+	Ms []PushMessage `json:"ms" proto:"3"`
 }
 
 type ClusterMessage struct {
 	NodeName  string
 	Message   AdminPushMessage
 	Timestamp int64
+	// 接收者及其消息序号
+	Seqs map[string]int64
+	// 只发送给部分设备的接收者
+	Devices map[string][]string
+	// 发给客户端的请求和客户端的回复, 不为空时不是推送
+	RPC   *RPCRequest `json:",omitempty"`
+	Reply *RPCReply   `json:",omitempty"`
+	// 在线查询和踢人, 以及其他节点的结果
+	Query  *ClusterQuery  `json:",omitempty"`
+	Answer *ClusterAnswer `json:",omitempty"`
 }
 
 type PushMessage struct {
-	ID   string `json:"id"`
-	Ts   int64  `json:"ts"`
-	Data string `json:"data"`
+	ID   string `json:"id" proto:"1"`
+	Ts   int64  `json:"ts" proto:"2"`
+	Data string `json:"data" proto:"3"`
+	// 用户内的消息序号
+	Seq int64 `json:"sq,omitempty" proto:"4"`
+	// 发送消息的用户
+	From string `json:"f,omitempty" proto:"5"`
+	// 临时消息, 不需要回执
+	Ep bool `json:"ep,omitempty" proto:"6"`
+	// 优先级
+	Pr int `json:"pr,omitempty" proto:"7"`
+	// 扩展数据 json, protobuf 中为 bytes
+	Ext json.RawMessage `json:"e,omitempty" proto:"8"`
 }
 
 type ClientAck struct {
-	User string
-	IDs  []string
+	User     string
+	ClientID string
+	IDs      []string
+	// 已读回执
+	Read bool
 }
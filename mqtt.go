@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MQTT 3.1.1 网关.
+// CONNECT 的用户名为用户id, client id 为 clientid, 密码为 "ts:token";
+// 订阅 sw/t/<tag> 即订阅标签, 消息以 QoS1 发布到 sw/u/<user>, PUBACK 即送达回执.
+
+// 主题
+const (
+	MQTTTagTopic  = "sw/t/"
+	MQTTUserTopic = "sw/u/"
+)
+
+// 控制报文类型
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK 返回码
+const (
+	mqttAccepted           = 0
+	mqttBadVersion         = 1
+	mqttIdentifierRejected = 2
+	mqttUnavailable        = 3
+	mqttBadCredentials     = 4
+	mqttNotAuthorized      = 5
+)
+
+// SUBACK 订阅失败
+const mqttSubFailure = 0x80
+
+var errMQTTMalformed = errors.New("malformed packet")
+
+type mqttState struct {
+	conn net.Conn
+	// 保活时间, 0 不检查
+	keepalive time.Duration
+
+	mu  sync.Mutex
+	pid uint16
+	// 等待 PUBACK 的报文id -> 消息id
+	inflight map[uint16]string
+	// 消息id -> 报文id, 重发时使用相同的报文id
+	pids map[string]uint16
+	// 释放报文id时通知等待的 mqttWritePump
+	free chan struct{}
+}
+
+func newMQTTState(conn net.Conn) *mqttState {
+	return &mqttState{conn: conn, inflight: map[uint16]string{}, pids: map[string]uint16{}, free: make(chan struct{}, 1)}
+}
+
+func (m MQTTConfig) inflight() int {
+	if m.Inflight <= 0 {
+		return 100
+	}
+	if m.Inflight > 65535 {
+		return 65535
+	}
+	return m.Inflight
+}
+
+// release 删除消息的报文id, 返回报文id对应的消息id
+func (s *mqttState) release(pid uint16) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.inflight[pid]
+	if ok {
+		delete(s.inflight, pid)
+		delete(s.pids, id)
+		s.notify()
+	}
+	return id, ok
+}
+
+// releaseIDs 放弃重发的消息不再占用报文id
+func (s *mqttState) releaseIDs(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if pid, ok := s.pids[id]; ok {
+			delete(s.pids, id)
+			delete(s.inflight, pid)
+			s.notify()
+		}
+	}
+}
+
+func (s *mqttState) notify() {
+	select {
+	case s.free <- struct{}{}:
+	default:
+	}
+}
+
+// mqttRaw 已编码的报文, 由 mqttWritePump 发送
+type mqttRaw []byte
+
+type mqttPacket struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readMQTTPacket(r *bufio.Reader, max int64) (*mqttPacket, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, mul := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMQTTMalformed
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		n += int(b&127) * mul
+		if b&128 == 0 {
+			break
+		}
+		mul *= 128
+	}
+	if max > 0 && int64(n) > max {
+		return nil, errors.New("packet too large")
+	}
+	p := &mqttPacket{typ: h >> 4, flags: h & 0x0f, body: make([]byte, n)}
+	if _, err := io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func mqttEncode(typ, flags byte, body []byte) mqttRaw {
+	b := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			break
+		}
+	}
+	return append(b, body...)
+}
+
+func mqttAppendString(b []byte, s string) []byte {
+	return append(mqttAppendUint16(b, uint16(len(s))), s...)
+}
+
+func mqttAppendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// mqttReader 读取报文的可变头和载荷, 出错后返回零值
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) byte() byte {
+	if r.err != nil || len(r.b) < 1 {
+		r.err = errMQTTMalformed
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if r.err != nil || len(r.b) < 2 {
+		r.err = errMQTTMalformed
+		return 0
+	}
+	v := uint16(r.b[0])<<8 | uint16(r.b[1])
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *mqttReader) bytes() []byte {
+	n := int(r.uint16())
+	if r.err != nil || len(r.b) < n {
+		r.err = errMQTTMalformed
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *mqttReader) string() string {
+	return string(r.bytes())
+}
+
+func (n *Node) serveMQTT() {
+	log := zap.S().With("method", "mqtt")
+	l, err := net.Listen("tcp", DefConfig.MQTT.Host)
+	if err != nil {
+		log.Fatal("listen:", err)
+	}
+	log.Info("Start:", DefConfig.MQTT.Host)
+	n.acceptMQTT(l)
+}
+
+func (n *Node) acceptMQTT(l net.Listener) {
+	log := zap.S().With("method", "mqtt")
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Error("accept:", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Error("accept:", err)
+			return
+		}
+		go n.serveMQTTConn(conn)
+	}
+}
+
+func (n *Node) serveMQTTConn(conn net.Conn) {
+	if reason := n.reserve(); reason != "" {
+		zap.S().Info("mqtt:", reason)
+		conn.Close()
+		return
+	}
+	c := n.newClient(TransportMQTT, jsonCodec{})
+	c.mqtt = newMQTTState(conn)
+	go c.mqttWritePump()
+	defer func() {
+		n.UnRegister(c)
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	connected := false
+	for {
+		deadline := c.readDeadline()
+		if connected {
+			deadline = time.Time{}
+			if c.mqtt.keepalive > 0 {
+				deadline = time.Now().Add(c.mqtt.keepalive * 3 / 2)
+			}
+		}
+		conn.SetReadDeadline(deadline)
+		p, err := readMQTTPacket(r, DefConfig.Client.ReadMessageSizeLimit)
+		if err != nil {
+			if err != io.EOF {
+				c.log.Info("mqtt read:", err)
+			}
+			return
+		}
+		// 第一个报文必须是 CONNECT, 之后不能再有 CONNECT
+		if (p.typ == mqttConnect) == connected {
+			c.log.Info("mqtt: protocol violation:", p.typ)
+			return
+		}
+		switch p.typ {
+		case mqttConnect:
+			if !n.mqttConnect(c, p) {
+				return
+			}
+			connected = c.user != ""
+		case mqttSubscribe:
+			if !n.mqttSubscribe(c, p, true) {
+				return
+			}
+		case mqttUnsubscribe:
+			if !n.mqttSubscribe(c, p, false) {
+				return
+			}
+		case mqttPuback:
+			pr := &mqttReader{b: p.body}
+			pid := pr.uint16()
+			if pr.err != nil {
+				return
+			}
+			n.mqttAck(c, pid)
+		case mqttPublish:
+			// 不支持客户端发布, 确认后丢弃
+			qos := p.flags >> 1 & 3
+			pr := &mqttReader{b: p.body}
+			topic := pr.string()
+			if qos > 0 {
+				pid := pr.uint16()
+				if pr.err != nil {
+					return
+				}
+				if qos == 1 {
+					c.write(mqttEncode(mqttPuback, 0, mqttAppendUint16(nil, pid)))
+				}
+			}
+			c.log.Info("mqtt: drop publish:", topic)
+		case mqttPingreq:
+			c.write(mqttEncode(mqttPingresp, 0, nil))
+		case mqttDisconnect:
+			return
+		default:
+			c.log.Info("mqtt: unsupported packet:", p.typ)
+			return
+		}
+	}
+}
+
+// mqttConnect 处理 CONNECT, 登录结果由 mqttWritePump 以 CONNACK 返回,
+// 登录失败时 mqttWritePump 返回 CONNACK 后断开连接
+func (n *Node) mqttConnect(c *Client, p *mqttPacket) bool {
+	r := &mqttReader{b: p.body}
+	name := r.string()
+	level := r.byte()
+	flags := r.byte()
+	keepalive := r.uint16()
+	if r.err != nil || name != "MQTT" || flags&1 != 0 {
+		return false
+	}
+	if level != 4 {
+		mqttReject(c, mqttBadVersion)
+		return false
+	}
+	clientid := r.string()
+	if flags&0x04 != 0 {
+		// 遗嘱不支持, 跳过
+		r.string()
+		r.bytes()
+	}
+	var user, password string
+	if flags&0x80 != 0 {
+		user = r.string()
+	}
+	if flags&0x40 != 0 {
+		password = string(r.bytes())
+	}
+	if r.err != nil {
+		return false
+	}
+	if clientid == "" {
+		mqttReject(c, mqttIdentifierRejected)
+		return false
+	}
+	c.mqtt.keepalive = time.Duration(keepalive) * time.Second
+
+	f := &LoginFrame{Frame: Frame{T: T_LOGIN, I: "mqtt"}, U: user, M: clientid}
+	ts := password
+	if i := strings.IndexByte(password, ':'); i >= 0 {
+		ts, f.Tk = password[:i], password[i+1:]
+	}
+	f.Ts, _ = strconv.ParseInt(ts, 10, 64)
+	if ferr := f.Validate(); ferr != nil {
+		c.log.Info("mqtt connect:", ferr)
+		mqttReject(c, mqttBadCredentials)
+		return false
+	}
+	n.login(c, f)
+	return true
+}
+
+// mqttReject 登录前直接返回 CONNACK, 之后连接由调用方关闭
+func mqttReject(c *Client, code byte) {
+	c.mqtt.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.mqtt.conn.Write(mqttEncode(mqttConnack, 0, []byte{0, code}))
+}
+
+// mqttSubscribe 处理 SUBSCRIBE 和 UNSUBSCRIBE
+func (n *Node) mqttSubscribe(c *Client, p *mqttPacket, sub bool) bool {
+	if p.flags != 0x02 {
+		return false
+	}
+	r := &mqttReader{b: p.body}
+	pid := r.uint16()
+	topics := []string{}
+	qos := []byte{}
+	for r.err == nil && len(r.b) > 0 {
+		topics = append(topics, r.string())
+		if sub {
+			qos = append(qos, r.byte())
+		}
+	}
+	if r.err != nil || len(topics) == 0 {
+		return false
+	}
+
+	tags := map[string]bool{}
+	for _, t := range topics {
+		if tag := strings.TrimPrefix(t, MQTTTagTopic); tag != t && validTag(tag) == nil {
+			tags[tag] = sub
+		}
+	}
+	rs := map[string]int{}
+	if len(tags) > 0 {
+		rs = n.Tager(c, tags, false)
+	}
+	if !sub {
+		c.write(mqttEncode(mqttUnsuback, 0, mqttAppendUint16(nil, pid)))
+		return true
+	}
+	body := mqttAppendUint16(nil, pid)
+	for i, t := range topics {
+		granted := qos[i]
+		if granted > 1 {
+			granted = 1
+		}
+		switch {
+		case t == MQTTUserTopic+c.user:
+		case strings.HasPrefix(t, MQTTTagTopic):
+			if code, ok := rs[strings.TrimPrefix(t, MQTTTagTopic)]; !ok || code != codeInt(C_OK) {
+				granted = mqttSubFailure
+			}
+		default:
+			granted = mqttSubFailure
+		}
+		body = append(body, granted)
+	}
+	c.write(mqttEncode(mqttSuback, 0, body))
+	return true
+}
+
+// mqttAck 处理 PUBACK
+func (n *Node) mqttAck(c *Client, pid uint16) {
+	id, ok := c.mqtt.release(pid)
+	if !ok {
+		return
+	}
+	ids := []string{id}
+	n.Acker(ClientAck{User: c.user, ClientID: c.clientid, IDs: ids})
+	if c.pending != nil {
+		c.pending.ack(ids)
+	}
+}
+
+// mqttPublish 编码发给客户端的消息, 临时消息使用 QoS0.
+// 重发的消息使用相同的报文id并设置 DUP; 等待 PUBACK 的消息达到上限时返回 nil, 由调用方等待释放后再次编码
+func (c *Client) mqttPublish(m PushMessage) (mqttRaw, error) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	body := mqttAppendString(nil, MQTTUserTopic+c.user)
+	if m.Ep {
+		return mqttEncode(mqttPublish, 0, append(body, payload...)), nil
+	}
+	s := c.mqtt
+	flags := byte(0x02)
+	s.mu.Lock()
+	pid, ok := s.pids[m.ID]
+	if ok {
+		flags |= 0x08
+	} else {
+		if len(s.inflight) >= DefConfig.MQTT.inflight() {
+			s.mu.Unlock()
+			return nil, nil
+		}
+		// 未满时一定有空闲的报文id
+		for {
+			s.pid++
+			if _, ok := s.inflight[s.pid]; s.pid != 0 && !ok {
+				break
+			}
+		}
+		pid = s.pid
+		s.inflight[pid] = m.ID
+		s.pids[m.ID] = pid
+	}
+	s.mu.Unlock()
+	body = mqttAppendUint16(body, pid)
+	return mqttEncode(mqttPublish, flags, append(body, payload...)), nil
+}
+
+// mqttConnackCode 登录失败的返回码
+func mqttConnackCode(code int) byte {
+	switch code {
+	case codeInt(C_AUTH):
+		return mqttBadCredentials
+	case codeInt(C_LIMIT):
+		return mqttUnavailable
+	}
+	return mqttNotAuthorized
+}
+
+// mqttWritePump 把帧编码为 MQTT 报文发送, 不能表示为 MQTT 报文的帧会被丢弃
+func (c *Client) mqttWritePump() {
+	conn := c.mqtt.conn
+	defer conn.Close()
+	for {
+		frame, rv := c.recv(nil, nil)
+		if rv == recvDone {
+			return
+		}
+		packets := []mqttRaw{}
+		closing := false
+		switch v := frame.(type) {
+		case mqttRaw:
+			packets = append(packets, v)
+		case *LoginRespFrame:
+			packets = append(packets, mqttEncode(mqttConnack, 0, []byte{0, mqttAccepted}))
+		case *RespFrame:
+			if v.Rt != T_LOGIN {
+				continue
+			}
+			packets = append(packets, mqttEncode(mqttConnack, 0, []byte{0, mqttConnackCode(v.C)}))
+			closing = true
+		case *PushMessageClient:
+			for _, m := range v.Ms {
+				p, err := c.mqttPublish(m)
+				for err == nil && p == nil {
+					// 等待 PUBACK 释放报文id, 期间不再读取发送队列
+					c.log.Info("mqtt: inflight full, wait:", m.ID)
+					if !c.mqttWrite(packets) {
+						return
+					}
+					packets = packets[:0]
+					select {
+					case <-c.mqtt.free:
+					case <-c.done:
+						return
+					}
+					p, err = c.mqttPublish(m)
+				}
+				if err != nil {
+					c.log.Error("mqtt publish:", err)
+					continue
+				}
+				packets = append(packets, p)
+			}
+		case *CloseFrame:
+			// MQTT 3.1.1 服务端没有 DISCONNECT, 直接断开
+			return
+		default:
+			continue
+		}
+		if !c.mqttWrite(packets) || closing {
+			return
+		}
+	}
+}
+
+// mqttWrite 发送报文, 失败时返回 false
+func (c *Client) mqttWrite(packets []mqttRaw) bool {
+	conn := c.mqtt.conn
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	for _, p := range packets {
+		if _, err := conn.Write(p); err != nil {
+			c.log.Info("mqtt write:", err)
+			return false
+		}
+	}
+	return true
+}
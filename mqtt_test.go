@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// mqttClient 测试用的 MQTT 客户端, 服务端通过 net.Pipe 连接
+type mqttClient struct {
+	t       *testing.T
+	conn    net.Conn
+	packets chan *mqttPacket
+}
+
+func mqttDial(t *testing.T, tn *testNode) *mqttClient {
+	t.Helper()
+	client, server := net.Pipe()
+	go tn.serveMQTTConn(server)
+	c := &mqttClient{t: t, conn: client, packets: make(chan *mqttPacket, 1024)}
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer close(c.packets)
+		r := bufio.NewReader(client)
+		for {
+			p, err := readMQTTPacket(r, 0)
+			if err != nil {
+				return
+			}
+			c.packets <- p
+		}
+	}()
+	return c
+}
+
+// mqttLogin 连接并登录, 返回 CONNACK 的返回码
+func mqttLogin(t *testing.T, tn *testNode, user, m string) (*mqttClient, byte) {
+	t.Helper()
+	ts := fmt.Sprint(time.Now().Unix())
+	return mqttLoginPassword(t, tn, user, m, ts+":"+SignMD5(DefConfig.Secret, user+m, ts))
+}
+
+func mqttLoginPassword(t *testing.T, tn *testNode, user, m, password string) (*mqttClient, byte) {
+	t.Helper()
+	c := mqttDial(t, tn)
+	body := mqttAppendString(nil, "MQTT")
+	body = append(body, 4, 0xc2)
+	body = mqttAppendUint16(body, 60)
+	body = mqttAppendString(body, m)
+	body = mqttAppendString(body, user)
+	body = mqttAppendString(body, password)
+	c.send(mqttEncode(mqttConnect, 0, body))
+	p := c.next()
+	if p.typ != mqttConnack || len(p.body) != 2 {
+		t.Fatalf("expect connack, got %+v", p)
+	}
+	return c, p.body[1]
+}
+
+func (c *mqttClient) send(p mqttRaw) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(waitTimeout))
+	if _, err := c.conn.Write(p); err != nil {
+		c.t.Fatal("mqtt write:", err)
+	}
+}
+
+func (c *mqttClient) next() *mqttPacket {
+	c.t.Helper()
+	select {
+	case p, ok := <-c.packets:
+		if !ok {
+			c.t.Fatal("mqtt: connection closed")
+		}
+		return p
+	case <-time.After(waitTimeout):
+		c.t.Fatal("mqtt: timeout waiting for packet")
+	}
+	return nil
+}
+
+func (c *mqttClient) silent(d time.Duration) {
+	c.t.Helper()
+	select {
+	case p, ok := <-c.packets:
+		if ok {
+			c.t.Fatalf("mqtt: unexpected packet %+v", p)
+		}
+	case <-time.After(d):
+	}
+}
+
+// mqttMessage 收到的 PUBLISH
+type mqttMessage struct {
+	flags byte
+	topic string
+	pid   uint16
+	m     PushMessage
+}
+
+func (c *mqttClient) publish() mqttMessage {
+	c.t.Helper()
+	p := c.next()
+	if p.typ != mqttPublish {
+		c.t.Fatalf("expect publish, got %+v", p)
+	}
+	r := &mqttReader{b: p.body}
+	mm := mqttMessage{flags: p.flags, topic: r.string()}
+	if p.flags&0x06 != 0 {
+		mm.pid = r.uint16()
+	}
+	if r.err != nil {
+		c.t.Fatal("mqtt publish:", r.err)
+	}
+	if err := json.Unmarshal(r.b, &mm.m); err != nil {
+		c.t.Fatal("mqtt payload:", err)
+	}
+	return mm
+}
+
+func (c *mqttClient) puback(pid uint16) {
+	c.t.Helper()
+	c.send(mqttEncode(mqttPuback, 0, mqttAppendUint16(nil, pid)))
+}
+
+func (c *mqttClient) subscribe(topics ...string) []byte {
+	c.t.Helper()
+	body := mqttAppendUint16(nil, 1)
+	for _, topic := range topics {
+		body = append(mqttAppendString(body, topic), 1)
+	}
+	c.send(mqttEncode(mqttSubscribe, 0x02, body))
+	p := c.next()
+	if p.typ != mqttSuback || len(p.body) != 2+len(topics) {
+		c.t.Fatalf("expect suback, got %+v", p)
+	}
+	return p.body[2:]
+}
+
+func (c *mqttClient) inflight(tn *testNode, user, m string) int {
+	c.t.Helper()
+	n := -1
+	for _, cl := range tn.userClients(user) {
+		if cl.clientid == m && cl.mqtt != nil {
+			cl.mqtt.mu.Lock()
+			n = len(cl.mqtt.inflight)
+			cl.mqtt.mu.Unlock()
+		}
+	}
+	return n
+}
+
+func TestMQTT(t *testing.T) {
+	tn := newTestNode(t)
+
+	if _, code := mqttLoginPassword(t, tn, "u1", "m1", fmt.Sprint(time.Now().Unix())+":bad"); code != mqttBadCredentials {
+		t.Fatalf("bad token: %d", code)
+	}
+	c, code := mqttLogin(t, tn, "u1", "m1")
+	if code != mqttAccepted {
+		t.Fatalf("connack: %d", code)
+	}
+	if rs := c.subscribe(MQTTTagTopic+"news", MQTTUserTopic+"u1", "other/#"); rs[0] != 1 || rs[1] != 1 || rs[2] != mqttSubFailure {
+		t.Fatalf("suback: %v", rs)
+	}
+
+	id := tn.publish(AdminPushMessage{Tags: []string{"news"}, Data: "x"})
+	mm := c.publish()
+	if mm.flags != 0x02 || mm.topic != MQTTUserTopic+"u1" || mm.m.ID != id || mm.pid == 0 {
+		t.Fatalf("publish: %+v", mm)
+	}
+	c.puback(mm.pid)
+	waitFor(t, func() bool { return userAcked(t, tn, "u1", id) })
+	if n := c.inflight(tn, "u1", "m1"); n != 0 {
+		t.Fatalf("inflight after puback: %d", n)
+	}
+
+	// 临时消息使用 QoS0
+	tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "y", Ephemeral: true})
+	if mm := c.publish(); mm.flags != 0 || mm.pid != 0 || mm.m.Data != "y" {
+		t.Fatalf("ephemeral publish: %+v", mm)
+	}
+
+	c.send(mqttEncode(mqttPingreq, 0, nil))
+	if p := c.next(); p.typ != mqttPingresp {
+		t.Fatalf("expect pingresp, got %+v", p)
+	}
+}
+
+// TestMQTTRedeliver 重发使用相同的报文id并设置 DUP
+func TestMQTTRedeliver(t *testing.T) {
+	old := DefConfig.Redelivery
+	DefConfig.Redelivery = RedeliveryConfig{Enable: true, Interval: 1}
+	t.Cleanup(func() { DefConfig.Redelivery = old })
+	tn := newTestNode(t)
+
+	c, _ := mqttLogin(t, tn, "u1", "m1")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	first := c.publish()
+	again := c.publish()
+	if again.m.ID != id || again.pid != first.pid || again.flags != 0x0a {
+		t.Fatalf("redeliver: first %+v, again %+v", first, again)
+	}
+	c.puback(again.pid)
+	waitFor(t, func() bool { return c.inflight(tn, "u1", "m1") == 0 })
+}
+
+// TestMQTTInflightLimit 等待 PUBACK 的消息达到上限时暂不发布, 确认后由重发补上
+// TestMQTTInflightLimit 等待 PUBACK 的消息达到上限时暂停发送, 不开启重发也不会丢消息
+func TestMQTTInflightLimit(t *testing.T) {
+	oldMQTT := DefConfig.MQTT
+	DefConfig.MQTT.Inflight = 2
+	t.Cleanup(func() { DefConfig.MQTT = oldMQTT })
+	tn := newTestNode(t)
+
+	c, _ := mqttLogin(t, tn, "u1", "m1")
+	sent := []string{}
+	for i := 0; i < 4; i++ {
+		sent = append(sent, tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: fmt.Sprint(i)}))
+	}
+	a, b := c.publish(), c.publish()
+	if a.pid == b.pid {
+		t.Fatalf("same pid: %+v %+v", a, b)
+	}
+	if n := c.inflight(tn, "u1", "m1"); n != 2 {
+		t.Fatalf("inflight: %d", n)
+	}
+	got := []string{a.m.ID, b.m.ID}
+	c.puback(a.pid)
+	mm := c.publish()
+	if mm.flags&0x08 != 0 {
+		t.Fatalf("delayed publish: %+v", mm)
+	}
+	got = append(got, mm.m.ID)
+	c.puback(b.pid)
+	got = append(got, c.publish().m.ID)
+	if !reflect.DeepEqual(got, sent) {
+		t.Fatalf("published %v, want %v", got, sent)
+	}
+}
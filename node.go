@@ -6,11 +6,10 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-redis/redis/v9"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"gorm.io/driver/postgres"
@@ -29,15 +28,40 @@ type Node struct {
 	clientids *sync.Map
 	//	users     map[string]map[string]*Client
 	users *sync.Map
+	// 保护users中每个用户的客户端map
+	ulock sync.Mutex
+
+	// 当前连接数
+	conns int64
+	// 未登录连接数
+	unauth int64
 
 	db *gorm.DB
 
-	rdb  *redis.Client
-	rpub *redis.PubSub
+	// 节点名, 集群内唯一
+	name string
+	// 集群广播, 没有开启集群时为 nil
+	cluster Cluster
+	// 关闭后停止后台任务
+	done chan struct{}
+	// 待写入的设备发送记录, 由 sentWriter 批量写入, 写完后关闭 sentDone
+	sents    chan DeviceMessage
+	sentDone chan struct{}
 
-	id int
+	id int64
 
 	upgrader websocket.Upgrader
+
+	upstream UpstreamSink
+
+	// 等待客户端回复的请求, id -> chan *RPCReply
+	rpcs sync.Map
+	// 已发给本节点客户端的请求, id -> *rpcCall
+	rpcOut sync.Map
+	// 非 websocket 传输的会话, sid -> *Client
+	sessions sync.Map
+	// 等待其他节点回复的查询, id -> chan *ClusterAnswer
+	queries sync.Map
 }
 
 type tag struct {
@@ -45,294 +69,497 @@ type tag struct {
 	tag map[string]interface{}
 }
 
-func newNode() *Node {
-	log := zap.S()
-
+// openDB 连接数据库
+func openDB() (*gorm.DB, error) {
 	loglevel := logger.Error
 	if DefConfig.DBLog {
 		loglevel = logger.Info
 	}
 
-	db, err := gorm.Open(postgres.Open(DefConfig.DB), &gorm.Config{
+	return gorm.Open(postgres.Open(DefConfig.DB), &gorm.Config{
 		CreateBatchSize: 10,
 		Logger: logger.New(zap.NewStdLog(zap.L()), logger.Config{
 			SlowThreshold: 200 * time.Millisecond,
 			LogLevel:      loglevel,
 		}),
 	})
-	if err != nil {
-		log.Fatal(err)
+}
+
+// migrateDB 创建和更新表结构
+func migrateDB(db *gorm.DB) error {
+	if err := db.AutoMigrate(new(UserTag), new(Message), new(UserMessage), new(UserSeq), new(UserDevice), new(DeviceMessage)); err != nil {
+		return err
+	}
+	if err := migrateTags(db); err != nil {
+		return fmt.Errorf("migrate tags: %w", err)
 	}
-	//	db.LogMode(true)
-	db.AutoMigrate(new(UserTag), new(Message), new(UserMessage))
+	return nil
+}
+
+func newNode(name string, db *gorm.DB, cluster Cluster) *Node {
+	log := zap.S()
+
 	n := &Node{
 		clientids: &sync.Map{},
 		clients:   &sync.Map{},
 		users:     &sync.Map{},
 		db:        db,
+		name:      name,
+		cluster:   cluster,
+		done:      make(chan struct{}),
+		sents:     make(chan DeviceMessage, sentQueue),
+		sentDone:  make(chan struct{}),
 	}
+	go n.tagSweeper()
+	go n.sentWriter()
+	go n.pollSweeper()
 
 	n.upgrader = websocket.Upgrader{
-		ReadBufferSize:  DefConfig.Client.ReadBufferSize,
-		WriteBufferSize: DefConfig.Client.WriteBufferSize,
+		ReadBufferSize:    DefConfig.Client.ReadBufferSize,
+		WriteBufferSize:   DefConfig.Client.WriteBufferSize,
+		EnableCompression: DefConfig.Client.Compression,
+		Subprotocols:      codecNames(),
 	}
 	n.upgrader.CheckOrigin = func(r *http.Request) bool {
 		return true
 	}
-	if DefConfig.Redis.Enable {
-		n.rdb = redis.NewClient(&redis.Options{
-			Addr:         DefConfig.Redis.Host,
-			DialTimeout:  10 * time.Second,
-			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
-			PoolSize:     10,
-			PoolTimeout:  30 * time.Second,
-		})
-		if DefConfig.Redis.Name == "" {
-			DefConfig.Redis.Name = time.Now().Format("Node-20060102150405")
-		}
-		if DefConfig.Redis.Channel == "" {
-			DefConfig.Redis.Channel = DefConfig.Redis.Name
-		}
-
-		if err := n.rdb.Ping(context.Background()).Err(); err != nil {
-			log.Fatal("redis err:", err.Error())
+	if DefConfig.Upstream.Enable {
+		var err error
+		if n.upstream, err = newUpstreamSink(); err != nil {
+			log.Fatal(err)
 		}
-
+	}
+	if n.cluster != nil {
 		go n.clusterRev()
-
-		log.Info("Node Enable Redis Cluster:", DefConfig.Redis.Name, DefConfig.Redis.Channel)
-
+		log.Info("Node Enable Cluster:", n.name)
 	}
 
 	return n
 }
 
-func (n *Node) clusterRev() {
-	log := zap.S().With("method", "clusterRev")
-	defer func() {
-		if err := recover(); err != nil {
-			log.Error("ClusterRev err:", err)
-		}
-		go n.clusterRev()
-	}()
-	n.rpub = n.rdb.Subscribe(context.Background(), DefConfig.Redis.Channel)
-
-	m := ClusterMessage{}
-	for msg := range n.rpub.Channel() {
-		if err := json.Unmarshal([]byte(msg.Payload), &m); err != nil {
-			fmt.Printf("ClusterRev Json Error:%+v,%s", msg, err)
-			continue
-		}
-		if m.NodeName == DefConfig.Redis.Name {
-			continue
-		}
-		log.Info("ClusterRev:", DefConfig.Redis.Name, msg.Channel, m.NodeName, m.Message)
-
-		go n.Publish(m.Message, true, m.Timestamp)
-	}
-}
-
 func (n *Node) Close() {
-	if n.rpub != nil {
-		n.rpub.Close()
-	}
-	if n.rdb != nil {
-		n.rdb.Close()
+	close(n.done)
+	<-n.sentDone
+	if n.cluster != nil {
+		n.cluster.Close()
 	}
 }
 
-func (n *Node) Register(client *Client) {
+// Register 登记已登录的客户端, 设备数超限时按策略踢掉最早的设备或拒绝登录
+func (n *Node) Register(client *Client) bool {
 	log := zap.S().With("method", "Register", "user", client.user, "clientid", client.clientid)
 	log.Info("register")
-	n.clients.Store(client, nil)
-	if us, ok := n.users.Load(client.user); ok {
-		us.(map[string]*Client)[client.clientid] = client
-		n.users.Store(client.user, us)
-	} else {
-		n.users.Store(client.user, map[string]*Client{
-			client.clientid: client,
-		})
+
+	evict := []*Client{}
+	n.ulock.Lock()
+	us := map[string]*Client{}
+	if v, ok := n.users.Load(client.user); ok {
+		us = v.(map[string]*Client)
+	}
+	// 相同clientid视为重连, 替换旧连接
+	if old, ok := us[client.clientid]; ok {
+		evict = append(evict, old)
+		delete(us, client.clientid)
 	}
-	// 发送离线消息
-	mids := []string{}
-	if err := n.db.Model(new(UserMessage)).
-		Where("userid = ? and ack = ?", client.user, false).
-		Order("created_at").
-		Pluck("messageid", &mids).Error; err != nil {
-		log.Error("db:find offline message id:", err)
-	}
-	if len(mids) > 0 {
-		skip := 0
-		for {
-			ms := []Message{}
-			end := skip + 5
-			if end > len(mids) {
-				end = len(mids)
+	if max := DefConfig.Limit.MaxDevices; max > 0 {
+		for len(us) >= max {
+			if DefConfig.Limit.DevicePolicy == DevicePolicyReject {
+				n.ulock.Unlock()
+				log.Info("register:device limit reject")
+				return false
 			}
-			ids := mids[skip:end]
-			if err := n.db.Where("messageid in (?)", ids).Order("created_at").Find(&ms).Error; err != nil {
-				log.Error("db:find offline message:", err)
-				break
-			} else {
-				if len(ms) == 0 {
-					break
-				}
-				p := PushMessageClient{
-					T:  "m",
-					Ms: []PushMessage{},
-				}
-				for _, v := range ms {
-					p.Ms = append(p.Ms, PushMessage{
-						ID:   v.MessagesID,
-						Ts:   v.CreatedAt.Unix(),
-						Data: v.Data,
-					})
-				}
-				data, err := json.Marshal(&p)
-				if err != nil {
-					log.Error("json:marshal message:", err)
-				}
-				client.send <- data
-				skip += 5
-				if skip >= len(mids) {
-					break
+			var oldest *Client
+			for _, v := range us {
+				if oldest == nil || v.logined.Before(oldest.logined) {
+					oldest = v
 				}
 			}
+			evict = append(evict, oldest)
+			delete(us, oldest.clientid)
 		}
 	}
-}
+	us[client.clientid] = client
+	n.users.Store(client.user, us)
+	n.ulock.Unlock()
 
-func (n *Node) UnRegister(client *Client) {
-	zap.S().Info("unregister:", client.user, client.clientid)
-	if _, ok := n.clients.Load(client); ok {
-		n.clients.Delete(client)
-		if users, ok := n.users.Load(client.user); ok {
-			delete(users.(map[string]*Client), client.clientid)
-		}
-		close(client.send)
+	n.clients.Store(client, nil)
+	for _, c := range evict {
+		c.kick(websocket.ClosePolicyViolation, "device limit")
 	}
+	return true
 }
 
-func (n *Node) Tager(c *Client, tag map[string]interface{}) {
-	log := zap.S().With("method", "tager", "user", c.user, "clientid", c.clientid)
-	log.Info("Tager")
-	nt := []string{}
-	ct := []string{}
-	for k, v := range tag {
-		if vb, ok := v.(bool); ok {
-			if vb {
-				nt = append(nt, k)
-			} else {
-				ct = append(ct, k)
+// offlineBatch 离线消息每帧条数
+const offlineBatch = 5
+
+type offlineMessage struct {
+	ID         uint
+	MessagesID string `gorm:"column:messageid"`
+	Seq        int64
+	Priority   int
+	Data       string
+	Ext        string
+	Sender     string
+	CreatedAt  time.Time
+}
+
+// Offline 发送全部未确认的消息, since 为客户端最后收到的序号, 不为空时还发送序号之后已被其他设备确认的消息.
+// 按优先级从高到低, 同优先级按序号发送
+func (n *Node) Offline(client *Client, since *int64) {
+	log := zap.S().With("method", "Offline", "user", client.user, "clientid", client.clientid)
+	var last *offlineMessage
+	for {
+		q := n.db.Table("user_messages um").
+			Select("um.id, um.messageid, um.seq, um.priority, m.data, m.ext, m.sender, m.created_at").
+			Joins("join messages m on m.messageid = um.messageid and m.deleted_at is null").
+			Where("um.userid = ? and um.deleted_at is null", client.user)
+		// 只发送给部分设备的消息
+		q = q.Where(`(um.devices = ? or exists (select 1 from device_messages dm where dm.messageid = um.messageid
+			and dm.userid = um.userid and dm.clientid = ?))`, false, client.clientid)
+		unacked := `um.ack = ? and not exists (select 1 from device_messages dm where dm.messageid = um.messageid
+			and dm.userid = um.userid and dm.clientid = ? and dm.ack = ?)`
+		if since != nil {
+			// 补发按优先级排序, 客户端可能先回执了序号更大的消息, 未确认的消息不论序号都补发
+			q = q.Where("(um.seq > ? or ("+unacked+"))", *since, false, client.clientid, true)
+		} else {
+			q = q.Where(unacked, false, client.clientid, true)
+		}
+		if last != nil {
+			q = q.Where("(um.priority < ? or (um.priority = ? and (um.seq > ? or (um.seq = ? and um.id > ?))))",
+				last.Priority, last.Priority, last.Seq, last.Seq, last.ID)
+		}
+		ms := []offlineMessage{}
+		if err := q.Order("um.priority desc, um.seq, um.id").
+			Limit(offlineBatch).
+			Scan(&ms).Error; err != nil {
+			log.Error("db:find offline message:", err)
+			return
+		}
+		if len(ms) == 0 {
+			return
+		}
+		p := PushMessageClient{
+			T:  "m",
+			Ms: []PushMessage{},
+		}
+		for _, v := range ms {
+			pm := PushMessage{
+				ID:   v.MessagesID,
+				Ts:   v.CreatedAt.Unix(),
+				Data: v.Data,
+				Seq:  v.Seq,
+				From: v.Sender,
+				Pr:   v.Priority,
+			}
+			if v.Ext != "" {
+				pm.Ext = json.RawMessage(v.Ext)
 			}
+			p.Ms = append(p.Ms, pm)
 		}
-	}
-	if len(nt) > 0 {
-		tags := []string{}
-		if err := n.db.Model(new(UserTag)).Where("userid = ? and tag in (?)", c.user, nt).Pluck("tag", &tags).Error; err != nil {
-			log.Error("db:find tags users:", err)
+		if !client.write(&p) {
+			return
+		}
+		client.sent(p.Ms)
+		n.markSent(client, p.Ms)
+		last = &ms[len(ms)-1]
+		if len(ms) < offlineBatch {
+			return
 		}
-		tm := map[string]struct{}{}
-		for _, v := range tags {
-			tm[v] = struct{}{}
+	}
+}
+
+// UnRegister 注销客户端, 多次调用只生效一次
+func (n *Node) UnRegister(client *Client) {
+	client.unregOnce.Do(func() {
+		zap.S().Info("unregister:", client.user, client.clientid)
+		atomic.AddInt64(&n.conns, -1)
+		if client.user == "" {
+			atomic.AddInt64(&n.unauth, -1)
 		}
-		for _, v := range nt {
-			if _, ok := tm[v]; !ok {
-				if err := n.db.Create(&UserTag{
-					UsersID: c.user,
-					Tag:     v,
-				}); err != nil {
-					log.Error("db:add user_tags users:", c.user, v)
+		if _, ok := n.clients.Load(client); ok {
+			n.clients.Delete(client)
+			n.ulock.Lock()
+			if users, ok := n.users.Load(client.user); ok {
+				us := users.(map[string]*Client)
+				if us[client.clientid] == client {
+					delete(us, client.clientid)
 				}
 			}
+			n.ulock.Unlock()
+		}
+		if client.sid != "" {
+			n.sessions.Delete(client.sid)
+		}
+		client.close()
+	})
+}
+
+// userClients 返回用户当前在线的客户端
+func (n *Node) userClients(user string) []*Client {
+	n.ulock.Lock()
+	defer n.ulock.Unlock()
+	cs := []*Client{}
+	if us, ok := n.users.Load(user); ok {
+		for _, c := range us.(map[string]*Client) {
+			cs = append(cs, c)
 		}
 	}
-	if len(ct) > 0 {
-		if err := n.db.Exec("delete from user_tags where userid = ? and tag in (?)", c.user, ct).Error; err != nil {
-			log.Error("db:delete user_tags users:", c.user, ct, err)
+	return cs
+}
+
+// Tager 订阅或取消订阅标签, device 为 true 时只对当前设备生效, 返回每个标签的结果
+func (n *Node) Tager(c *Client, tag map[string]bool, device bool) map[string]int {
+	log := zap.S().With("method", "tager", "user", c.user, "clientid", c.clientid)
+	log.Info("Tager")
+	add := map[string]*TagOptions{}
+	del := []string{}
+	for k, v := range tag {
+		if v {
+			add[k] = nil
+		} else {
+			del = append(del, k)
 		}
 	}
+	clientid := ""
+	if device {
+		clientid = c.clientid
+	}
+	return n.setTags(log, c.user, clientid, add, del)
 }
 
-func (n *Node) Publish(m AdminPushMessage, r bool, ts int64) {
+func (n *Node) Publish(m AdminPushMessage) {
 	log := zap.S().With("method", "public")
-	log.Info("publish:", m.UserIDs, m.MessageID, m.Tags, m.Data)
-	// 查询 tags对应user
-	users := []string{}
-	if m.Tags != nil && len(m.Tags) > 0 {
-		if err := n.db.Model(new(UserTag)).Where("tag in (?)", m.Tags).Pluck("userid", &users).Error; err != nil {
-			log.Error("db:find tags users:", err)
+	log.Info("publish:", m.UserIDs, m.MessageID, m.Tags, m.Expr, m.Data)
+	users, devices, err := n.Audience(m)
+	if err != nil {
+		log.Error("db:find audience:", err)
+	}
+
+	var ts int64
+	seqs := map[string]int64{}
+	if m.Ephemeral {
+		// 临时消息不保存, 没有序号
+		ts = time.Now().Unix()
+		for _, id := range users {
+			seqs[id] = 0
 		}
+	} else {
+		ts, seqs = n.persist(m, users, devices)
 	}
-	users = sm(users, m.UserIDs)
-	if !r {
-		// 保存消息
-		dm := Message{
-			MessagesID: m.MessageID,
-			Data:       m.Data,
-		}
-		if err := n.db.Create(&dm).Error; err != nil {
-			log.Error("db:save message:", err)
-		}
-		ts = dm.CreatedAt.Unix()
-
-		if n.rdb != nil {
-			d, err := json.Marshal(ClusterMessage{
-				NodeName:  DefConfig.Redis.Name,
-				Timestamp: ts,
-				Message:   m,
-			})
-			if err != nil {
-				log.Error("redis json:", err.Error())
-			} else {
-				r, err := n.rdb.Publish(context.Background(), DefConfig.Redis.Channel, string(d)).Result()
-				log.Info("redis:", r, err)
-			}
+
+	if n.cluster != nil {
+		err := n.broadcast(context.Background(), ClusterMessage{
+			Timestamp: ts,
+			Message:   m,
+			Seqs:      seqs,
+			Devices:   devices,
+		})
+		if err != nil {
+			log.Error("cluster:", err)
 		}
 	}
-	p := PushMessageClient{
-		T: "m",
-		Ms: []PushMessage{
-			{
-				ID:   m.MessageID,
-				Ts:   ts,
-				Data: m.Data,
-			},
-		},
+	n.deliver(m, ts, seqs, devices)
+}
+
+// persist 保存消息和接收者的收件箱, 返回消息时间和接收者的序号
+func (n *Node) persist(m AdminPushMessage, users []string, devices map[string][]string) (int64, map[string]int64) {
+	log := zap.S().With("method", "persist", "message", m.MessageID)
+	if m.Policy == "" {
+		m.Policy = PolicyAny
 	}
-	data, err := json.Marshal(&p)
-	if err != nil {
-		log.Error("json:marshal message:", err)
+	// 保存消息, 带幂等键的消息在推送前已保存
+	dm := messageRow(m)
+	if m.IdempotencyKey != "" {
+		if err := n.db.Select("created_at").Where("messageid = ?", m.MessageID).Take(&dm).Error; err != nil {
+			log.Error("db:find message:", err)
+		}
+	} else if err := n.db.Create(&dm).Error; err != nil {
+		log.Error("db:save message:", err)
 	}
+
 	// 保存发送消息
+	seqs := map[string]int64{}
 	for _, id := range users {
+		seq, err := n.nextSeq(id)
+		if err != nil {
+			log.Error("db:next seq:", id, err)
+			continue
+		}
+		ms, limited := devices[id]
 		if err := n.db.Create(&UserMessage{
 			MessagesID: m.MessageID,
 			UsersID:    id,
+			Seq:        seq,
+			Policy:     m.Policy,
+			Priority:   m.Priority,
+			Devices:    limited,
 		}).Error; err != nil {
 			log.Error("db:save user message:", err)
+			continue
 		}
-		if um, ok := n.users.Load(id); ok {
-			for _, c := range um.(map[string]*Client) {
-				c.send <- data
+		if limited {
+			if err := n.targetDevices(m.MessageID, id, ms); err != nil {
+				log.Error("db:save device message:", err)
 			}
 		}
+		seqs[id] = seq
+	}
+	return dm.CreatedAt.Unix(), seqs
+}
+
+// messageRow 保存的消息
+func messageRow(m AdminPushMessage) Message {
+	dm := Message{
+		MessagesID: m.MessageID,
+		Policy:     m.Policy,
+		Priority:   m.Priority,
+		From:       m.From,
+		Data:       m.Data,
+		Ext:        string(m.Ext),
+	}
+	if dm.Policy == "" {
+		dm.Policy = PolicyAny
+	}
+	if m.IdempotencyKey != "" {
+		dm.IdempotencyKey = &m.IdempotencyKey
 	}
+	return dm
 }
 
-func (n *Node) Acker(a ClientAck) {
+// deliver 发送给本节点在线的接收者, seqs 为接收者及其消息序号, devices 为只发送给部分设备的接收者
+func (n *Node) deliver(m AdminPushMessage, ts int64, seqs map[string]int64, devices map[string][]string) {
+	for id, seq := range seqs {
+		cs := n.userClients(id)
+		if ms, ok := devices[id]; ok {
+			cs = filterClients(cs, ms)
+		}
+		if len(cs) == 0 {
+			continue
+		}
+		p := PushMessageClient{
+			T: "m",
+			Ms: []PushMessage{
+				{
+					ID:   m.MessageID,
+					Ts:   ts,
+					Data: m.Data,
+					Seq:  seq,
+					From: m.From,
+					Ep:   m.Ephemeral,
+					Pr:   m.Priority,
+					Ext:  m.Ext,
+				},
+			},
+		}
+		for _, c := range cs {
+			if c.write(&p) && !m.Ephemeral {
+				c.sent(p.Ms)
+				n.markSent(c, p.Ms)
+			}
+		}
+	}
+}
+
+// nextSeq 分配用户的下一个消息序号
+func (n *Node) nextSeq(user string) (int64, error) {
+	var seq int64
+	err := n.db.Raw("insert into user_seqs (userid, seq) values (?, 1) on conflict (userid) do update set seq = user_seqs.seq + 1 returning seq", user).Scan(&seq).Error
+	return seq, err
+}
+
+// lastSeq 用户当前最大的消息序号
+func (n *Node) lastSeq(user string) (int64, error) {
+	seqs := []int64{}
+	err := n.db.Model(new(UserSeq)).Where("userid = ?", user).Pluck("seq", &seqs).Error
+	if err != nil || len(seqs) == 0 {
+		return 0, err
+	}
+	return seqs[0], nil
+}
+
+// Acker 处理回执, 返回不是发给该用户而被忽略的消息id
+func (n *Node) Acker(a ClientAck) []string {
 	log := zap.S().With("method", "acker", "user", a.User)
 	log.Info("acker", a.IDs)
-	if err := n.db.Model(new(UserMessage)).Where("userid = ? and messageid in (?)", a.User, a.IDs).Update("ack", true).Error; err != nil {
+	dropped, err := n.deviceAck(a)
+	if err != nil {
 		log.Error("acker:db:update user message ack:", err)
 	}
+	if len(dropped) > 0 {
+		log.Info("acker:dropped:", dropped)
+	}
+	return dropped
 }
 
 func (n *Node) auth(c *Client, u, m, tk string, ts int64) bool {
 	return CheckTokenMD5(DefConfig.Secret, u, m, fmt.Sprint(ts), tk)
 }
 
+// Audience 推送的接收者: 标签、用户、设备和表达式的并集, 去掉排除的用户, 再按设备属性筛选.
+// devices 为只发送给部分设备的用户及其设备, 不在其中的接收者发送给所有设备
+func (n *Node) Audience(m AdminPushMessage) ([]string, map[string][]string, error) {
+	var rerr error
+	// 查询 tags对应user
+	users := []string{}
+	devices := map[string][]string{}
+	if m.Tags != nil && len(m.Tags) > 0 {
+		var err error
+		if users, devices, err = n.tagUsers(m.Tags); err != nil {
+			rerr = err
+		}
+	}
+	if m.Expr != "" {
+		e, err := parseTagExpr(m.Expr)
+		if err != nil {
+			return nil, nil, err
+		}
+		eusers, err := n.exprUsers(e)
+		if err != nil {
+			rerr = err
+		}
+		users = append(users, eusers...)
+	}
+	if len(m.Devices) > 0 {
+		mdevices, err := n.clientDevices(m.Devices)
+		if err != nil {
+			rerr = err
+		}
+		for u, ms := range mdevices {
+			devices[u] = append(devices[u], ms...)
+		}
+	}
+	users = sm(users, m.UserIDs)
+	// 发送给所有设备的用户不再限制设备
+	for _, u := range users {
+		delete(devices, u)
+	}
+	for u, ms := range devices {
+		devices[u] = sm(ms)
+		users = append(users, u)
+	}
+	if len(m.Exclude) > 0 {
+		ex := map[string]struct{}{}
+		for _, v := range m.Exclude {
+			ex[v] = struct{}{}
+			delete(devices, v)
+		}
+		r := []string{}
+		for _, v := range users {
+			if _, ok := ex[v]; !ok {
+				r = append(r, v)
+			}
+		}
+		users = r
+	}
+	if len(m.Platforms) > 0 || m.AppVersion != "" {
+		var err error
+		if users, devices, err = n.filterDevices(users, devices, m.Platforms, m.AppVersion); err != nil {
+			rerr = err
+		}
+	}
+	return users, devices, rerr
+}
+
 func sm(s ...[]string) []string {
 	m := map[string]struct{}{}
 
@@ -355,92 +582,222 @@ type ch struct {
 }
 
 func (n *Node) ClientHandler(c *Client, data []byte) {
-	m := map[string]interface{}{}
+	head := Frame{}
 	defer func() {
 		if err := recover(); err != nil {
 			c.log.Errorf("handler panic:%v\n", err)
-			c.send <- resp("e", fmt.Sprint(m["i"]), C_FAIL, fmt.Sprint(err))
+			c.write(resp("e", head.I, C_FAIL, fmt.Sprint(err)))
 		}
 	}()
-	c.log.Infof("handler:New Message: %+v\n", string(data))
-
-	if err := json.Unmarshal(data, &m); err != nil {
-		c.log.Errorf("handler:json unmarshal: %+v\n", err.Error())
-		return
+	if c.codec.MessageType() == websocket.TextMessage {
+		c.log.Infof("handler:New Message: %+v\n", string(data))
 	}
 
-	switch m["t"] {
-	case "l":
-		if c.user != "" {
-			c.send <- resp("l", m["i"].(string), C_FAIL, "user is not empty")
-			return
+	head, f, ferr := decodeFrame(c.codec, data)
+	if ferr != nil {
+		c.log.Errorf("handler:decode frame: %v\n", ferr)
+		rt := head.T
+		if rt == "" {
+			rt = "e"
 		}
+		c.write(resp(rt, head.I, ferr.Code, ferr.Msg))
+		return
+	}
+	if c.user == "" && head.T != T_LOGIN {
+		c.write(resp(head.T, head.I, C_AUTH, "auth error"))
+		return
+	}
 
-		user := strings.TrimSpace(m["u"].(string))
-		clientid := strings.TrimSpace(m["m"].(string))
-		if user == "" || clientid == "" {
-			c.send <- resp("l", m["i"].(string), C_FAIL, "no user or clientid")
-			return
+	switch v := f.(type) {
+	case *LoginFrame:
+		n.login(c, v)
+	case *AckFrame:
+		r := n.ack(c, v)
+		if !c.legacy() {
+			c.write(r)
 		}
-		if !n.auth(c, user, clientid, m["tk"].(string), int64(m["ts"].(float64))) {
-			c.send <- resp("l", m["i"].(string), C_AUTH, "auth error")
-			return
+	case *TagFrame:
+		r := n.tag(c, v)
+		if c.legacy() {
+			r.Rt = legacyTagRt
 		}
-		c.user = user
-		c.clientid = clientid
+		c.write(r)
+	case *UpstreamFrame:
+		n.Upstream(c, v)
+	case *SendFrame:
+		n.Send(c, v)
+	case *ReplyFrame:
+		n.Reply(c, v)
+	}
+}
 
-		c.log = zap.S().With(
-			"cid", c.cid,
-			"user", c.user,
-			"clientid", c.clientid,
-		)
-		c.send <- resp("l", m["i"].(string), C_OK, c.clientid)
-		n.Register(c)
-		return
-	case "a":
-		if c.user == "" {
-			c.send <- resp("a", m["i"].(string), C_AUTH, "auth error")
-			return
-		}
+func (n *Node) ack(c *Client, f *AckFrame) *AckRespFrame {
+	dropped := n.Acker(ClientAck{
+		User:     c.user,
+		ClientID: c.clientid,
+		IDs:      f.ID,
+		Read:     f.K == AckRead,
+	})
+	if c.pending != nil {
+		c.pending.ack(f.ID)
+	}
+	return ackResp(f, dropped)
+}
 
-		n.Acker(ClientAck{
-			User: c.user,
-			IDs:  istoss(m["id"].([]interface{})),
-		})
-	case "t":
-		if c.user == "" {
-			c.send <- resp("a", m["i"].(string), C_AUTH, "auth error")
-			return
+func (n *Node) tag(c *Client, f *TagFrame) *TagRespFrame {
+	return tagResp(f, n.Tager(c, f.D, f.Dv))
+}
+
+func (n *Node) login(c *Client, f *LoginFrame) {
+	if since, ok := n.logon(c, f); ok {
+		n.Offline(c, since)
+	}
+}
+
+// logon 登录并回复, 返回发送离线消息的起始序号, 离线消息由调用方在发送循环开始后发送
+func (n *Node) logon(c *Client, f *LoginFrame) (*int64, bool) {
+	if c.user != "" {
+		c.write(resp(f.T, f.I, C_FAIL, "user is not empty"))
+		return nil, false
+	}
+	if f.V < ProtoVersionMin || f.V > ProtoVersionMax {
+		c.write(resp(f.T, f.I, C_VERSION, fmt.Sprintf("unsupported version %d, server supports %d-%d", f.V, ProtoVersionMin, ProtoVersionMax)))
+		return nil, false
+	}
+	if !n.auth(c, f.U, f.M, f.Tk, f.Ts) {
+		c.write(resp(f.T, f.I, C_AUTH, "auth error"))
+		return nil, false
+	}
+	c.user = f.U
+	c.clientid = f.M
+	c.platform = f.P
+	c.appVersion = f.Av
+	c.logined = time.Now()
+	// 注册后其他协程(例如踢下线)会使用 c.log
+	c.log = zap.S().With(
+		"cid", c.cid,
+		"user", c.user,
+		"clientid", c.clientid,
+	)
+	if !n.Register(c) {
+		c.user = ""
+		c.clientid = ""
+		c.write(resp(f.T, f.I, C_LIMIT, "device limit"))
+		return nil, false
+	}
+	atomic.AddInt64(&n.unauth, -1)
+
+	n.touchDevice(c)
+	c.version = f.V
+	c.caps = negotiate(c, f.Cs)
+	if f.Cs != nil && c.conn != nil {
+		// 声明了能力的客户端按协商结果决定是否压缩, 由 writePump 应用
+		compress := int32(0)
+		if contains(c.caps, CapCompress) {
+			compress = 1
 		}
-		n.Tager(c, m["d"].(map[string]interface{}))
-		c.send <- resp("a", m["i"].(string), C_OK, "")
-	default:
-		if c.user == "" {
-			c.send <- resp("a", m["i"].(string), C_AUTH, "auth error")
-			return
+		atomic.StoreInt32(&c.compress, compress)
+	}
+	if contains(c.caps, CapBatch) {
+		atomic.StoreInt32(&c.batch, 1)
+	}
+	r := &LoginRespFrame{
+		RespFrame: *resp(f.T, f.I, C_OK, c.clientid),
+		V:         c.version,
+		Sv:        Version,
+		Cs:        c.caps,
+		Sid:       c.sid,
+	}
+	if contains(c.caps, CapCodec) {
+		r.Cd = codecNames()
+	}
+	since := f.S
+	if contains(c.caps, CapResume) {
+		last, err := n.lastSeq(c.user)
+		if err != nil {
+			c.log.Error("db:last seq:", err)
 		}
-		c.log.Errorf("handler error: unknown type:%v\n", m["t"])
-		return
+		r.Ls = last
+		// 客户端序号超过服务端时视为服务端数据已重置, 重新发送全部未确认的消息
+		if since != nil && *since > last {
+			r.Rs = true
+			since = nil
+		}
+	} else {
+		since = nil
+	}
+	c.write(r)
+	if c.pending != nil {
+		go c.redeliverPump()
+	}
+	return since, true
+}
+
+// reserve 原子地占用一个未登录连接名额, 超过限制时回滚并返回原因
+func (n *Node) reserve() string {
+	conns := atomic.AddInt64(&n.conns, 1)
+	unauth := atomic.AddInt64(&n.unauth, 1)
+	reason := ""
+	if max := DefConfig.Limit.MaxConnections; max > 0 && conns > max {
+		reason = "too many connections"
+	} else if max := DefConfig.Limit.MaxUnauth; max > 0 && unauth > max {
+		reason = "too many unauthenticated connections"
+	}
+	if reason != "" {
+		n.release()
 	}
+	return reason
+}
+
+// release 归还 reserve 占用但未创建客户端的名额
+func (n *Node) release() {
+	atomic.AddInt64(&n.conns, -1)
+	atomic.AddInt64(&n.unauth, -1)
+}
+
+// admit 占用连接名额, 超过限制时返回 503
+func (n *Node) admit(w http.ResponseWriter) bool {
+	if reason := n.reserve(); reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// newClient 创建未登录的客户端, 使用 admit 或 reserve 占用的名额
+func (n *Node) newClient(transport string, codec Codec) *Client {
+	cid := int(atomic.AddInt64(&n.id, 1))
+	c := &Client{
+		cid:       cid,
+		node:      n,
+		transport: transport,
+		codec:     codec,
+		send:      newLanes(5),
+		done:      make(chan struct{}),
+		connected: time.Now(),
+		log:       zap.S().With("cid", cid),
+	}
+	if cfg := DefConfig.Redelivery; cfg.Enable {
+		c.pending = newPending(cfg)
+	}
+	return c
 }
 
 // serveWs handles websocket requests from the peer.
 func (n *Node) serveWs(node *Node, w http.ResponseWriter, r *http.Request) {
+	if !n.admit(w) {
+		return
+	}
 	conn, err := n.upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		n.release()
 		log.Println(err)
 		return
 	}
-	n.id++
-	client := &Client{
-		cid:  n.id,
-		node: node,
-		conn: conn,
-		send: make(chan []byte, 5),
-		log:  zap.S().With("cid", n.id),
-	}
+	client := n.newClient(TransportWS, getCodec(conn.Subprotocol()))
+	client.conn = conn
 	if DefConfig.Client.Compression {
-		client.conn.EnableWriteCompression(true)
+		client.compress = 1
 		client.conn.SetCompressionLevel(DefConfig.Client.CompressionLevel)
 	}
 	client.conn.SetCloseHandler(func(code int, text string) error {
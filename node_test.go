@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// withLimit 临时修改连接数限制, 只改这两项, 避免和仍在运行的连接读到的配置冲突
+func withLimit(t *testing.T, conns, unauth int64) {
+	l := &DefConfig.Limit
+	oc, ou := l.MaxConnections, l.MaxUnauth
+	l.MaxConnections, l.MaxUnauth = conns, unauth
+	t.Cleanup(func() { l.MaxConnections, l.MaxUnauth = oc, ou })
+}
+
+func TestReserveLimit(t *testing.T) {
+	withLimit(t, 5, 0)
+	tn := newTestNode(t)
+
+	var ok int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tn.reserve() == "" {
+				atomic.AddInt64(&ok, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if ok != 5 || atomic.LoadInt64(&tn.conns) != 5 || atomic.LoadInt64(&tn.unauth) != 5 {
+		t.Fatalf("admitted %d, conns %d, unauth %d", ok, tn.conns, tn.unauth)
+	}
+	tn.release()
+	if reason := tn.reserve(); reason != "" {
+		t.Fatalf("reserve after release: %s", reason)
+	}
+	for i := 0; i < 5; i++ {
+		tn.release()
+	}
+}
+
+func TestAdmitUnauthLimit(t *testing.T) {
+	withLimit(t, 0, 1)
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	// 登录后不再占用未登录名额
+	idle := dial(t, tn, "u2", "m1")
+	if _, resp, err := websocket.DefaultDialer.Dial(tn.wsURL(), nil); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("third connection admitted: %v", err)
+	}
+	idle.conn.Close()
+	waitFor(t, func() bool { return atomic.LoadInt64(&tn.unauth) == 0 })
+	dial(t, tn, "u2", "m2")
+	c.close(tn)
+}
+
+func TestLegacyAckTagReply(t *testing.T) {
+	tn := newTestNode(t)
+
+	old := dial(t, tn, "u1", "m1")
+	if r := old.login(map[string]interface{}{"v": 1}); r.C != 0 {
+		t.Fatalf("login v1: %+v", r)
+	}
+	tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	ms := old.messages(1)
+	// 版本 1 的 ack 没有回复, tag 回复的 rt 为 a
+	old.send(map[string]interface{}{"t": T_ACK, "id": ids(ms)})
+	if r := old.call(map[string]interface{}{"t": T_TAG, "d": map[string]bool{"a": true}}); r.Rt != legacyTagRt || r.C != 0 {
+		t.Fatalf("v1 tag reply: %+v", r)
+	}
+	old.silent(200 * time.Millisecond)
+
+	c := connect(t, tn, "u2", "m1")
+	if r := c.call(map[string]interface{}{"t": T_ACK, "id": []string{"x"}}); r.Rt != T_ACK {
+		t.Fatalf("v2 ack reply: %+v", r)
+	}
+	if r := c.call(map[string]interface{}{"t": T_TAG, "d": map[string]bool{"a": true}}); r.Rt != T_TAG {
+		t.Fatalf("v2 tag reply: %+v", r)
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	DefConfig.Client.Compression = true
+	t.Cleanup(func() { DefConfig.Client.Compression = false })
+	tn := newTestNode(t)
+
+	on := dial(t, tn, "u1", "m1")
+	if r := on.login(map[string]interface{}{"cs": []string{CapCompress}}); r.C != 0 || !contains(r.Cs, CapCompress) {
+		t.Fatalf("login: %+v", r)
+	}
+	off := dial(t, tn, "u1", "m2")
+	if r := off.login(map[string]interface{}{"cs": []string{}}); r.C != 0 || contains(r.Cs, CapCompress) {
+		t.Fatalf("login: %+v", r)
+	}
+	cs := map[string]int32{}
+	for _, c := range tn.userClients("u1") {
+		cs[c.clientid] = atomic.LoadInt32(&c.compress)
+	}
+	if cs["m1"] != 1 || cs["m2"] != 0 {
+		t.Fatalf("compress %v", cs)
+	}
+	// 登录后写压缩的切换在 writePump 中进行, 与推送并发时不会出错
+	for i := 0; i < 20; i++ {
+		tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: strings.Repeat("x", 100)})
+	}
+	on.messages(20)
+	off.messages(20)
+}
+
+// withDevices 临时修改每个用户的设备数限制, 需在创建节点前调用
+func withDevices(t *testing.T, max int, policy string) {
+	l := &DefConfig.Limit
+	om, op := l.MaxDevices, l.DevicePolicy
+	l.MaxDevices, l.DevicePolicy = max, policy
+	t.Cleanup(func() { l.MaxDevices, l.DevicePolicy = om, op })
+}
+
+func TestDeviceLimitEvict(t *testing.T) {
+	withDevices(t, 2, DevicePolicyEvict)
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	connect(t, tn, "u1", "m2")
+	connect(t, tn, "u1", "m3")
+	// 踢掉最早登录的设备
+	if code := a.closed(); code != websocket.ClosePolicyViolation {
+		t.Fatalf("oldest device: close code %d", code)
+	}
+	connect(t, tn, "u2", "m1")
+}
+
+func TestDeviceLimitReject(t *testing.T) {
+	withDevices(t, 1, DevicePolicyReject)
+	tn := newTestNode(t)
+
+	connect(t, tn, "u1", "m1")
+	if r := dial(t, tn, "u1", "m2").login(nil); r.C != codeInt(C_LIMIT) {
+		t.Fatalf("second device: %+v", r)
+	}
+	// 相同 clientid 视为重连, 不受限制
+	connect(t, tn, "u1", "m1")
+}
+
+func TestLoginVersion(t *testing.T) {
+	tn := newTestNode(t)
+
+	if r := dial(t, tn, "u1", "m1").login(map[string]interface{}{"v": ProtoVersionMax + 1}); r.C != codeInt(C_VERSION) {
+		t.Fatalf("unsupported version: %+v", r)
+	}
+	// 不带版本视为版本 1
+	if r := dial(t, tn, "u1", "m1").login(map[string]interface{}{"v": 0}); r.C != 0 || r.V != ProtoVersionMin {
+		t.Fatalf("no version: %+v", r)
+	}
+	r := dial(t, tn, "u1", "m2").login(map[string]interface{}{"cs": []string{CapResume, "unknown", CapResume}})
+	if r.C != 0 || r.V != ProtoVersionMax || len(r.Cs) != 1 || r.Cs[0] != CapResume {
+		t.Fatalf("caps: %+v", r)
+	}
+}
+
+func TestFrameValidation(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := dial(t, tn, "u1", "m1")
+	if r := c.call(map[string]interface{}{"t": T_TAG, "i": "1", "d": map[string]bool{"a": true}}); r.C != codeInt(C_AUTH) {
+		t.Fatalf("before login: %+v", r)
+	}
+	if r := c.call(map[string]interface{}{"t": T_LOGIN, "i": "2", "u": "u1"}); r.C != codeInt(C_PARAM) || r.Rt != T_LOGIN {
+		t.Fatalf("missing fields: %+v", r)
+	}
+	if r := c.call(map[string]interface{}{"t": "x", "i": "3"}); r.C != codeInt(C_TYPE) {
+		t.Fatalf("unknown type: %+v", r)
+	}
+	c.conn.WriteMessage(websocket.TextMessage, []byte("{"))
+	if r := c.next(); r.T != T_RESP || r.Rt != "e" || r.C != codeInt(C_FORMAT) {
+		t.Fatalf("invalid json: %+v", r)
+	}
+	if r := c.login(nil); r.C != 0 {
+		t.Fatalf("login: %+v", r)
+	}
+	if r := c.call(map[string]interface{}{"t": T_ACK, "i": "4"}); r.C != codeInt(C_PARAM) {
+		t.Fatalf("ack without ids: %+v", r)
+	}
+}
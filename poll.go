@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 长轮询: GET /poll 第一次带登录参数, 之后带 sid 和上次返回的游标 c.
+// 带上上次的游标即确认上次返回的消息, 游标不同时重新返回上次的消息.
+
+const (
+	pollMaxWait       = 60
+	pollSweepInterval = 10 * time.Second
+)
+
+func (p PollConfig) wait() int {
+	if p.Wait <= 0 {
+		return 25
+	}
+	return p.Wait
+}
+
+func (p PollConfig) ttl() time.Duration {
+	if p.SessionTTL <= 0 {
+		return 90 * time.Second
+	}
+	return time.Duration(p.SessionTTL) * time.Second
+}
+
+func (p PollConfig) buffer() int {
+	if p.Buffer <= 0 {
+		return 100
+	}
+	return p.Buffer
+}
+
+func (p PollConfig) maxBatch() int {
+	if p.MaxBatch <= 0 {
+		return 100
+	}
+	return p.MaxBatch
+}
+
+// PollResp 一次轮询的结果
+type PollResp struct {
+	Sid string `json:"sid"`
+	// 游标, 下次轮询时带上即确认本次的消息, 没有需要确认的消息时为空
+	C  string        `json:"c"`
+	Ms []PushMessage `json:"ms"`
+	// 其他帧, 例如回复、请求和关闭
+	Fs []interface{} `json:"fs,omitempty"`
+}
+
+type pollState struct {
+	// 同一个会话的轮询依次处理
+	mu sync.Mutex
+	// 最后一次轮询的时间, unix 纳秒
+	last int64
+	// 正在处理的轮询数
+	polling int32
+	// 缓存满丢弃过帧
+	dropped int32
+
+	seq int64
+	// 上次返回的结果和需要确认的消息
+	resp *PollResp
+	ids  []string
+}
+
+func (p *pollState) touch() {
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+}
+
+func (n *Node) servePoll(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	c := n.session(r)
+	wait := DefConfig.Poll.wait()
+	if c == nil {
+		if q.Get("sid") != "" {
+			httpFrame(w, http.StatusUnauthorized, resp(T_LOGIN, "", C_AUTH, "session not found"))
+			return
+		}
+		if !n.admit(w) {
+			return
+		}
+		c = n.newClient(TransportPoll, jsonCodec{})
+		c.send = newLanes(DefConfig.Poll.buffer())
+		// 游标即确认, 不需要重发
+		c.pending = nil
+		c.poll = &pollState{}
+		c.poll.touch()
+		since, ok := n.httpLogin(w, c, httpLoginFrame(r))
+		if !ok {
+			return
+		}
+		// 轮询的发送队列不阻塞, 离线消息直接进入缓存
+		n.Offline(c, since)
+		// 登录时立即返回登录结果和离线消息
+		wait = 0
+	} else if v, err := strconv.Atoi(q.Get("w")); err == nil && v >= 0 {
+		wait = v
+	}
+	if wait > pollMaxWait {
+		wait = pollMaxWait
+	}
+
+	p := c.poll
+	if p == nil {
+		httpFrame(w, http.StatusBadRequest, resp(T_LOGIN, "", C_FAIL, "not a poll session"))
+		return
+	}
+	atomic.AddInt32(&p.polling, 1)
+	defer atomic.AddInt32(&p.polling, -1)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.touch()
+	defer p.touch()
+
+	if p.resp != nil {
+		if cursor := q.Get("c"); cursor != p.resp.C {
+			// 客户端没有收到上次的结果
+			httpFrame(w, http.StatusOK, p.resp)
+			return
+		}
+		n.Acker(ClientAck{User: c.user, ClientID: c.clientid, IDs: p.ids})
+		p.resp, p.ids = nil, nil
+	}
+	if atomic.CompareAndSwapInt32(&p.dropped, 1, 0) {
+		// 缓存中的消息也未确认, 先清掉再从数据库补发, 避免重复
+		c.dropMessages()
+		n.Offline(c, nil)
+	}
+
+	pr := &PollResp{Sid: c.sid, Ms: []PushMessage{}}
+	ids := []string{}
+	add := func(frame interface{}) {
+		if m, ok := frame.(*PushMessageClient); ok {
+			pr.Ms = append(pr.Ms, m.Ms...)
+			for _, v := range m.Ms {
+				if !v.Ep {
+					ids = append(ids, v.ID)
+				}
+			}
+			return
+		}
+		pr.Fs = append(pr.Fs, frame)
+	}
+	timer := time.NewTimer(time.Duration(wait) * time.Second)
+	defer timer.Stop()
+	frame, rv := c.recv(timer.C, r.Context().Done())
+	for rv == recvFrame {
+		add(frame)
+		if len(pr.Ms) >= DefConfig.Poll.maxBatch() {
+			break
+		}
+		var ok bool
+		if frame, ok = c.next(); !ok {
+			break
+		}
+	}
+	select {
+	case <-c.done:
+		// 会话被关闭, 返回剩下的帧, 包括 close 帧
+		for {
+			frame, ok := c.next()
+			if !ok {
+				break
+			}
+			add(frame)
+		}
+		n.UnRegister(c)
+	default:
+	}
+
+	if len(ids) > 0 {
+		p.seq++
+		pr.C = strconv.FormatInt(p.seq, 10)
+		p.resp, p.ids = pr, ids
+	}
+	httpFrame(w, http.StatusOK, pr)
+}
+
+// dropMessages 清掉缓存中需要确认的消息, 保留临时消息和回复、请求等其他帧
+func (c *Client) dropMessages() {
+	for i := range c.send {
+		keep := []interface{}{}
+	drain:
+		for {
+			select {
+			case frame := <-c.send[i]:
+				p, ok := frame.(*PushMessageClient)
+				if !ok {
+					keep = append(keep, frame)
+					continue
+				}
+				ms := []PushMessage{}
+				for _, m := range p.Ms {
+					if m.Ep {
+						ms = append(ms, m)
+					}
+				}
+				if len(ms) > 0 {
+					keep = append(keep, &PushMessageClient{T: p.T, Ms: ms})
+				}
+			default:
+				break drain
+			}
+		}
+		for _, frame := range keep {
+			select {
+			case c.send[i] <- frame:
+			default:
+			}
+		}
+	}
+}
+
+// pollSweeper 注销超过时间没有轮询的会话
+func (n *Node) pollSweeper() {
+	ticker := time.NewTicker(pollSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+		deadline := time.Now().Add(-DefConfig.Poll.ttl()).UnixNano()
+		n.sessions.Range(func(k, v interface{}) bool {
+			c := v.(*Client)
+			if c.poll != nil && atomic.LoadInt32(&c.poll.polling) == 0 && atomic.LoadInt64(&c.poll.last) < deadline {
+				c.log.Info("poll session expired")
+				n.UnRegister(c)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pollClient 测试用的轮询客户端
+type pollClient struct {
+	t   *testing.T
+	tn  *testNode
+	sid string
+	c   string
+}
+
+// pollGet 发起一次轮询, 返回状态码和结果
+func pollGet(t *testing.T, tn *testNode, q url.Values) (int, PollResp) {
+	t.Helper()
+	client := &http.Client{Timeout: waitTimeout}
+	r, err := client.Get(tn.srv.URL + "/poll?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	pr := PollResp{}
+	json.NewDecoder(r.Body).Decode(&pr)
+	return r.StatusCode, pr
+}
+
+func pollConnect(t *testing.T, tn *testNode, user, m string) (*pollClient, PollResp) {
+	t.Helper()
+	ts := fmt.Sprint(time.Now().Unix())
+	status, pr := pollGet(t, tn, url.Values{
+		"u":  {user},
+		"m":  {m},
+		"ts": {ts},
+		"tk": {SignMD5(DefConfig.Secret, user+m, ts)},
+		"v":  {fmt.Sprint(ProtoVersionMax)},
+	})
+	if status != http.StatusOK || pr.Sid == "" {
+		t.Fatalf("poll %s/%s login: status %d %+v", user, m, status, pr)
+	}
+	// 会话在两次轮询之间保留, 测试结束时注销
+	t.Cleanup(func() {
+		if v, ok := tn.sessions.Load(pr.Sid); ok {
+			tn.UnRegister(v.(*Client))
+		}
+	})
+	return &pollClient{t: t, tn: tn, sid: pr.Sid, c: pr.C}, pr
+}
+
+// poll 带上游标轮询, 等待 w 秒
+func (c *pollClient) poll(cursor string, w int) PollResp {
+	c.t.Helper()
+	status, pr := pollGet(c.t, c.tn, url.Values{"sid": {c.sid}, "c": {cursor}, "w": {fmt.Sprint(w)}})
+	if status != http.StatusOK {
+		c.t.Fatalf("poll: status %d", status)
+	}
+	c.c = pr.C
+	return pr
+}
+
+// TestPollOffline 登录返回离线消息, 游标确认后不再返回
+func TestPollOffline(t *testing.T) {
+	tn := newTestNode(t)
+
+	sent := []string{}
+	for i := 0; i < 3; i++ {
+		sent = append(sent, tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: fmt.Sprint(i)}))
+	}
+	c, pr := pollConnect(t, tn, "u1", "m1")
+	if len(pr.Ms) != len(sent) || pr.C == "" {
+		t.Fatalf("login: expect %d messages with cursor, got %+v", len(sent), pr)
+	}
+
+	// 没有带上游标时重新返回上次的结果
+	if again := c.poll("", 0); again.C != pr.C || len(again.Ms) != len(sent) {
+		t.Fatalf("poll without cursor: %+v", again)
+	}
+	if userAcked(t, tn, "u1", sent[0]) {
+		t.Fatal("message acked before cursor")
+	}
+	if next := c.poll(pr.C, 0); len(next.Ms) != 0 || next.C != "" {
+		t.Fatalf("poll with cursor: %+v", next)
+	}
+	for _, id := range sent {
+		if !userAcked(t, tn, "u1", id) {
+			t.Fatalf("message %s not acked", id)
+		}
+	}
+}
+
+// TestPollWait 长轮询等到推送的消息
+func TestPollWait(t *testing.T) {
+	tn := newTestNode(t)
+
+	c, _ := pollConnect(t, tn, "u1", "m1")
+	id := fmt.Sprintf("msg%d", atomic.AddInt64(&testMessageSeq, 1))
+	go func() {
+		// 等轮询进入等待
+		time.Sleep(100 * time.Millisecond)
+		tn.publish(AdminPushMessage{MessageID: id, UserIDs: []string{"u1"}, Data: "x"})
+	}()
+	if pr := c.poll("", 5); len(pr.Ms) != 1 || pr.Ms[0].ID != id || pr.C == "" {
+		t.Fatalf("expect message %s, got %+v", id, pr)
+	}
+
+	status, _ := pollGet(t, tn, url.Values{"sid": {"none"}})
+	if status != http.StatusUnauthorized {
+		t.Fatalf("unknown session: status %d", status)
+	}
+}
+
+// TestPollDropped 缓存满后从数据库补发, 缓存中的消息不重复返回
+func TestPollDropped(t *testing.T) {
+	old := DefConfig.Poll
+	DefConfig.Poll.Buffer = 2
+	t.Cleanup(func() { DefConfig.Poll = old })
+	tn := newTestNode(t)
+
+	c, _ := pollConnect(t, tn, "u1", "m1")
+	sent := []string{}
+	for i := 0; i < 4; i++ {
+		sent = append(sent, tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: fmt.Sprint(i)}))
+	}
+	pr := c.poll("", 0)
+	if got := ids(pr.Ms); !reflect.DeepEqual(got, sent) {
+		t.Fatalf("poll after dropped: %v, want %v", got, sent)
+	}
+	if next := c.poll(pr.C, 0); len(next.Ms) != 0 {
+		t.Fatalf("poll after ack: %+v", next)
+	}
+}
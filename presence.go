@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	// queryOnline 查询用户在线的设备
+	queryOnline = "online"
+	// queryKick 踢掉用户的设备
+	queryKick = "kick"
+)
+
+// clusterQueryWait 等待其他节点回复的时间
+const clusterQueryWait = 500 * time.Millisecond
+
+// OnlineDevice 在线的设备
+type OnlineDevice struct {
+	ClientID   string    `json:"m"`
+	Node       string    `json:"node"`
+	Transport  string    `json:"transport"`
+	Platform   string    `json:"p,omitempty"`
+	AppVersion string    `json:"av,omitempty"`
+	LoginAt    time.Time `json:"login_at"`
+}
+
+// ClusterQuery 集群内查询或踢掉用户的设备, 每个节点回复本节点的结果
+type ClusterQuery struct {
+	ID   string
+	Kind string
+	User string
+	// 为空时为用户的所有设备
+	ClientID string
+	// 发起查询的节点
+	Node string
+}
+
+// ClusterAnswer 节点对查询的回复
+type ClusterAnswer struct {
+	ID string
+	// 发起查询的节点, 只有它处理回复
+	To string
+	// 回复的节点
+	Node    string
+	Devices []OnlineDevice
+}
+
+// Online 查询用户在集群内在线的设备
+func (n *Node) Online(ctx context.Context, user string) ([]OnlineDevice, error) {
+	return n.query(ctx, ClusterQuery{Kind: queryOnline, User: user})
+}
+
+// Kick 踢掉用户的设备, clientid 为空时踢掉所有设备, 返回被踢掉的设备
+func (n *Node) Kick(ctx context.Context, user, clientid string) ([]OnlineDevice, error) {
+	return n.query(ctx, ClusterQuery{Kind: queryKick, User: user, ClientID: clientid})
+}
+
+// query 在本节点执行查询, 开启集群时汇总其他节点在 clusterQueryWait 内的回复
+func (n *Node) query(ctx context.Context, q ClusterQuery) ([]OnlineDevice, error) {
+	log := zap.S().With("method", "query", "kind", q.Kind, "user", q.User)
+	ds := n.answer(q)
+	if n.cluster != nil {
+		q.ID = rpcID()
+		q.Node = n.name
+		ch := make(chan *ClusterAnswer, 16)
+		n.queries.Store(q.ID, ch)
+		defer n.queries.Delete(q.ID)
+
+		if err := n.broadcast(ctx, ClusterMessage{Query: &q}); err != nil {
+			return nil, err
+		}
+		t := time.NewTimer(clusterQueryWait)
+		defer t.Stop()
+	wait:
+		for {
+			select {
+			case a := <-ch:
+				log.Info("answer:", a.Node, len(a.Devices))
+				ds = append(ds, a.Devices...)
+			case <-t.C:
+				break wait
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i].LoginAt.Before(ds[j].LoginAt) })
+	return ds, nil
+}
+
+// answer 在本节点执行查询
+func (n *Node) answer(q ClusterQuery) []OnlineDevice {
+	ds := []OnlineDevice{}
+	for _, c := range n.userClients(q.User) {
+		if q.ClientID != "" && c.clientid != q.ClientID {
+			continue
+		}
+		ds = append(ds, OnlineDevice{
+			ClientID:   c.clientid,
+			Node:       n.name,
+			Transport:  c.transport,
+			Platform:   c.platform,
+			AppVersion: c.appVersion,
+			LoginAt:    c.logined,
+		})
+		if q.Kind == queryKick {
+			c.kick(websocket.ClosePolicyViolation, "kicked")
+		}
+	}
+	return ds
+}
+
+// answerCluster 回复其他节点的查询
+func (n *Node) answerCluster(q ClusterQuery) {
+	log := zap.S().With("method", "answerCluster", "kind", q.Kind, "user", q.User)
+	err := n.broadcast(context.Background(), ClusterMessage{
+		Answer: &ClusterAnswer{ID: q.ID, To: q.Node, Node: n.name, Devices: n.answer(q)},
+	})
+	if err != nil {
+		log.Error("cluster:", err)
+	}
+}
+
+// gather 把其他节点的回复交给本节点等待中的查询
+func (n *Node) gather(a *ClusterAnswer) {
+	v, ok := n.queries.Load(a.ID)
+	if !ok {
+		return
+	}
+	select {
+	case v.(chan *ClusterAnswer) <- a:
+	default:
+	}
+}
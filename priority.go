@@ -0,0 +1,40 @@
+package main
+
+// 消息优先级, 高优先级的消息在客户端发送队列中优先发送
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// lanes 每个客户端的发送队列数, 下标为 priority - PriorityLow
+const lanes = PriorityHigh - PriorityLow + 1
+
+func validPriority(pr int) bool {
+	return pr >= PriorityLow && pr <= PriorityHigh
+}
+
+// laneOf 消息帧按其中最高的优先级入队, 其他帧(回复等)走高优先级队列
+func laneOf(frame interface{}) int {
+	pr := PriorityHigh
+	if p, ok := frame.(*PushMessageClient); ok {
+		pr = PriorityLow
+		for _, m := range p.Ms {
+			if m.Pr > pr {
+				pr = m.Pr
+			}
+		}
+	}
+	if !validPriority(pr) {
+		pr = PriorityNormal
+	}
+	return pr - PriorityLow
+}
+
+func newLanes(size int) [lanes]chan interface{} {
+	var send [lanes]chan interface{}
+	for i := range send {
+		send[i] = make(chan interface{}, size)
+	}
+	return send
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nzlov/sw/swadmin"
+)
+
+// TestPriorityOfflineOrder 离线补发按优先级从高到低, 同优先级按序号
+func TestPriorityOfflineOrder(t *testing.T) {
+	tn := newTestNode(t)
+
+	byPriority := map[int][]string{}
+	for _, pr := range []int{0, -1, 1, 0, 1, -1} {
+		byPriority[pr] = append(byPriority[pr], tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x", Priority: pr}))
+	}
+	want := append(append(byPriority[1], byPriority[0]...), byPriority[-1]...)
+	ms := connect(t, tn, "u1", "m1").messages(len(want))
+	if got := ids(ms); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay %v, want %v", got, want)
+	}
+	for _, m := range ms[:2] {
+		if m.Pr != 1 {
+			t.Fatalf("priority: %+v", m)
+		}
+	}
+}
+
+func TestPriorityValidation(t *testing.T) {
+	tn := newTestNode(t)
+
+	_, err := adminClient(t, tn).Push(contextTimeout(t), swadmin.PushRequest{UserIDs: []string{"u1"}, Data: "x", Priority: 2})
+	if !swadmin.IsCode(err, swadmin.CodeFail) {
+		t.Fatalf("priority 2: %v", err)
+	}
+}
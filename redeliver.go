@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// delay 第 attempts 次发送后到下次重发的等待时间
+func (r RedeliveryConfig) delay(attempts int) time.Duration {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = 10
+	}
+	backoff := r.Backoff
+	if backoff < 1 {
+		backoff = 1
+	}
+	d := float64(interval) * math.Pow(backoff, float64(attempts-1))
+	if r.MaxInterval > 0 && d > float64(r.MaxInterval) {
+		d = float64(r.MaxInterval)
+	}
+	return time.Duration(d * float64(time.Second))
+}
+
+type pendingMessage struct {
+	m        PushMessage
+	attempts int
+	next     time.Time
+}
+
+// pending 已发送到连接但未确认的消息, 使用连接建立时的配置
+type pending struct {
+	cfg RedeliveryConfig
+
+	mu sync.Mutex
+	ms map[string]*pendingMessage
+}
+
+func newPending(cfg RedeliveryConfig) *pending {
+	return &pending{cfg: cfg, ms: map[string]*pendingMessage{}}
+}
+
+// add 记录已发送的消息, 重复发送的消息不重置重发次数
+func (p *pending) add(ms []PushMessage) {
+	now := time.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, m := range ms {
+		if _, ok := p.ms[m.ID]; ok {
+			continue
+		}
+		p.ms[m.ID] = &pendingMessage{
+			m:        m,
+			attempts: 1,
+			next:     now.Add(p.cfg.delay(1)),
+		}
+	}
+}
+
+func (p *pending) ack(ids []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, id := range ids {
+		delete(p.ms, id)
+	}
+}
+
+// due 返回需要重发的消息, 超过最多重发次数的消息被丢弃
+func (p *pending) due(now time.Time) (resend []PushMessage, dropped []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, pm := range p.ms {
+		if now.Before(pm.next) {
+			continue
+		}
+		if max := p.cfg.MaxAttempts; max > 0 && pm.attempts > max {
+			delete(p.ms, id)
+			dropped = append(dropped, id)
+			continue
+		}
+		pm.attempts++
+		pm.next = now.Add(p.cfg.delay(pm.attempts))
+		resend = append(resend, pm.m)
+	}
+	return
+}
+
+// redeliverPump 定时重发未确认的消息, 连接关闭时退出
+func (c *Client) redeliverPump() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			resend, dropped := c.pending.due(now)
+			if len(dropped) > 0 {
+				c.log.Info("redeliver:give up:", dropped)
+				if c.mqtt != nil {
+					c.mqtt.releaseIDs(dropped)
+				}
+			}
+			if len(resend) == 0 {
+				continue
+			}
+			c.log.Info("redeliver:", len(resend))
+			if !c.write(&PushMessageClient{T: "m", Ms: resend}) {
+				return
+			}
+		}
+	}
+}
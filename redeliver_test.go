@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRedeliveryDelay(t *testing.T) {
+	r := RedeliveryConfig{Interval: 2, Backoff: 2, MaxInterval: 5}
+	for i, want := range []time.Duration{2, 4, 5, 5} {
+		if d := r.delay(i + 1); d != want*time.Second {
+			t.Fatalf("delay(%d) = %v, want %v", i+1, d, want*time.Second)
+		}
+	}
+	if d := (RedeliveryConfig{}).delay(3); d != 10*time.Second {
+		t.Fatalf("default delay: %v", d)
+	}
+}
+
+// TestRedelivery 重发未确认的消息, 超过最多重发次数后放弃
+func TestRedelivery(t *testing.T) {
+	old := DefConfig.Redelivery
+	DefConfig.Redelivery = RedeliveryConfig{Enable: true, Interval: 1, MaxAttempts: 1}
+	t.Cleanup(func() { DefConfig.Redelivery = old })
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	id1 := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "1"})
+	id2 := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "2"})
+	c.messages(2)
+	c.ack(id2)
+	// 只重发未确认的消息
+	if ms := c.messages(1); ms[0].ID != id1 {
+		t.Fatalf("redeliver: %+v", ms)
+	}
+	c.silent(2500 * time.Millisecond)
+	if userAcked(t, tn, "u1", id1) {
+		t.Fatal("message acked without ack")
+	}
+}
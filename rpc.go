@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 服务端发给客户端的请求
+const T_REQUEST = "q"
+
+const (
+	// rpcDefaultTimeout 默认等待回复的时间, 秒
+	rpcDefaultTimeout = 10
+	// rpcMaxTimeout 最长等待回复的时间, 秒
+	rpcMaxTimeout = 60
+)
+
+var (
+	errRPCOffline = errors.New("client is offline")
+	rpcSeq        int64
+)
+
+// RequestFrame 服务端发给客户端的请求, 客户端用相同的 i 回复 p 帧
+type RequestFrame struct {
+	T string `json:"t" proto:"1"`
+	I string `json:"i" proto:"2"`
+	// 请求类型, 由业务方定义
+	K string `json:"k,omitempty" proto:"3"`
+	D string `json:"d,omitempty" proto:"4"`
+}
+
+// RPCRequest 发给客户端的请求, 集群内转发
+type RPCRequest struct {
+	ID       string
+	User     string
+	ClientID string
+	Kind     string
+	Data     string
+	// 发起请求的节点
+	Node    string
+	Timeout time.Duration
+}
+
+// RPCReply 客户端的回复, 集群内转发给发起请求的节点
+type RPCReply struct {
+	ID   string
+	Node string
+	C    int
+	D    string
+	M    string
+}
+
+// rpcCall 已发给本节点客户端的请求
+type rpcCall struct {
+	c    *Client
+	node string
+}
+
+func rpcID() string {
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatInt(atomic.AddInt64(&rpcSeq, 1), 36)
+}
+
+// RPC 发送请求给在线的客户端, 等待客户端的回复.
+// 客户端在其他节点时通过集群转发, 找不到客户端时只能等到超时
+func (n *Node) RPC(ctx context.Context, req RPCRequest) (*RPCReply, error) {
+	log := zap.S().With("method", "rpc", "user", req.User, "clientid", req.ClientID)
+	req.ID = rpcID()
+	req.Node = n.name
+	if d, ok := ctx.Deadline(); ok {
+		req.Timeout = time.Until(d)
+	}
+	ch := make(chan *RPCReply, 1)
+	n.rpcs.Store(req.ID, ch)
+	defer n.rpcs.Delete(req.ID)
+
+	if !n.request(req) {
+		if n.cluster == nil {
+			return nil, errRPCOffline
+		}
+		if err := n.broadcast(ctx, ClusterMessage{RPC: &req}); err != nil {
+			return nil, err
+		}
+		log.Info("forward:", req.ID)
+	}
+	select {
+	case r := <-ch:
+		return r, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// request 发送请求给本节点的客户端
+func (n *Node) request(req RPCRequest) bool {
+	for _, c := range n.userClients(req.User) {
+		if c.clientid != req.ClientID {
+			continue
+		}
+		n.rpcOut.Store(req.ID, &rpcCall{c: c, node: req.Node})
+		if !c.write(&RequestFrame{T: T_REQUEST, I: req.ID, K: req.Kind, D: req.Data}) {
+			n.rpcOut.Delete(req.ID)
+			return false
+		}
+		timeout := req.Timeout
+		if timeout <= 0 {
+			timeout = rpcMaxTimeout * time.Second
+		}
+		time.AfterFunc(timeout, func() { n.rpcOut.Delete(req.ID) })
+		return true
+	}
+	return false
+}
+
+// Reply 处理客户端的回复, 只接受发给该客户端的请求的回复
+func (n *Node) Reply(c *Client, f *ReplyFrame) {
+	v, ok := n.rpcOut.Load(f.I)
+	if !ok || v.(*rpcCall).c != c {
+		c.log.Info("reply: unknown request:", f.I)
+		return
+	}
+	n.rpcOut.Delete(f.I)
+	call := v.(*rpcCall)
+	r := &RPCReply{ID: f.I, Node: call.node, C: f.C, D: f.D, M: f.M}
+	if n.reply(r) || n.cluster == nil {
+		return
+	}
+	if err := n.broadcast(context.Background(), ClusterMessage{Reply: r}); err != nil {
+		c.log.Error("reply cluster:", err)
+	}
+}
+
+// reply 把回复交给本节点等待中的请求
+func (n *Node) reply(r *RPCReply) bool {
+	v, ok := n.rpcs.Load(r.ID)
+	if !ok {
+		return false
+	}
+	select {
+	case v.(chan *RPCReply) <- r:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// answer 等待服务端的请求并回复 d
+func (c *fakeClient) answer(kind, d string) {
+	c.t.Helper()
+	f := c.next()
+	if f.T != T_REQUEST || f.K != kind {
+		c.t.Fatalf("%s/%s: expect request %s, got %+v", c.user, c.m, kind, f)
+	}
+	c.send(map[string]interface{}{"t": T_REPLY, "i": f.I, "c": 0, "d": d + ":" + f.D})
+}
+
+func TestRPC(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	go c.answer("ping", "pong")
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	r, err := tn.RPC(ctx, RPCRequest{User: "u1", ClientID: "m1", Kind: "ping", Data: "1"})
+	if err != nil || r.C != 0 || r.D != "pong:1" {
+		t.Fatalf("rpc: %+v %v", r, err)
+	}
+	if _, err := tn.RPC(ctx, RPCRequest{User: "u1", ClientID: "m2", Kind: "ping"}); err != errRPCOffline {
+		t.Fatalf("offline: %v", err)
+	}
+}
+
+func TestRPCCrossNode(t *testing.T) {
+	ns := newTestCluster(t, 2)
+
+	c := connect(t, ns[1], "u1", "m1")
+	go c.answer("ping", "pong")
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	r, err := ns[0].RPC(ctx, RPCRequest{User: "u1", ClientID: "m1", Kind: "ping", Data: "1"})
+	if err != nil || r.D != "pong:1" {
+		t.Fatalf("rpc: %+v %v", r, err)
+	}
+}
+
+// TestClusterRPCStuckClient 发送队列满的客户端不会卡住集群消息
+func TestClusterRPCStuckClient(t *testing.T) {
+	ns := newTestCluster(t, 2)
+
+	// 没有 writePump 的客户端, 填满发送队列
+	ns[1].reserve()
+	stuck := ns[1].newClient(TransportWS, jsonCodec{})
+	stuck.user, stuck.clientid = "u9", "m1"
+	ns[1].Register(stuck)
+	for i := 0; i < cap(stuck.send[lanes-1]); i++ {
+		stuck.write(&RespFrame{T: T_RESP})
+	}
+	defer func() {
+		stuck.close()
+		ns[1].UnRegister(stuck)
+	}()
+
+	c := connect(t, ns[1], "u1", "m1")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := ns[0].RPC(ctx, RPCRequest{User: "u9", ClientID: "m1", Kind: "ping"}); err != context.DeadlineExceeded {
+		t.Fatalf("rpc to stuck client: %v", err)
+	}
+	ns[0].publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	c.messages(1)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SSE 传输: GET /sse 推送消息, POST /sse/ack 和 /sse/tag 发送回执和标签.
+// 会话相关的函数长轮询也使用.
+// 登录参数可以放在 query 或 header 中, header 优先.
+
+// 登录参数的 header
+const (
+	HeaderUser   = "X-SW-User"
+	HeaderClient = "X-SW-Client"
+	HeaderToken  = "X-SW-Token"
+	HeaderTs     = "X-SW-Ts"
+)
+
+func newSid() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// httpLoginFrame 从请求中读取登录参数
+func httpLoginFrame(r *http.Request) *LoginFrame {
+	q := r.URL.Query()
+	get := func(header, key string) string {
+		if v := r.Header.Get(header); v != "" {
+			return v
+		}
+		return q.Get(key)
+	}
+	f := &LoginFrame{
+		Frame: Frame{T: T_LOGIN, I: "l"},
+		U:     get(HeaderUser, "u"),
+		M:     get(HeaderClient, "m"),
+		Tk:    get(HeaderToken, "tk"),
+		P:     q.Get("p"),
+		Av:    q.Get("av"),
+	}
+	f.Ts, _ = strconv.ParseInt(get(HeaderTs, "ts"), 10, 64)
+	f.V, _ = strconv.Atoi(q.Get("v"))
+	if cs := q.Get("cs"); cs != "" {
+		f.Cs = strings.Split(cs, ",")
+	}
+	if s, err := strconv.ParseInt(q.Get("s"), 10, 64); err == nil {
+		f.S = &s
+	}
+	return f
+}
+
+// httpLogin 登录非 websocket 的客户端, 失败时写回复并注销客户端.
+// 成功时返回离线消息的起始序号, 由调用方发送
+func (n *Node) httpLogin(w http.ResponseWriter, c *Client, f *LoginFrame) (*int64, bool) {
+	if ferr := f.Validate(); ferr != nil {
+		n.UnRegister(c)
+		httpFrame(w, http.StatusBadRequest, resp(f.T, f.I, ferr.Code, ferr.Msg))
+		return nil, false
+	}
+	c.sid = newSid()
+	since, ok := n.logon(c, f)
+	if !ok {
+		frame, _ := c.next()
+		n.UnRegister(c)
+		httpFrame(w, http.StatusUnauthorized, frame)
+		return nil, false
+	}
+	n.sessions.Store(c.sid, c)
+	return since, true
+}
+
+// session 按会话id查找非 websocket 的客户端
+func (n *Node) session(r *http.Request) *Client {
+	sid := r.URL.Query().Get("sid")
+	if sid == "" {
+		return nil
+	}
+	if v, ok := n.sessions.Load(sid); ok {
+		return v.(*Client)
+	}
+	return nil
+}
+
+// readBody 读取请求体, 与 websocket 一样限制大小, 0 不限制
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	if limit := DefConfig.Client.ReadMessageSizeLimit; limit > 0 {
+		return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+	}
+	return ioutil.ReadAll(r.Body)
+}
+
+func httpFrame(w http.ResponseWriter, status int, frame interface{}) {
+	d, _ := json.Marshal(frame)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(d)
+}
+
+// writeEvent 写一个 SSE 事件, 事件名为帧类型, 消息帧的 id 为最大的消息序号
+func writeEvent(w http.ResponseWriter, frame interface{}) error {
+	d, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	t := T_RESP
+	switch v := frame.(type) {
+	case *PushMessageClient:
+		t = v.T
+		var seq int64
+		for _, m := range v.Ms {
+			if m.Seq > seq {
+				seq = m.Seq
+			}
+		}
+		if seq > 0 {
+			fmt.Fprintf(w, "id: %d\n", seq)
+		}
+	case *RequestFrame:
+		t = v.T
+	case *CloseFrame:
+		t = v.T
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", t, d)
+	return err
+}
+
+func (n *Node) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if !n.admit(w) {
+		return
+	}
+	f := httpLoginFrame(r)
+	// 浏览器重连时带上最后收到的事件id, 即消息序号
+	if id := r.Header.Get("Last-Event-ID"); id != "" && f.S == nil {
+		if s, err := strconv.ParseInt(id, 10, 64); err == nil {
+			f.S = &s
+			if f.Cs == nil {
+				f.Cs = []string{CapResume}
+			}
+		}
+	}
+	c := n.newClient(TransportSSE, jsonCodec{})
+	since, ok := n.httpLogin(w, c, f)
+	if !ok {
+		return
+	}
+	log := c.log.With("method", "sse")
+	defer n.UnRegister(c)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// 离线消息可能超过发送队列, 与下面的发送循环同时进行
+	go n.Offline(c, since)
+
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		frame, rv := c.recv(ticker.C, r.Context().Done())
+		switch rv {
+		case recvDone:
+			// 被踢掉时发送剩下的帧, 包括 close 帧
+			for {
+				frame, ok := c.next()
+				if !ok {
+					break
+				}
+				writeEvent(w, frame)
+			}
+			flusher.Flush()
+			return
+		case recvTick:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		default:
+			if err := writeEvent(w, frame); err != nil {
+				log.Error("write:", err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// serveSessionFrame 处理 SSE 和长轮询会话的帧, 同步返回回复
+func (n *Node) serveSessionFrame(t string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log := zap.S().With("method", "sessionframe", "t", t)
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c := n.session(r)
+		if c == nil {
+			httpFrame(w, http.StatusUnauthorized, resp(t, "", C_AUTH, "session not found"))
+			return
+		}
+		body, err := readBody(w, r)
+		if err != nil {
+			log.Error("read body:", err)
+			httpFrame(w, http.StatusBadRequest, resp(t, "", C_FORMAT, "read body"))
+			return
+		}
+		head, f, ferr := decodeFrame(c.codec, body)
+		if ferr == nil && head.T != t {
+			ferr = &FrameError{Code: C_TYPE, Msg: "expect type " + t}
+		}
+		if ferr != nil {
+			httpFrame(w, http.StatusBadRequest, resp(t, head.I, ferr.Code, ferr.Msg))
+			return
+		}
+		switch v := f.(type) {
+		case *AckFrame:
+			httpFrame(w, http.StatusOK, n.ack(c, v))
+		case *TagFrame:
+			httpFrame(w, http.StatusOK, n.tag(c, v))
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent 一个 SSE 事件
+type sseEvent struct {
+	ID    string
+	Event string
+	Frame testFrame
+}
+
+// sseClient 测试用的 SSE 客户端
+type sseClient struct {
+	t      *testing.T
+	tn     *testNode
+	sid    string
+	events chan sseEvent
+}
+
+func sseConnect(t *testing.T, tn *testNode, user, m string) *sseClient {
+	t.Helper()
+	ts := fmt.Sprint(time.Now().Unix())
+	q := url.Values{
+		"u":  {user},
+		"m":  {m},
+		"ts": {ts},
+		"tk": {SignMD5(DefConfig.Secret, user+m, ts)},
+		"v":  {fmt.Sprint(ProtoVersionMax)},
+	}
+	// 登录和离线消息卡住时不会返回 header
+	client := &http.Client{Transport: &http.Transport{ResponseHeaderTimeout: waitTimeout}}
+	r, err := client.Get(tn.srv.URL + "/sse?" + q.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		t.Fatalf("sse %s/%s: status %d", user, m, r.StatusCode)
+	}
+	c := &sseClient{t: t, tn: tn, events: make(chan sseEvent, 1024)}
+	t.Cleanup(func() { r.Body.Close() })
+	go func() {
+		defer close(c.events)
+		s := bufio.NewScanner(r.Body)
+		e := sseEvent{}
+		for s.Scan() {
+			line := s.Text()
+			switch {
+			case line == "":
+				if e.Event != "" {
+					c.events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.ID = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				e.Event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(line[6:]), &e.Frame)
+			}
+		}
+	}()
+	login := c.next()
+	if login.Event != T_RESP || login.Frame.C != 0 || login.Frame.Sid == "" {
+		t.Fatalf("sse %s/%s login: %+v", user, m, login)
+	}
+	c.sid = login.Frame.Sid
+	return c
+}
+
+func (c *sseClient) next() sseEvent {
+	c.t.Helper()
+	select {
+	case e, ok := <-c.events:
+		if !ok {
+			c.t.Fatal("sse: stream closed")
+		}
+		return e
+	case <-time.After(waitTimeout):
+		c.t.Fatal("sse: timeout waiting for event")
+	}
+	return sseEvent{}
+}
+
+// post 发送会话帧
+func (c *sseClient) post(path string, f map[string]interface{}) testFrame {
+	c.t.Helper()
+	d, _ := json.Marshal(f)
+	r, err := http.Post(c.tn.srv.URL+path+"?sid="+c.sid, "application/json", bytes.NewReader(d))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer r.Body.Close()
+	rf := testFrame{}
+	json.NewDecoder(r.Body).Decode(&rf)
+	return rf
+}
+
+// TestSSEOffline 离线消息超过发送队列时也能全部送达
+func TestSSEOffline(t *testing.T) {
+	tn := newTestNode(t)
+
+	sent := map[string]bool{}
+	for i := 0; i < 60; i++ {
+		sent[tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: fmt.Sprint(i)})] = true
+	}
+	c := sseConnect(t, tn, "u1", "m1")
+	got := []string{}
+	for len(got) < len(sent) {
+		e := c.next()
+		if e.Event != "m" || e.ID == "" {
+			t.Fatalf("expect message event, got %+v", e)
+		}
+		got = append(got, ids(e.Frame.Ms)...)
+	}
+	for _, id := range got {
+		if !sent[id] {
+			t.Fatalf("unexpected message %s", id)
+		}
+		delete(sent, id)
+	}
+	if len(sent) != 0 {
+		t.Fatalf("missing messages %v", sent)
+	}
+
+	if r := c.post("/sse/ack", map[string]interface{}{"t": T_ACK, "i": "1", "id": got}); r.C != 0 {
+		t.Fatalf("ack: %+v", r)
+	}
+	if !userAcked(t, tn, "u1", got[0]) {
+		t.Fatal("message not acked")
+	}
+}
+
+func TestSSEPush(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := sseConnect(t, tn, "u1", "m1")
+	if r := c.post("/sse/tag", map[string]interface{}{"t": T_TAG, "i": "1", "d": map[string]bool{"news": true}}); r.C != 0 || r.R["news"] != 0 {
+		t.Fatalf("tag: %+v", r)
+	}
+	id := tn.publish(AdminPushMessage{Tags: []string{"news"}, Data: "x"})
+	if e := c.next(); e.Event != "m" || len(e.Frame.Ms) != 1 || e.Frame.Ms[0].ID != id {
+		t.Fatalf("expect message %s, got %+v", id, e)
+	}
+	c.sid = "none"
+	if r := c.post("/sse/ack", map[string]interface{}{"t": T_ACK, "i": "1", "id": []string{id}}); r.C != codeInt(C_AUTH) {
+		t.Fatalf("ack with unknown session: %+v", r)
+	}
+}
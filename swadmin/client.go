@@ -0,0 +1,259 @@
+// Package swadmin 是 sw Admin 接口的 Go 客户端.
+//
+// 请求使用 AdminSecret 签名, 网络错误和 5xx 时按退避重试; 推送带上幂等键, 重试不会重复推送.
+// 临时消息不保存, 服务端无法去重, 所以不带幂等键也不重试:
+//
+//	c, _ := swadmin.New(swadmin.Config{Addr: "http://localhost:8000", Secret: secret})
+//	id, err := c.Push(ctx, swadmin.PushRequest{UserIDs: []string{"u1"}, Data: "hello"})
+package swadmin
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// 服务地址, 例如 http://localhost:8000
+	Addr string
+	// 服务端的 adminsecret
+	Secret string
+
+	// 失败后的重试次数, 默认 3, 小于 0 不重试
+	Retries int
+	// 重试等待时间, 默认 200ms 到 5s, 每次翻倍并随机抖动
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// 单次请求的超时时间, 默认 10s; RPC 会加上等待回复的时间
+	Timeout time.Duration
+
+	HTTPClient *http.Client
+}
+
+type Client struct {
+	cfg  Config
+	addr *url.URL
+}
+
+// New 创建客户端
+func New(cfg Config) (*Client, error) {
+	if cfg.Addr == "" || cfg.Secret == "" {
+		return nil, errors.New("sw: Addr and Secret are required")
+	}
+	u, err := url.Parse(strings.TrimRight(cfg.Addr, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Retries == 0 {
+		cfg.Retries = 3
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 200 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 5 * time.Second
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &Client{cfg: cfg, addr: u}, nil
+}
+
+// Push 推送消息, 返回消息id. 临时消息不重试
+func (c *Client) Push(ctx context.Context, m PushRequest) (string, error) {
+	if m.IdempotencyKey == "" && !m.Ephemeral {
+		m.IdempotencyKey = newKey()
+	}
+	id := ""
+	return id, c.do(ctx, "/", m, &id, call{key: m.IdempotencyKey, retry: !m.Ephemeral})
+}
+
+// Audience 计算推送的接收者数量, 不推送
+func (c *Client) Audience(ctx context.Context, m PushRequest) (*Audience, error) {
+	a := &Audience{}
+	return a, c.do(ctx, "/audience", m, a, call{retry: true})
+}
+
+// Receipts 查询消息的回执
+func (c *Client) Receipts(ctx context.Context, req ReceiptsRequest) (*Receipts, error) {
+	rs := &Receipts{}
+	return rs, c.do(ctx, "/receipts", req, rs, call{retry: true})
+}
+
+// Tags 批量修改用户的订阅, 返回 用户 -> 标签 -> 状态码
+func (c *Client) Tags(ctx context.Context, req TagsRequest) (map[string]map[string]int, error) {
+	rs := map[string]map[string]int{}
+	return rs, c.do(ctx, "/tags", req, &rs, call{retry: true})
+}
+
+// UserTags 查询用户的订阅
+func (c *Client) UserTags(ctx context.Context, user string) ([]UserTag, error) {
+	rs := []UserTag{}
+	return rs, c.do(ctx, "/tags/list", map[string]string{"u": user}, &rs, call{retry: true})
+}
+
+// Online 查询用户在线的设备
+func (c *Client) Online(ctx context.Context, user string) ([]OnlineDevice, error) {
+	ds := []OnlineDevice{}
+	return ds, c.do(ctx, "/online", map[string]string{"u": user}, &ds, call{retry: true})
+}
+
+// Kick 踢掉用户的设备, clientid 为空时踢掉所有设备, 返回被踢掉的设备
+func (c *Client) Kick(ctx context.Context, user, clientid string) ([]OnlineDevice, error) {
+	ds := []OnlineDevice{}
+	return ds, c.do(ctx, "/kick", map[string]string{"u": user, "m": clientid}, &ds, call{retry: true})
+}
+
+// RPC 发送请求给在线的客户端并等待回复; 客户端可能已经处理了请求, 所以不重试
+func (c *Client) RPC(ctx context.Context, req RPCRequest) (*RPCReply, error) {
+	wait := req.Timeout
+	if wait <= 0 {
+		wait = 10
+	}
+	rp := &RPCReply{}
+	return rp, c.do(ctx, "/rpc", req, rp, call{wait: time.Duration(wait) * time.Second})
+}
+
+// call 请求的选项
+type call struct {
+	// 幂等键
+	key   string
+	retry bool
+	// 服务端等待的时间, 加到超时时间上
+	wait time.Duration
+}
+
+// adminResp 服务端的响应, 失败时 data 为错误信息
+type adminResp struct {
+	Code string          `json:"code"`
+	Data json.RawMessage `json:"data"`
+}
+
+// httpError 需要重试的 http 状态
+type httpError struct {
+	status int
+}
+
+func (e *httpError) Error() string {
+	return "sw: http " + strconv.Itoa(e.status)
+}
+
+func (c *Client) do(ctx context.Context, path string, req, out interface{}, o call) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.send(ctx, path, body, out, o)
+		if err == nil || !o.retry || attempt >= c.cfg.Retries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		t := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// send 签名并发送一次请求
+func (c *Client) send(ctx context.Context, path string, body []byte, out interface{}, o call) error {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout+o.wait)
+	defer cancel()
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	u := *c.addr
+	u.Path += path
+	u.RawQuery = url.Values{"sign": {Sign(c.cfg.Secret, string(body), ts)}, "ts": {ts}}.Encode()
+	r, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r = r.WithContext(ctx)
+	r.Header.Set("Content-Type", "application/json")
+	if o.key != "" {
+		r.Header.Set("Idempotency-Key", o.key)
+	}
+	resp, err := c.cfg.HTTPClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &httpError{status: resp.StatusCode}
+	}
+
+	ar := adminResp{}
+	if err := json.Unmarshal(data, &ar); err != nil {
+		return fmt.Errorf("sw: bad response: %v", err)
+	}
+	if ar.Code != CodeOK {
+		e := &Error{Code: ar.Code}
+		json.Unmarshal(ar.Data, &e.Msg)
+		return e
+	}
+	if out == nil || len(ar.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(ar.Data, out)
+}
+
+// retryable 网络错误、超时和 5xx 时重试, 服务端返回的错误码不重试
+func retryable(err error) bool {
+	var he *httpError
+	if errors.As(err, &he) {
+		return he.status >= 500 || he.status == http.StatusTooManyRequests
+	}
+	var e *Error
+	return !errors.As(err, &e)
+}
+
+// backoff 第 attempt 次重试前的等待时间, 在 [d/2, d) 之间随机
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.cfg.MinBackoff
+	for i := 0; i < attempt && d < c.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.cfg.MaxBackoff {
+		d = c.cfg.MaxBackoff
+	}
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)+1))
+}
+
+// Sign 计算 Admin 请求的签名 md5(secret+body+ts)
+func Sign(secret, body, ts string) string {
+	h := md5.New()
+	h.Write([]byte(secret + body + ts))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newKey 生成随机的幂等键
+func newKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
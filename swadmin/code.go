@@ -0,0 +1,44 @@
+package swadmin
+
+import "errors"
+
+// 状态码, 与服务端 code.go 相同
+const (
+	CodeOK    = "0"
+	CodeFail  = "1000"
+	CodeAuth  = "1001"
+	CodeLimit = "1002"
+
+	// 请求不是合法的json对象
+	CodeFormat = "1003"
+	// 字段缺失或类型错误
+	CodeParam = "1004"
+	// 未知的类型
+	CodeType = "1005"
+	// 不支持的协议版本
+	CodeVersion = "1006"
+	// 没有权限
+	CodeForbidden = "1007"
+	// 等待超时
+	CodeTimeout = "1008"
+	// 客户端不在线
+	CodeOffline = "1009"
+	// 消息不存在或不是发给该用户的
+	CodeNotFound = "1010"
+)
+
+// Error 服务端返回的错误
+type Error struct {
+	Code string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return "sw: " + e.Code + ": " + e.Msg
+}
+
+// IsCode 判断 err 或其包装的错误是否为服务端返回的 code
+func IsCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
@@ -0,0 +1,139 @@
+package swadmin
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 确认策略
+const (
+	// 任一设备确认即可
+	PolicyAny = "any"
+	// 每个设备都需要确认
+	PolicyEach = "each"
+)
+
+// 优先级
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0
+	PriorityHigh   = 1
+)
+
+// PushRequest 推送的消息, 接收者为 UserIDs、Tags、Expr、Devices 的并集
+type PushRequest struct {
+	UserIDs []string `json:"us,omitempty"`
+	Tags    []string `json:"ts,omitempty"`
+	// 标签表达式, 例如 vip AND NOT beta
+	Expr string `json:"x,omitempty"`
+	// 排除的用户
+	Exclude []string `json:"ex,omitempty"`
+	// 目标设备, 用户 -> clientid
+	Devices map[string][]string `json:"ms,omitempty"`
+	// 只发送给这些平台的设备
+	Platforms []string `json:"ps,omitempty"`
+	// 只发送给满足版本条件的设备, 例如 >=2.3.0
+	AppVersion string `json:"av,omitempty"`
+	// 确认策略 PolicyAny 或 PolicyEach
+	Policy string `json:"p,omitempty"`
+	// 临时消息, 不保存, 只尽力发送给在线的客户端
+	Ephemeral bool `json:"ep,omitempty"`
+	Priority  int  `json:"pr,omitempty"`
+
+	Data string `json:"d"`
+	// 扩展数据
+	Ext json.RawMessage `json:"e,omitempty"`
+
+	// 幂等键, 为空时自动生成; 重试时使用相同的键, 服务端只推送一次.
+	// 临时消息不支持幂等键
+	IdempotencyKey string `json:"-"`
+}
+
+// Audience 推送的接收者数量
+type Audience struct {
+	Count int `json:"count"`
+	// 只发送给部分设备的用户数
+	Limited int `json:"limited"`
+}
+
+type ReceiptsRequest struct {
+	// 消息id
+	ID string `json:"id"`
+	// 是否返回每个接收者的回执
+	Detail bool `json:"detail,omitempty"`
+	Offset int  `json:"offset,omitempty"`
+	Limit  int  `json:"limit,omitempty"`
+}
+
+type Receipts struct {
+	ID            string    `json:"id"`
+	Total         int64     `json:"total"`
+	Delivered     int64     `json:"delivered"`
+	Read          int64     `json:"read"`
+	DeliveredRate float64   `json:"delivered_rate"`
+	ReadRate      float64   `json:"read_rate"`
+	Receipts      []Receipt `json:"receipts,omitempty"`
+}
+
+type Receipt struct {
+	UserID      string     `json:"u"`
+	DeliveredAt *time.Time `json:"delivered_at"`
+	ReadAt      *time.Time `json:"read_at"`
+}
+
+// TagOptions 订阅的选项
+type TagOptions struct {
+	// 过期时间, 秒, 0 不过期
+	TTL   int64             `json:"ttl,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+// TagsRequest 批量修改用户的订阅
+type TagsRequest struct {
+	UserIDs []string `json:"us"`
+	// 只修改该设备的订阅, 为空时修改用户的订阅
+	ClientID string `json:"m,omitempty"`
+	// 添加的订阅, 已有的订阅会更新过期时间和属性
+	Add map[string]*TagOptions `json:"add,omitempty"`
+	// 删除的订阅
+	Del []string `json:"del,omitempty"`
+}
+
+// UserTag 用户的订阅
+type UserTag struct {
+	Tag string `json:"tag"`
+	// 设备的订阅
+	ClientID  string            `json:"m,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+// RPCRequest 发给在线客户端的请求
+type RPCRequest struct {
+	UserID   string `json:"u"`
+	ClientID string `json:"m"`
+	// 请求类型, 由业务方定义
+	Kind string `json:"k,omitempty"`
+	Data string `json:"d,omitempty"`
+	// 等待回复的时间, 秒, 默认 10 最大 60
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// RPCReply 客户端的回复
+type RPCReply struct {
+	Code int    `json:"c"`
+	Data string `json:"d"`
+	Msg  string `json:"m"`
+}
+
+// OnlineDevice 在线的设备
+type OnlineDevice struct {
+	ClientID string `json:"m"`
+	// 设备所在的节点
+	Node string `json:"node"`
+	// 传输方式 ws sse poll mqtt
+	Transport  string    `json:"transport"`
+	Platform   string    `json:"p,omitempty"`
+	AppVersion string    `json:"av,omitempty"`
+	LoginAt    time.Time `json:"login_at"`
+}
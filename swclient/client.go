@@ -0,0 +1,555 @@
+// Package swclient 是 sw 的 Go 客户端.
+//
+// 客户端自动重连并续传, 对收到的消息去重, 默认在消息交给调用方后自动回执:
+//
+//	c, _ := swclient.New(swclient.Config{
+//		URL:      "ws://localhost:8000/ws",
+//		User:     "u1",
+//		ClientID: "m1",
+//		Signer:   swclient.MD5Signer(secret),
+//	})
+//	go c.Run(ctx)
+//	for m := range c.Messages() {
+//		fmt.Println(m.ID, m.Data)
+//	}
+package swclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNotConnected 当前没有连接
+	ErrNotConnected = errors.New("sw: not connected")
+	// ErrDisconnected 等待回复时连接断开
+	ErrDisconnected = errors.New("sw: disconnected")
+	// ErrKicked 被服务端踢掉, 例如相同的 clientid 在其他地方登录, 不会重连
+	ErrKicked = errors.New("sw: kicked by server")
+	// ErrClosed 客户端已关闭
+	ErrClosed = errors.New("sw: client closed")
+)
+
+// 回执类型
+const (
+	ackDelivered = "d"
+	ackRead      = "r"
+)
+
+// 服务端的读超时为 60 秒, 每 54 秒发送 ping
+const readWait = 90 * time.Second
+
+type Config struct {
+	// websocket 地址, 例如 ws://localhost:8000/ws
+	URL      string
+	User     string
+	ClientID string
+	Signer   Signer
+
+	// 登录时上报的平台和应用版本
+	Platform   string
+	AppVersion string
+	// 协议版本, 默认 2, 不低于 2
+	Version int
+	// 能力, 默认 resume
+	Caps []string
+
+	// 为 true 时需要调用 Ack 或 Read 回执, 默认在消息交给调用方后自动回执.
+	// 重连时从最大的连续已回执序号续传, 未回执的消息会重新收到
+	ManualAck bool
+	// 收到消息的回调, 为空时从 Messages 读取; 回调在单独的 goroutine 中依次执行
+	Handler func(Message)
+	// 服务端请求的回调, 为空时回复 CodeFail
+	OnRequest func(Request) Reply
+	// 登录成功和连接断开的回调
+	OnConnect    func(LoginResult)
+	OnDisconnect func(error)
+
+	// 重连等待时间, 默认 500ms 到 30s, 每次翻倍并随机抖动
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// 请求的超时时间, 默认 10s
+	RequestTimeout time.Duration
+	// 去重记录的消息数, 默认 1024
+	DedupeSize int
+	// Messages 的缓冲大小, 默认 64
+	Buffer int
+
+	Dialer *websocket.Dialer
+}
+
+type Client struct {
+	cfg Config
+
+	msgs  chan Message
+	inbox chan []Message
+	seen  *dedupe
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	pending map[string]chan *serverFrame
+	// 写入需要互斥
+	wmu sync.Mutex
+
+	reqID int64
+	seqs  *seqs
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// New 创建客户端, 调用 Run 后开始连接
+func New(cfg Config) (*Client, error) {
+	if cfg.URL == "" || cfg.User == "" || cfg.ClientID == "" || cfg.Signer == nil {
+		return nil, errors.New("sw: URL, User, ClientID and Signer are required")
+	}
+	// 版本 1 的 ack 没有回复, 最低使用版本 2
+	if cfg.Version < 2 {
+		cfg.Version = 2
+	}
+	if cfg.Caps == nil {
+		cfg.Caps = []string{CapResume}
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = 10 * time.Second
+	}
+	if cfg.DedupeSize <= 0 {
+		cfg.DedupeSize = 1024
+	}
+	if cfg.Buffer <= 0 {
+		cfg.Buffer = 64
+	}
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
+	return &Client{
+		cfg:     cfg,
+		msgs:    make(chan Message, cfg.Buffer),
+		inbox:   make(chan []Message, cfg.Buffer),
+		seen:    newDedupe(cfg.DedupeSize),
+		seqs:    newSeqs(),
+		pending: map[string]chan *serverFrame{},
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// Messages 收到的消息, 设置了 Handler 时不使用; Run 返回后关闭
+func (c *Client) Messages() <-chan Message {
+	return c.msgs
+}
+
+// LastSeq 重连时续传的序号, 收到的不超过它的消息都已回执
+func (c *Client) LastSeq() int64 {
+	return c.seqs.resume()
+}
+
+// Close 断开连接并让 Run 返回
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// Run 连接并在断开后重连, 直到 ctx 结束、Close、被踢掉或 token 错误
+func (c *Client) Run(ctx context.Context) error {
+	done := make(chan struct{})
+	go c.dispatch(ctx, done)
+	defer func() {
+		close(c.inbox)
+		<-done
+		close(c.msgs)
+	}()
+
+	attempt := 0
+	for {
+		logined, err := c.session(ctx)
+		if c.cfg.OnDisconnect != nil {
+			c.cfg.OnDisconnect(err)
+		}
+		select {
+		case <-c.closed:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		var se *Error
+		if err == ErrKicked || errors.As(err, &se) && se.Code != CodeLimit {
+			return err
+		}
+		if logined {
+			attempt = 0
+		}
+		t := time.NewTimer(c.backoff(attempt))
+		attempt++
+		select {
+		case <-t.C:
+		case <-c.closed:
+			t.Stop()
+			return ErrClosed
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff 第 attempt 次重连前的等待时间, 在 [d/2, d) 之间随机
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.cfg.MinBackoff
+	for i := 0; i < attempt && d < c.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > c.cfg.MaxBackoff {
+		d = c.cfg.MaxBackoff
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// session 连接、登录并读取帧, 直到连接断开
+func (c *Client) session(ctx context.Context) (bool, error) {
+	conn, _, err := c.cfg.Dialer.DialContext(ctx, c.cfg.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.closed:
+		case <-stop:
+		}
+		conn.Close()
+	}()
+	defer conn.Close()
+
+	res, err := c.login(conn)
+	if err != nil {
+		return false, err
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		for id, ch := range c.pending {
+			close(ch)
+			delete(c.pending, id)
+		}
+		c.mu.Unlock()
+	}()
+	if c.cfg.OnConnect != nil {
+		c.cfg.OnConnect(*res)
+	}
+	return true, c.read(ctx, conn)
+}
+
+func (c *Client) login(conn *websocket.Conn) (*LoginResult, error) {
+	ts := time.Now().Unix()
+	tk, err := c.cfg.Signer.Sign(c.cfg.User, c.cfg.ClientID, ts)
+	if err != nil {
+		return nil, err
+	}
+	f := &loginFrame{
+		frame: frame{T: "l", I: c.nextID()},
+		U:     c.cfg.User,
+		M:     c.cfg.ClientID,
+		Tk:    tk,
+		Ts:    ts,
+		V:     c.cfg.Version,
+		Cs:    c.cfg.Caps,
+		P:     c.cfg.Platform,
+		Av:    c.cfg.AppVersion,
+	}
+	if last := c.LastSeq(); last > 0 {
+		f.S = &last
+	}
+	conn.SetWriteDeadline(time.Now().Add(c.cfg.RequestTimeout))
+	if err := conn.WriteJSON(f); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(c.cfg.RequestTimeout))
+	r := &serverFrame{}
+	if err := conn.ReadJSON(r); err != nil {
+		return nil, err
+	}
+	if r.T != "r" || r.Rt != "l" {
+		return nil, errors.New("sw: unexpected login reply " + r.T)
+	}
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	if r.Rs {
+		// 服务端数据已重置, 重新开始计数
+		c.seqs.reset()
+	}
+	return &LoginResult{
+		ClientID:      r.M,
+		Version:       r.V,
+		ServerVersion: r.Sv,
+		Caps:          r.Cs,
+		LastSeq:       r.Ls,
+		Reset:         r.Rs,
+	}, nil
+}
+
+func (c *Client) read(ctx context.Context, conn *websocket.Conn) error {
+	conn.SetReadDeadline(time.Now().Add(readWait))
+	conn.SetPingHandler(func(data string) error {
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		c.wmu.Lock()
+		defer c.wmu.Unlock()
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(c.cfg.RequestTimeout))
+	})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				return ErrKicked
+			}
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(readWait))
+		f := &serverFrame{}
+		if err := json.Unmarshal(data, f); err != nil {
+			continue
+		}
+		switch f.T {
+		case "m":
+			c.receive(ctx, f.Ms)
+		case "r":
+			c.mu.Lock()
+			ch, ok := c.pending[f.I]
+			delete(c.pending, f.I)
+			c.mu.Unlock()
+			if ok {
+				ch <- f
+			}
+		case "q":
+			go c.request(Request{ID: f.I, Kind: f.K, Data: f.D})
+		}
+	}
+}
+
+// receive 去重后交给 dispatch, 自动回执时重复的消息直接回执, 手动回执时由调用方回执.
+// ctx 结束或 Close 后不再等待 dispatch
+func (c *Client) receive(ctx context.Context, ms []Message) {
+	fresh := []Message{}
+	dup := []string{}
+	for _, m := range ms {
+		if c.seen.seen(m.ID) {
+			if !m.Ephemeral {
+				dup = append(dup, m.ID)
+			}
+			continue
+		}
+		c.seqs.received(m)
+		fresh = append(fresh, m)
+	}
+	if len(dup) > 0 && !c.cfg.ManualAck {
+		c.ack(dup, ackDelivered)
+	}
+	if len(fresh) > 0 {
+		select {
+		case c.inbox <- fresh:
+		case <-ctx.Done():
+		case <-c.closed:
+		}
+	}
+}
+
+// dispatch 把消息交给调用方, 自动回执时随后回执. ctx 结束或 Close 后调用方可能不再读取 Messages, 不再等待
+func (c *Client) dispatch(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for ms := range c.inbox {
+		ids := []string{}
+		for _, m := range ms {
+			if c.cfg.Handler != nil {
+				c.cfg.Handler(m)
+			} else {
+				select {
+				case c.msgs <- m:
+				case <-ctx.Done():
+					return
+				case <-c.closed:
+					return
+				}
+			}
+			if !m.Ephemeral {
+				ids = append(ids, m.ID)
+			}
+		}
+		if !c.cfg.ManualAck && len(ids) > 0 {
+			c.ack(ids, ackDelivered)
+			c.seqs.done(ids)
+		}
+	}
+}
+
+// request 处理服务端的请求
+func (c *Client) request(q Request) {
+	r := Reply{Code: CodeFail, Msg: "not supported"}
+	if c.cfg.OnRequest != nil {
+		r = c.cfg.OnRequest(q)
+	}
+	c.write(&replyFrame{frame: frame{T: "p", I: q.ID}, C: r.Code, D: r.Data, M: r.Msg})
+}
+
+// ack 发送回执, 不等待回复
+func (c *Client) ack(ids []string, k string) {
+	c.write(&ackFrame{frame: frame{T: "a", I: c.nextID()}, ID: ids, K: k})
+}
+
+func (c *Client) nextID() string {
+	return strconv.FormatInt(atomic.AddInt64(&c.reqID, 1), 10)
+}
+
+func (c *Client) write(v interface{}) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(c.cfg.RequestTimeout))
+	return conn.WriteJSON(v)
+}
+
+// call 发送帧并等待回复
+func (c *Client) call(ctx context.Context, id string, v interface{}) (*serverFrame, error) {
+	ch := make(chan *serverFrame, 1)
+	c.mu.Lock()
+	if c.conn == nil {
+		c.mu.Unlock()
+		return nil, ErrNotConnected
+	}
+	c.pending[id] = ch
+	c.mu.Unlock()
+	if err := c.write(v); err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.RequestTimeout)
+		defer cancel()
+	}
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		return r, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Ack 回执消息已送达, 开启 ManualAck 时使用
+func (c *Client) Ack(ctx context.Context, ids ...string) error {
+	return c.ackCall(ctx, ids, ackDelivered)
+}
+
+// Read 回执消息已读, 同时视为送达
+func (c *Client) Read(ctx context.Context, ids ...string) error {
+	return c.ackCall(ctx, ids, ackRead)
+}
+
+func (c *Client) ackCall(ctx context.Context, ids []string, k string) error {
+	id := c.nextID()
+	r, err := c.call(ctx, id, &ackFrame{frame: frame{T: "a", I: id}, ID: ids, K: k})
+	if err != nil {
+		return err
+	}
+	if r.R == nil {
+		if err := r.err(); err != nil {
+			return err
+		}
+	}
+	// 被忽略的消息服务端没有记录, 同样不需要再续传
+	c.seqs.done(ids)
+	return r.err()
+}
+
+// Tag 订阅(true)或取消订阅(false)标签, device 为 true 时只对当前设备生效, 返回每个标签的状态码
+func (c *Client) Tag(ctx context.Context, tags map[string]bool, device bool) (map[string]int, error) {
+	id := c.nextID()
+	r, err := c.call(ctx, id, &tagFrame{frame: frame{T: "t", I: id}, D: tags, Dv: device})
+	if err != nil {
+		return nil, err
+	}
+	if r.R == nil {
+		return nil, r.err()
+	}
+	return r.R, nil
+}
+
+// Subscribe 订阅标签
+func (c *Client) Subscribe(ctx context.Context, tags ...string) (map[string]int, error) {
+	return c.Tag(ctx, tagMap(tags, true), false)
+}
+
+// Unsubscribe 取消订阅标签
+func (c *Client) Unsubscribe(ctx context.Context, tags ...string) (map[string]int, error) {
+	return c.Tag(ctx, tagMap(tags, false), false)
+}
+
+func tagMap(tags []string, v bool) map[string]bool {
+	m := map[string]bool{}
+	for _, t := range tags {
+		m[t] = v
+	}
+	return m
+}
+
+// Upstream 发送上行消息给业务方, 返回服务端生成的消息id
+func (c *Client) Upstream(ctx context.Context, kind, data string) (string, error) {
+	id := c.nextID()
+	r, err := c.call(ctx, id, &upstreamFrame{frame: frame{T: "u", I: id}, K: kind, D: data})
+	if err != nil {
+		return "", err
+	}
+	return r.M, r.err()
+}
+
+// Send 发送消息给其他用户或标签, 返回消息id
+func (c *Client) Send(ctx context.Context, s SendRequest) (string, error) {
+	id := c.nextID()
+	r, err := c.call(ctx, id, &sendFrame{frame: frame{T: "s", I: id}, Us: s.Users, Ts: s.Tags, D: s.Data, Ep: s.Ephemeral})
+	if err != nil {
+		return "", err
+	}
+	return r.M, r.err()
+}
@@ -0,0 +1,31 @@
+package swclient
+
+import "sync"
+
+// dedupe 记录最近收到的消息id
+type dedupe struct {
+	mu   sync.Mutex
+	ids  map[string]struct{}
+	ring []string
+	pos  int
+}
+
+func newDedupe(size int) *dedupe {
+	return &dedupe{ids: map[string]struct{}{}, ring: make([]string, size)}
+}
+
+// seen 返回消息是否收到过, 没有时记录
+func (d *dedupe) seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.ids[id]; ok {
+		return true
+	}
+	if old := d.ring[d.pos]; old != "" {
+		delete(d.ids, old)
+	}
+	d.ring[d.pos] = id
+	d.pos = (d.pos + 1) % len(d.ring)
+	d.ids[id] = struct{}{}
+	return false
+}
@@ -0,0 +1,172 @@
+package swclient
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// 状态码, 与服务端 code.go 相同
+const (
+	CodeOK        = 0
+	CodeFail      = 1000
+	CodeAuth      = 1001
+	CodeLimit     = 1002
+	CodeFormat    = 1003
+	CodeParam     = 1004
+	CodeType      = 1005
+	CodeVersion   = 1006
+	CodeForbidden = 1007
+	CodeTimeout   = 1008
+	CodeOffline   = 1009
+	CodeNotFound  = 1010
+)
+
+// 能力
+const (
+	CapBatch    = "batch"
+	CapCompress = "compress"
+	CapCodec    = "codec"
+	CapResume   = "resume"
+)
+
+// Error 服务端返回的错误
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return "sw: " + strconv.Itoa(e.Code) + ": " + e.Msg
+}
+
+// Message 收到的消息
+type Message struct {
+	ID   string `json:"id"`
+	Ts   int64  `json:"ts"`
+	Data string `json:"data"`
+	// 用户内的消息序号, 临时消息为 0
+	Seq int64 `json:"sq,omitempty"`
+	// 发送消息的用户, Admin 推送时为空
+	From string `json:"f,omitempty"`
+	// 临时消息, 不需要回执
+	Ephemeral bool `json:"ep,omitempty"`
+	Priority  int  `json:"pr,omitempty"`
+	// 扩展数据, 推送时的 e
+	Ext json.RawMessage `json:"e,omitempty"`
+}
+
+// Request 服务端发来的请求
+type Request struct {
+	ID   string
+	Kind string
+	Data string
+}
+
+// Reply 对服务端请求的回复
+type Reply struct {
+	Code int
+	Data string
+	Msg  string
+}
+
+// LoginResult 登录的协商结果
+type LoginResult struct {
+	ClientID string
+	Version  int
+	// 服务端版本
+	ServerVersion string
+	Caps          []string
+	// 服务端最后的消息序号
+	LastSeq int64
+	// 服务端数据已重置, 补发了全部未确认的消息
+	Reset bool
+}
+
+// SendRequest 发送给其他用户或标签的消息
+type SendRequest struct {
+	Users []string
+	Tags  []string
+	Data  string
+	// 临时消息
+	Ephemeral bool
+}
+
+type frame struct {
+	T string `json:"t"`
+	I string `json:"i"`
+}
+
+type loginFrame struct {
+	frame
+	U  string   `json:"u"`
+	M  string   `json:"m"`
+	Tk string   `json:"tk"`
+	Ts int64    `json:"ts"`
+	V  int      `json:"v,omitempty"`
+	Cs []string `json:"cs,omitempty"`
+	S  *int64   `json:"s,omitempty"`
+	P  string   `json:"p,omitempty"`
+	Av string   `json:"av,omitempty"`
+}
+
+type tagFrame struct {
+	frame
+	D  map[string]bool `json:"d"`
+	Dv bool            `json:"dv,omitempty"`
+}
+
+type ackFrame struct {
+	frame
+	ID []string `json:"id"`
+	K  string   `json:"k,omitempty"`
+}
+
+type upstreamFrame struct {
+	frame
+	K string `json:"k,omitempty"`
+	D string `json:"d"`
+}
+
+type sendFrame struct {
+	frame
+	Us []string `json:"us,omitempty"`
+	Ts []string `json:"ts,omitempty"`
+	D  string   `json:"d"`
+	Ep bool     `json:"ep,omitempty"`
+}
+
+type replyFrame struct {
+	frame
+	C int    `json:"c"`
+	D string `json:"d,omitempty"`
+	M string `json:"m,omitempty"`
+}
+
+// serverFrame 服务端发来的所有帧
+type serverFrame struct {
+	T string `json:"t"`
+	I string `json:"i"`
+	// r
+	Rt  string         `json:"rt"`
+	C   int            `json:"c"`
+	M   string         `json:"m"`
+	V   int            `json:"v"`
+	Sv  string         `json:"sv"`
+	Cs  []string       `json:"cs"`
+	Ls  int64          `json:"ls"`
+	Rs  bool           `json:"rs"`
+	R   map[string]int `json:"r"`
+	Sid string         `json:"sid"`
+	// m
+	Ms []Message `json:"ms"`
+	// q
+	K string `json:"k"`
+	D string `json:"d"`
+}
+
+func (f *serverFrame) err() error {
+	if f.C == CodeOK {
+		return nil
+	}
+	return &Error{Code: f.C, Msg: f.M}
+}
@@ -0,0 +1,58 @@
+package swclient
+
+import "sync"
+
+// seqs 记录收到但未回执的消息序号, 计算重连时续传的序号.
+// 服务端续传序号之后的全部消息和之前未确认的消息, 续传序号不超过未回执的消息, 这些消息即使被其他设备确认也会重新收到
+type seqs struct {
+	mu   sync.Mutex
+	max  int64
+	open map[string]int64
+}
+
+func newSeqs() *seqs {
+	return &seqs{open: map[string]int64{}}
+}
+
+// received 记录收到的消息, 临时消息没有序号
+func (s *seqs) received(m Message) {
+	if m.Seq <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m.Seq > s.max {
+		s.max = m.Seq
+	}
+	s.open[m.ID] = m.Seq
+}
+
+// done 消息已回执
+func (s *seqs) done(ids []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		delete(s.open, id)
+	}
+}
+
+// resume 收到的最大序号, 不超过未回执的消息. 之前还没收到的消息服务端在未确认时仍会补发
+func (s *seqs) resume() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.max
+	for _, seq := range s.open {
+		if seq-1 < r {
+			r = seq - 1
+		}
+	}
+	return r
+}
+
+// reset 服务端数据已重置, 重新开始计数
+func (s *seqs) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.max = 0
+	s.open = map[string]int64{}
+}
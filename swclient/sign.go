@@ -0,0 +1,33 @@
+package swclient
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"strconv"
+)
+
+// Signer 生成登录的 token, 可以替换为调用业务方的签名服务
+type Signer interface {
+	Sign(user, clientid string, ts int64) (string, error)
+}
+
+// SignerFunc 函数形式的 Signer
+type SignerFunc func(user, clientid string, ts int64) (string, error)
+
+func (f SignerFunc) Sign(user, clientid string, ts int64) (string, error) {
+	return f(user, clientid, ts)
+}
+
+// MD5Signer 与服务端默认的 token 校验相同, secret 不应下发到不可信的客户端
+func MD5Signer(secret string) Signer {
+	return SignerFunc(func(user, clientid string, ts int64) (string, error) {
+		return TokenMD5(secret, user, clientid, strconv.FormatInt(ts, 10)), nil
+	})
+}
+
+// TokenMD5 计算服务端默认的 token
+func TokenMD5(secret, user, clientid, ts string) string {
+	h := md5.New()
+	h.Write([]byte(secret + user + clientid + ts))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nzlov/sw/swclient"
+)
+
+// sdkClient 运行连接到测试节点的 swclient, conns 为每次连接的底层连接
+type sdkClient struct {
+	*swclient.Client
+	t     *testing.T
+	conns chan net.Conn
+	done  chan error
+}
+
+func newSDKClient(t *testing.T, tn *testNode, cfg swclient.Config) *sdkClient {
+	t.Helper()
+	s := &sdkClient{t: t, conns: make(chan net.Conn, 16), done: make(chan error, 1)}
+	cfg.URL = tn.wsURL()
+	if cfg.User == "" {
+		cfg.User, cfg.ClientID = "u1", "m1"
+	}
+	if cfg.Signer == nil {
+		cfg.Signer = swclient.MD5Signer(DefConfig.Secret)
+	}
+	cfg.MinBackoff, cfg.MaxBackoff = 10*time.Millisecond, 50*time.Millisecond
+	if cfg.Dialer == nil {
+		cfg.Dialer = &websocket.Dialer{
+			NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+				if err == nil {
+					s.conns <- conn
+				}
+				return conn, err
+			},
+		}
+	}
+	c, err := swclient.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client = c
+	go func() { s.done <- c.Run(context.Background()) }()
+	t.Cleanup(func() {
+		c.Close()
+		<-s.done
+	})
+	return s
+}
+
+// drop 断开当前连接, 客户端会重连
+func (s *sdkClient) drop() {
+	s.t.Helper()
+	select {
+	case conn := <-s.conns:
+		conn.Close()
+	case <-time.After(waitTimeout):
+		s.t.Fatal("sdk: not connected")
+	}
+}
+
+func (s *sdkClient) message() swclient.Message {
+	s.t.Helper()
+	select {
+	case m := <-s.Messages():
+		return m
+	case <-time.After(waitTimeout):
+		s.t.Fatal("sdk: timeout waiting for message")
+	}
+	return swclient.Message{}
+}
+
+func (s *sdkClient) silent(d time.Duration) {
+	s.t.Helper()
+	select {
+	case m := <-s.Messages():
+		s.t.Fatalf("sdk: unexpected message %+v", m)
+	case <-time.After(d):
+	}
+}
+
+// online 等待客户端登录
+func online(t *testing.T, tn *testNode, user, m string) {
+	t.Helper()
+	waitFor(t, func() bool {
+		for _, c := range tn.userClients(user) {
+			if c.clientid == m {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestSDKAutoAck(t *testing.T) {
+	tn := newTestNode(t)
+
+	c := newSDKClient(t, tn, swclient.Config{})
+	online(t, tn, "u1", "m1")
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if rs, err := c.Subscribe(ctx, "news"); err != nil || rs["news"] != swclient.CodeOK {
+		t.Fatalf("subscribe: %v %v", rs, err)
+	}
+	id := tn.publish(AdminPushMessage{Tags: []string{"news"}, Data: "x"})
+	if m := c.message(); m.ID != id || m.Data != "x" {
+		t.Fatalf("message: %+v", m)
+	}
+	waitFor(t, func() bool { return userAcked(t, tn, "u1", id) })
+	if c.LastSeq() != 1 {
+		t.Fatalf("last seq: %d", c.LastSeq())
+	}
+}
+
+// TestSDKManualAckDedupe 重发的消息去重, 手动回执时不自动回执重复的消息
+func TestSDKManualAckDedupe(t *testing.T) {
+	old := DefConfig.Redelivery
+	DefConfig.Redelivery = RedeliveryConfig{Enable: true, Interval: 1}
+	t.Cleanup(func() { DefConfig.Redelivery = old })
+	tn := newTestNode(t)
+
+	c := newSDKClient(t, tn, swclient.Config{ManualAck: true})
+	online(t, tn, "u1", "m1")
+	id := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	if m := c.message(); m.ID != id {
+		t.Fatalf("message: %+v", m)
+	}
+	// 服务端至少重发一次
+	c.silent(2500 * time.Millisecond)
+	if userAcked(t, tn, "u1", id) {
+		t.Fatal("duplicate acked without Ack")
+	}
+	if c.LastSeq() != 0 {
+		t.Fatalf("last seq before ack: %d", c.LastSeq())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := c.Ack(ctx, id); err != nil {
+		t.Fatal("ack:", err)
+	}
+	if !userAcked(t, tn, "u1", id) || c.LastSeq() != 1 {
+		t.Fatalf("after ack: acked %v, last seq %d", userAcked(t, tn, "u1", id), c.LastSeq())
+	}
+}
+
+// TestSDKResume 手动回执时从连续已回执的序号续传, 未回执的消息重连后重新收到
+func TestSDKResume(t *testing.T) {
+	tn := newTestNode(t)
+
+	// 去重只记录一条, 重新收到的消息能交给调用方
+	c := newSDKClient(t, tn, swclient.Config{ManualAck: true, DedupeSize: 1})
+	online(t, tn, "u1", "m1")
+	id1 := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "1"})
+	id2 := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "2"})
+	c.message()
+	c.message()
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if err := c.Ack(ctx, id2); err != nil {
+		t.Fatal("ack:", err)
+	}
+	if c.LastSeq() != 0 {
+		t.Fatalf("last seq with unacked message: %d", c.LastSeq())
+	}
+
+	c.drop()
+	if m := c.message(); m.ID != id1 {
+		t.Fatalf("expect %s again, got %+v", id1, m)
+	}
+	c.silent(100 * time.Millisecond)
+	if err := c.Ack(ctx, id1); err != nil {
+		t.Fatal("ack:", err)
+	}
+	if c.LastSeq() != 2 {
+		t.Fatalf("last seq: %d", c.LastSeq())
+	}
+
+	// 断开期间的消息重连后收到
+	c.drop()
+	id3 := tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "3"})
+	if m := c.message(); m.ID != id3 {
+		t.Fatalf("expect %s, got %+v", id3, m)
+	}
+}
+
+func TestSDKReconnectBackoff(t *testing.T) {
+	var mu sync.Mutex
+	dials := []time.Time{}
+	refused := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dials = append(dials, time.Now())
+			mu.Unlock()
+			return nil, errors.New("refused")
+		},
+	}
+	tn := newTestNode(t)
+	newSDKClient(t, tn, swclient.Config{Dialer: refused})
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(dials) >= 6
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	// 等待时间在 [MinBackoff/2, MaxBackoff) 之间, 第一次为 MinBackoff
+	for i := 1; i < len(dials); i++ {
+		if d := dials[i].Sub(dials[i-1]); d < 5*time.Millisecond || d > 50*time.Millisecond+40*time.Millisecond {
+			t.Fatalf("backoff %d: %v", i, d)
+		}
+	}
+}
+
+func TestSDKStop(t *testing.T) {
+	tn := newTestNode(t)
+
+	bad := newSDKClient(t, tn, swclient.Config{Signer: swclient.MD5Signer("wrong")})
+	select {
+	case err := <-bad.done:
+		var se *swclient.Error
+		if !errors.As(err, &se) || se.Code != swclient.CodeAuth {
+			t.Fatalf("bad token: %v", err)
+		}
+		bad.done <- err
+	case <-time.After(waitTimeout):
+		t.Fatal("bad token: Run not returned")
+	}
+
+	c := newSDKClient(t, tn, swclient.Config{})
+	online(t, tn, "u1", "m1")
+	ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+	defer cancel()
+	if _, err := tn.Kick(ctx, "u1", "m1"); err != nil {
+		t.Fatal("kick:", err)
+	}
+	select {
+	case err := <-c.done:
+		if err != swclient.ErrKicked {
+			t.Fatalf("kicked: %v", err)
+		}
+		c.done <- err
+	case <-time.After(waitTimeout):
+		t.Fatal("kicked: Run not returned")
+	}
+}
+
+// TestSDKCancelUndrained 调用方不再读取 Messages 时取消, Run 仍然返回
+func TestSDKCancelUndrained(t *testing.T) {
+	tn := newTestNode(t)
+
+	c, err := swclient.New(swclient.Config{
+		URL:      tn.wsURL(),
+		User:     "u1",
+		ClientID: "m1",
+		Signer:   swclient.MD5Signer(DefConfig.Secret),
+		Buffer:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	online(t, tn, "u1", "m1")
+	for i := 0; i < 10; i++ {
+		tn.publish(AdminPushMessage{UserIDs: []string{"u1"}, Data: "x"})
+	}
+	// 等缓存填满, 读取循环阻塞
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("run: %v", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("Run not returned")
+	}
+	for range c.Messages() {
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// 标签以 . 分隔层级, 例如 city.beijing.chaoyang.
+// 推送时可以使用通配符: * 匹配一层, # 只能在最后, 匹配零层或多层.
+const (
+	TagSep      = "."
+	TagWildOne  = "*"
+	TagWildMore = "#"
+)
+
+// tagDepth 标签的层数
+func tagDepth(tag string) int {
+	return strings.Count(tag, TagSep) + 1
+}
+
+// validTag 校验订阅的标签, 不能包含通配符和空的层级
+func validTag(tag string) error {
+	for _, s := range strings.Split(tag, TagSep) {
+		if s == "" {
+			return errors.New("empty tag segment")
+		}
+		if strings.ContainsAny(s, TagWildOne+TagWildMore) {
+			return errors.New("wildcard not allowed")
+		}
+	}
+	return nil
+}
+
+// validTagPattern 校验推送的标签, 通配符必须是完整的一层, # 只能在最后
+func validTagPattern(p string) error {
+	ss := strings.Split(p, TagSep)
+	for i, s := range ss {
+		switch {
+		case s == "":
+			return errors.New("empty tag segment")
+		case s == TagWildMore:
+			if i != len(ss)-1 {
+				return errors.New("# must be the last segment")
+			}
+		case s == TagWildOne:
+		case strings.ContainsAny(s, TagWildOne+TagWildMore):
+			return errors.New("wildcard must be a whole segment")
+		}
+	}
+	return nil
+}
+
+func isTagPattern(p string) bool {
+	return strings.ContainsAny(p, TagWildOne+TagWildMore)
+}
+
+// matchTag 标签是否匹配推送的标签
+func matchTag(pattern, tag string) bool {
+	return matchSegments(strings.Split(pattern, TagSep), strings.Split(tag, TagSep))
+}
+
+func matchSegments(p, t []string) bool {
+	for i, s := range p {
+		if s == TagWildMore {
+			return true
+		}
+		if i >= len(t) || (s != TagWildOne && s != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// likePattern 把层级转换成 like 表达式, * 转换为 %
+func likePattern(ss []string) string {
+	ls := []string{}
+	for _, s := range ss {
+		if s == TagWildOne {
+			ls = append(ls, "%")
+		} else {
+			ls = append(ls, likeEscaper.Replace(s))
+		}
+	}
+	return strings.Join(ls, TagSep)
+}
+
+// tagCondition 推送标签对应的查询条件, 结合 depth 和前缀 like 使用索引.
+// exact 为 false 时结果是超集, 需要再用 matchTag 过滤
+func tagCondition(p string) (query string, args []interface{}, exact bool) {
+	if !isTagPattern(p) {
+		return "tag = ?", []interface{}{p}, true
+	}
+	ss := strings.Split(p, TagSep)
+	if ss[len(ss)-1] != TagWildMore {
+		return `depth = ? and tag like ? escape '\'`, []interface{}{len(ss), likePattern(ss)}, true
+	}
+	ss = ss[:len(ss)-1]
+	if len(ss) == 0 {
+		return "1 = 1", nil, true
+	}
+	// 前面有 * 时 % 可能匹配多层
+	exact = !strings.Contains(p, TagWildOne)
+	prefix := likePattern(ss)
+	return `((depth = ? and tag like ? escape '\') or (depth > ? and tag like ? escape '\'))`,
+		[]interface{}{len(ss), prefix, len(ss), prefix + TagSep + "%"}, exact
+}
+
+// tagUnexpired 未过期的订阅, 参数为当前时间
+const tagUnexpired = "(user_tags.expires_at is null or user_tags.expires_at > ?)"
+
+// tagSweepInterval 清理过期订阅的间隔
+const tagSweepInterval = time.Minute
+
+// TagOptions 订阅的过期时间和属性
+type TagOptions struct {
+	// 有效期, 秒, 0 不过期
+	TTL   int64             `json:"ttl,omitempty"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+func (o *TagOptions) values() (*time.Time, string) {
+	if o == nil {
+		return nil, ""
+	}
+	var expires *time.Time
+	if o.TTL > 0 {
+		t := time.Now().Add(time.Duration(o.TTL) * time.Second)
+		expires = &t
+	}
+	attrs := ""
+	if len(o.Attrs) > 0 {
+		b, _ := json.Marshal(o.Attrs)
+		attrs = string(b)
+	}
+	return expires, attrs
+}
+
+// setTags 添加和删除用户的订阅, 返回每个标签的结果.
+// add 的选项为 nil 时不修改已有订阅的过期时间和属性.
+func (n *Node) setTags(log *zap.SugaredLogger, user, clientid string, add map[string]*TagOptions, del []string) map[string]int {
+	r := map[string]int{}
+	for t, o := range add {
+		if err := n.addTag(user, clientid, t, o); err != nil {
+			log.Error("db:add user_tags:", user, t, err)
+			r[t] = codeInt(C_FAIL)
+			continue
+		}
+		r[t] = codeInt(C_OK)
+	}
+	if len(del) > 0 {
+		code := codeInt(C_OK)
+		if err := n.db.Exec("delete from user_tags where userid = ? and clientid = ? and tag in (?)", user, clientid, del).Error; err != nil {
+			log.Error("db:delete user_tags:", user, del, err)
+			code = codeInt(C_FAIL)
+		}
+		for _, t := range del {
+			r[t] = code
+		}
+	}
+	return r
+}
+
+func (n *Node) addTag(user, clientid, tag string, o *TagOptions) error {
+	now := time.Now()
+	expires, attrs := o.values()
+	set := map[string]interface{}{
+		"expires_at": gorm.Expr("excluded.expires_at"),
+		"attrs":      gorm.Expr("excluded.attrs"),
+		"updated_at": now,
+	}
+	if o == nil {
+		// 不修改未过期的订阅, 已过期未清理的订阅视为新订阅
+		expired := "user_tags.expires_at is not null and user_tags.expires_at <= ?"
+		set["expires_at"] = gorm.Expr("case when "+expired+" then excluded.expires_at else user_tags.expires_at end", now)
+		set["attrs"] = gorm.Expr("case when "+expired+" then excluded.attrs else user_tags.attrs end", now)
+	}
+	return n.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "userid"}, {Name: "tag"}, {Name: "clientid"}},
+		DoUpdates: clause.Assignments(set),
+	}).Create(&UserTag{
+		UsersID:   user,
+		ClientID:  clientid,
+		Tag:       tag,
+		Depth:     tagDepth(tag),
+		ExpiresAt: expires,
+		Attrs:     attrs,
+	}).Error
+}
+
+// userTags 用户未过期的订阅
+func (n *Node) userTags(user string) ([]UserTag, error) {
+	tags := []UserTag{}
+	err := n.db.Where("userid = ?", user).Where(tagUnexpired, time.Now()).Order("tag, clientid").Find(&tags).Error
+	return tags, err
+}
+
+// tagSweeper 定期删除过期的订阅
+func (n *Node) tagSweeper() {
+	log := zap.S().With("method", "tagsweeper")
+	ticker := time.NewTicker(tagSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+		r := n.db.Exec("delete from user_tags where expires_at is not null and expires_at <= ?", time.Now())
+		if r.Error != nil {
+			log.Error("db:delete expired user_tags:", r.Error)
+			continue
+		}
+		if r.RowsAffected > 0 {
+			log.Info("expired:", r.RowsAffected)
+		}
+	}
+}
+
+// tagUsers 查询订阅了标签的用户, 只有设备订阅的用户在 devices 中返回其设备
+func (n *Node) tagUsers(tags []string) ([]string, map[string][]string, error) {
+	rows := []UserTag{}
+	plain := []string{}
+	for _, t := range tags {
+		if !isTagPattern(t) {
+			plain = append(plain, t)
+		}
+	}
+	if len(plain) > 0 {
+		if err := n.db.Model(new(UserTag)).Select("userid, clientid").Where("tag in (?)", plain).Where(tagUnexpired, time.Now()).Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, t := range tags {
+		if !isTagPattern(t) {
+			continue
+		}
+		query, args, exact := tagCondition(t)
+		prows := []UserTag{}
+		if err := n.db.Model(new(UserTag)).Select("userid, clientid, tag").Where(query, args...).Where(tagUnexpired, time.Now()).Find(&prows).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, r := range prows {
+			if exact || matchTag(t, r.Tag) {
+				rows = append(rows, r)
+			}
+		}
+	}
+	users := []string{}
+	all := map[string]bool{}
+	devices := map[string][]string{}
+	for _, r := range rows {
+		if r.ClientID == "" {
+			if !all[r.UsersID] {
+				all[r.UsersID] = true
+				users = append(users, r.UsersID)
+			}
+			continue
+		}
+		devices[r.UsersID] = append(devices[r.UsersID], r.ClientID)
+	}
+	for u := range all {
+		delete(devices, u)
+	}
+	return users, devices, nil
+}
+
+// migrateTags 补全旧数据的层数, postgres 下为前缀匹配建立索引
+func migrateTags(db *gorm.DB) error {
+	if err := db.Exec("update user_tags set depth = length(tag) - length(replace(tag, '.', '')) + 1 where depth = 0").Error; err != nil {
+		return err
+	}
+	if !db.Migrator().HasIndex(new(UserTag), "idx_user_tags_unique") {
+		// 建唯一索引前去掉重复的订阅, 保留最新的一条
+		if err := db.Exec("delete from user_tags where deleted_at is not null").Error; err != nil {
+			return err
+		}
+		if err := db.Exec("delete from user_tags where id not in (select max(id) from user_tags group by userid, tag, clientid)").Error; err != nil {
+			return err
+		}
+		if err := db.Exec("create unique index if not exists idx_user_tags_unique on user_tags (userid, tag, clientid)").Error; err != nil {
+			return err
+		}
+	}
+	if db.Dialector.Name() == "postgres" {
+		return db.Exec("create index if not exists idx_user_tags_tag_pattern on user_tags (tag text_pattern_ops)").Error
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nzlov/sw/swadmin"
+	"go.uber.org/zap"
+)
+
+func countTags(t *testing.T, tn *testNode, user string) int64 {
+	t.Helper()
+	var n int64
+	if err := tn.db.Model(new(UserTag)).Where("userid = ?", user).Count(&n).Error; err != nil {
+		t.Fatal("db:", err)
+	}
+	return n
+}
+
+func TestAddTagUnique(t *testing.T) {
+	tn := newTestNode(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tn.addTag("u1", "", "vip", nil); err != nil {
+				t.Error("add tag:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	tn.addTag("u1", "m1", "vip", nil)
+	if n := countTags(t, tn, "u1"); n != 2 {
+		t.Fatalf("%d rows", n)
+	}
+}
+
+func TestAddTagOptions(t *testing.T) {
+	tn := newTestNode(t)
+	get := func() UserTag {
+		ut := UserTag{}
+		if err := tn.db.Where("userid = ? and tag = ?", "u1", "vip").First(&ut).Error; err != nil {
+			t.Fatal("db:", err)
+		}
+		return ut
+	}
+
+	tn.addTag("u1", "", "vip", &TagOptions{TTL: 60, Attrs: map[string]string{"lv": "1"}})
+	// 客户端重新订阅不改变有效期和属性
+	tn.addTag("u1", "", "vip", nil)
+	if ut := get(); ut.ExpiresAt == nil || ut.Attrs != `{"lv":"1"}` {
+		t.Fatalf("options changed: %+v", ut)
+	}
+	// 已过期的订阅重新订阅视为新订阅
+	tn.db.Model(new(UserTag)).Where("userid = ?", "u1").Update("expires_at", time.Now().Add(-time.Second))
+	tn.addTag("u1", "", "vip", nil)
+	if ut := get(); ut.ExpiresAt != nil || ut.Attrs != "" {
+		t.Fatalf("expired not renewed: %+v", ut)
+	}
+	// Admin 设置选项时覆盖
+	tn.addTag("u1", "", "vip", &TagOptions{Attrs: map[string]string{"lv": "2"}})
+	if ut := get(); ut.ExpiresAt != nil || ut.Attrs != `{"lv":"2"}` {
+		t.Fatalf("options not updated: %+v", ut)
+	}
+	r := tn.setTags(zap.S(), "u1", "", nil, []string{"vip"})
+	if r["vip"] != 0 || countTags(t, tn, "u1") != 0 {
+		t.Fatalf("delete: %v", r)
+	}
+}
+
+func TestMigrateTagsDedupe(t *testing.T) {
+	db := testDB(t)
+	if err := db.Exec("drop index idx_user_tags_unique").Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, ut := range []UserTag{
+		{UsersID: "u1", Tag: "vip"},
+		{UsersID: "u1", Tag: "vip", Attrs: "new"},
+		{UsersID: "u1", ClientID: "m1", Tag: "vip"},
+		{UsersID: "u2", Tag: "vip"},
+	} {
+		ut.ID = uint(i + 1)
+		if err := db.Create(&ut).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 软删除的旧数据也会和唯一索引冲突
+	db.Delete(&UserTag{}, 4)
+
+	if err := migrateTags(db); err != nil {
+		t.Fatal("migrate:", err)
+	}
+	uts := []UserTag{}
+	db.Unscoped().Order("id").Find(&uts)
+	if len(uts) != 2 || uts[0].Attrs != "new" || uts[1].ClientID != "m1" {
+		t.Fatalf("after dedupe: %+v", uts)
+	}
+	if !db.Migrator().HasIndex(new(UserTag), "idx_user_tags_unique") {
+		t.Fatal("unique index not created")
+	}
+	if err := db.Create(&UserTag{UsersID: "u1", Tag: "vip"}).Error; err == nil {
+		t.Fatal("duplicate inserted")
+	}
+}
+
+// audience 按推送条件计算接收者数
+func audience(t *testing.T, tn *testNode, m swadmin.PushRequest) int {
+	t.Helper()
+	a, err := adminClient(t, tn).Audience(contextTimeout(t), m)
+	if err != nil {
+		t.Fatal("audience:", err)
+	}
+	return a.Count
+}
+
+func TestTagWildcard(t *testing.T) {
+	tn := newTestNode(t)
+
+	subs := map[string]string{
+		"u1": "city.beijing.chaoyang",
+		"u2": "city.beijing.haidian",
+		"u3": "city.beijing",
+		"u4": "city.sh.pudong",
+		"u5": "city_x.y",
+	}
+	cs := map[string]*fakeClient{}
+	for u, tag := range subs {
+		cs[u] = connect(t, tn, u, "m1")
+		if rs := cs[u].tag(map[string]bool{tag: true}); rs[tag] != 0 {
+			t.Fatalf("%s subscribe %s: %v", u, tag, rs)
+		}
+	}
+	// 订阅不能包含通配符
+	if r := cs["u1"].call(map[string]interface{}{"t": T_TAG, "d": map[string]bool{"city.*": true}}); r.C == 0 {
+		t.Fatalf("subscribed wildcard: %+v", r)
+	}
+	for pattern, want := range map[string]int{
+		"city.beijing.*": 2,
+		"city.beijing.#": 3,
+		"city.#":         4,
+		"city.*.pudong":  1,
+		"city.*":         1,
+		"#":              5,
+	} {
+		if n := audience(t, tn, swadmin.PushRequest{Tags: []string{pattern}}); n != want {
+			t.Errorf("%s: %d receivers, want %d", pattern, n, want)
+		}
+	}
+	if _, err := adminClient(t, tn).Push(contextTimeout(t), swadmin.PushRequest{Tags: []string{"city.#.x"}, Data: "x"}); err == nil {
+		t.Fatal("# not at the end accepted")
+	}
+
+	tn.publish(AdminPushMessage{Tags: []string{"city.beijing.*"}, Data: "x"})
+	cs["u1"].messages(1)
+	cs["u2"].messages(1)
+	cs["u3"].silent(100 * time.Millisecond)
+}
+
+func TestTagExpr(t *testing.T) {
+	tn := newTestNode(t)
+
+	for u, tags := range map[string][]string{
+		"u1": {"vip", "city.sh"},
+		"u2": {"vip", "city.sh", "opted_out"},
+		"u3": {"vip", "city.bj"},
+		"u4": {"city.sh.pd"},
+		// 没有标签但登录过
+		"u5": nil,
+	} {
+		m := map[string]bool{}
+		for _, tag := range tags {
+			m[tag] = true
+		}
+		c := connect(t, tn, u, "m1")
+		if len(m) > 0 {
+			c.tag(m)
+		}
+	}
+	for expr, want := range map[string]int{
+		"vip AND city.sh AND NOT opted_out": 1,
+		"vip and (city.sh or city.bj)":      3,
+		"NOT vip":                           2,
+		"city.# and not vip":                1,
+		"vip OR city.*.pd":                  4,
+	} {
+		if n := audience(t, tn, swadmin.PushRequest{Expr: expr}); n != want {
+			t.Errorf("%s: %d receivers, want %d", expr, n, want)
+		}
+	}
+	// 排除的用户
+	if n := audience(t, tn, swadmin.PushRequest{Expr: "vip", Exclude: []string{"u3"}}); n != 2 {
+		t.Errorf("exclude: %d receivers", n)
+	}
+	for _, expr := range []string{"vip AND", "(vip", "a OR OR"} {
+		if _, err := adminClient(t, tn).Audience(contextTimeout(t), swadmin.PushRequest{Expr: expr}); err == nil {
+			t.Errorf("%s: accepted", expr)
+		}
+	}
+}
+
+// TestTagExprLimit 超过嵌套层数、长度和标签数的表达式返回 1004
+func TestTagExprLimit(t *testing.T) {
+	tn := newTestNode(t)
+
+	nested := func(open, close string, n int) string {
+		return strings.Repeat(open, n) + "vip" + strings.Repeat(close, n)
+	}
+	if _, err := parseTagExpr(nested("(", ")", maxExprDepth)); err != nil {
+		t.Fatalf("max depth: %v", err)
+	}
+	for name, expr := range map[string]string{
+		"parens": nested("(", ")", 2000),
+		"not":    nested("NOT ", "", 1000),
+		"mixed":  nested("NOT (", ")", maxExprDepth),
+		"length": strings.Repeat("vip OR ", maxExprLen/7) + "vip",
+		"terms":  strings.Repeat("vip OR ", maxExprTerms) + "vip",
+	} {
+		if _, err := parseTagExpr(expr); !errors.Is(err, errExprLimit) {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, err := adminClient(t, tn).Audience(contextTimeout(t), swadmin.PushRequest{Expr: expr}); !swadmin.IsCode(err, swadmin.CodeParam) {
+			t.Errorf("%s: admin %v", name, err)
+		}
+	}
+}
+
+// TestTagAdmin 服务端管理订阅, 过期的订阅不再匹配
+func TestTagAdmin(t *testing.T) {
+	tn := newTestNode(t)
+
+	admin := adminClient(t, tn)
+	rs, err := admin.Tags(contextTimeout(t), swadmin.TagsRequest{
+		UserIDs: []string{"u1", "u2"},
+		Add:     map[string]*swadmin.TagOptions{"trial": {TTL: 3600, Attrs: map[string]string{"src": "promo"}}, "vip": nil},
+	})
+	if err != nil || rs["u1"]["trial"] != 0 || rs["u2"]["vip"] != 0 {
+		t.Fatalf("tags: %v %v", rs, err)
+	}
+	tags, err := admin.UserTags(contextTimeout(t), "u1")
+	if err != nil || len(tags) != 2 {
+		t.Fatalf("user tags: %+v %v", tags, err)
+	}
+	for _, tag := range tags {
+		if tag.Tag == "trial" && (tag.ExpiresAt == nil || tag.Attrs["src"] != "promo") {
+			t.Fatalf("trial: %+v", tag)
+		}
+	}
+
+	tn.db.Model(new(UserTag)).Where("userid = ? and tag = ?", "u1", "trial").Update("expires_at", time.Now().Add(-time.Second))
+	if n := audience(t, tn, swadmin.PushRequest{Tags: []string{"trial"}}); n != 1 {
+		t.Fatalf("expired tag: %d receivers", n)
+	}
+	if tags, _ := admin.UserTags(contextTimeout(t), "u1"); len(tags) != 1 {
+		t.Fatalf("expired tag listed: %+v", tags)
+	}
+
+	if _, err := admin.Tags(contextTimeout(t), swadmin.TagsRequest{UserIDs: []string{"u2"}, Del: []string{"vip"}}); err != nil {
+		t.Fatal("del:", err)
+	}
+	if n := audience(t, tn, swadmin.PushRequest{Tags: []string{"vip"}}); n != 1 {
+		t.Fatalf("after del: %d receivers", n)
+	}
+}
+
+// TestDeviceTag 设备的订阅只发送给订阅的设备
+func TestDeviceTag(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	b := connect(t, tn, "u1", "m2")
+	if r := a.call(map[string]interface{}{"t": T_TAG, "d": map[string]bool{"news": true}, "dv": true}); r.C != 0 {
+		t.Fatalf("device tag: %+v", r)
+	}
+	tn.publish(AdminPushMessage{Tags: []string{"news"}, Data: "x"})
+	a.messages(1)
+	b.silent(100 * time.Millisecond)
+	// 表达式只使用用户的订阅
+	if n := audience(t, tn, swadmin.PushRequest{Expr: "news"}); n != 0 {
+		t.Fatalf("expr with device tag: %d receivers", n)
+	}
+}
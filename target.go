@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// targetChunk 按用户查询设备时每批的用户数
+const targetChunk = 500
+
+// clientDevices 查询登录过的目标设备, ms 为用户 -> clientid
+func (n *Node) clientDevices(ms map[string][]string) (map[string][]string, error) {
+	users := make([]string, 0, len(ms))
+	for u := range ms {
+		users = append(users, u)
+	}
+	devices := map[string][]string{}
+	for i := 0; i < len(users); i += targetChunk {
+		end := i + targetChunk
+		if end > len(users) {
+			end = len(users)
+		}
+		rows := []UserDevice{}
+		if err := n.db.Select("userid, clientid").Where("userid in (?)", users[i:end]).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			if contains(ms[r.UsersID], r.ClientID) {
+				devices[r.UsersID] = append(devices[r.UsersID], r.ClientID)
+			}
+		}
+	}
+	return devices, nil
+}
+
+// filterDevices 按平台和应用版本筛选接收者的设备, 没有满足条件设备的用户会被去掉
+func (n *Node) filterDevices(users []string, devices map[string][]string, platforms []string, version string) ([]string, map[string][]string, error) {
+	r := map[string][]string{}
+	for i := 0; i < len(users); i += targetChunk {
+		end := i + targetChunk
+		if end > len(users) {
+			end = len(users)
+		}
+		q := n.db.Select("userid, clientid, app_version").Where("userid in (?)", users[i:end])
+		if len(platforms) > 0 {
+			q = q.Where("platform in (?)", platforms)
+		}
+		rows := []UserDevice{}
+		if err := q.Find(&rows).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, d := range rows {
+			if ms, ok := devices[d.UsersID]; ok && !contains(ms, d.ClientID) {
+				continue
+			}
+			if version != "" && !matchVersion(version, d.AppVersion) {
+				continue
+			}
+			r[d.UsersID] = append(r[d.UsersID], d.ClientID)
+		}
+	}
+	us := make([]string, 0, len(r))
+	for u := range r {
+		us = append(us, u)
+	}
+	return us, r, nil
+}
+
+// targetDevices 记录只发送给部分设备的消息的目标设备
+func (n *Node) targetDevices(id, user string, ms []string) error {
+	dms := []DeviceMessage{}
+	for _, m := range ms {
+		dms = append(dms, DeviceMessage{
+			MessagesID: id,
+			UsersID:    user,
+			ClientID:   m,
+		})
+	}
+	if len(dms) == 0 {
+		return nil
+	}
+	return n.db.Create(&dms).Error
+}
+
+func filterClients(cs []*Client, ms []string) []*Client {
+	r := []*Client{}
+	for _, c := range cs {
+		if contains(ms, c.clientid) {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// 版本条件的比较符, 长的在前
+var versionOps = []string{">=", "<=", "!=", ">", "<", "="}
+
+// validVersionConstraint 校验版本条件, 多个条件以 , 分隔, 同时满足
+func validVersionConstraint(s string) error {
+	for _, c := range strings.Split(s, ",") {
+		_, v := splitVersionOp(strings.TrimSpace(c))
+		if err := validVersion(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validVersion 版本号由 . 分隔, 例如 2.3.0
+func validVersion(v string) error {
+	if v == "" {
+		return errors.New("version must not be empty")
+	}
+	for _, p := range strings.Split(v, ".") {
+		if p == "" {
+			return errors.New("version " + v + ": empty segment")
+		}
+	}
+	return nil
+}
+
+func splitVersionOp(c string) (string, string) {
+	for _, op := range versionOps {
+		if strings.HasPrefix(c, op) {
+			return op, strings.TrimSpace(c[len(op):])
+		}
+	}
+	return "=", c
+}
+
+// matchVersion 版本是否满足条件, 没有版本的设备不满足任何条件
+func matchVersion(constraint, v string) bool {
+	if v == "" {
+		return false
+	}
+	for _, c := range strings.Split(constraint, ",") {
+		op, cv := splitVersionOp(strings.TrimSpace(c))
+		r := compareVersion(v, cv)
+		var ok bool
+		switch op {
+		case ">=":
+			ok = r >= 0
+		case "<=":
+			ok = r <= 0
+		case "!=":
+			ok = r != 0
+		case ">":
+			ok = r > 0
+		case "<":
+			ok = r < 0
+		default:
+			ok = r == 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersion 逐段比较版本号, 数字按大小比较, 缺少的段视为 0
+func compareVersion(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		xi, xerr := strconv.Atoi(x)
+		yi, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xi != yi {
+				if xi < yi {
+					return -1
+				}
+				return 1
+			}
+		case x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
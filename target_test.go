@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPublishToDevices(t *testing.T) {
+	tn := newTestNode(t)
+
+	a1 := connect(t, tn, "u1", "m1")
+	a2 := connect(t, tn, "u1", "m2")
+	// 其他用户相同 clientid 的设备不是目标
+	b1 := connect(t, tn, "u2", "m1")
+	id := tn.publish(AdminPushMessage{Devices: map[string][]string{"u1": {"m1"}}, Data: "x"})
+	if ms := a1.messages(1); ms[0].ID != id {
+		t.Fatalf("received %+v", ms)
+	}
+	a2.silent(100 * time.Millisecond)
+	b1.silent(10 * time.Millisecond)
+
+	users, devices, err := tn.Audience(AdminPushMessage{Devices: map[string][]string{"u1": {"m1", "m9"}, "u3": {"m1"}}})
+	if err != nil || len(users) != 1 || users[0] != "u1" || len(devices["u1"]) != 1 || devices["u1"][0] != "m1" {
+		t.Fatalf("audience %v %v %v", users, devices, err)
+	}
+}
+
+func TestPublishToDevicesOffline(t *testing.T) {
+	tn := newTestNode(t)
+
+	a := connect(t, tn, "u1", "m1")
+	a.close(tn)
+	connect(t, tn, "u1", "m2").close(tn)
+	tn.publish(AdminPushMessage{Devices: map[string][]string{"u1": {"m1"}}, Data: "x"})
+	// 只在目标设备上补发
+	connect(t, tn, "u1", "m2").silent(100 * time.Millisecond)
+	connect(t, tn, "u1", "m1").messages(1)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"go.uber.org/zap"
+)
+
+// UpstreamMessage 转发给业务方的上行消息
+type UpstreamMessage struct {
+	ID       string `json:"id"`
+	User     string `json:"u"`
+	ClientID string `json:"m"`
+	Kind     string `json:"k"`
+	Data     string `json:"d"`
+	Ts       int64  `json:"ts"`
+}
+
+type UpstreamSink interface {
+	Send(ctx context.Context, m UpstreamMessage) error
+}
+
+func newUpstreamSink() (UpstreamSink, error) {
+	cfg := DefConfig.Upstream
+	switch cfg.Sink {
+	case SinkWebhook:
+		if cfg.Webhook == "" {
+			return nil, errors.New("upstream: webhook is empty")
+		}
+		return &webhookSink{url: cfg.Webhook, client: &http.Client{}}, nil
+	case SinkRedis:
+		if cfg.Stream == "" {
+			return nil, errors.New("upstream: stream is empty")
+		}
+		return &redisSink{
+			stream: cfg.Stream,
+			rdb: redis.NewClient(&redis.Options{
+				Addr:        DefConfig.Redis.Host,
+				DialTimeout: 10 * time.Second,
+			}),
+		}, nil
+	}
+	return nil, fmt.Errorf("upstream: unknown sink %q", cfg.Sink)
+}
+
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(ctx context.Context, m UpstreamMessage) error {
+	status, _, err := postSigned(ctx, s.client, s.url, &m)
+	if err != nil {
+		return err
+	}
+	if status/100 != 2 {
+		return fmt.Errorf("webhook status %d", status)
+	}
+	return nil
+}
+
+// postSigned 按 Admin 的方式在 query 中带 sign, ts 签名后 POST json, 返回状态码和响应内容
+func postSigned(ctx context.Context, client *http.Client, rawurl string, v interface{}) (int, []byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, nil, err
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return 0, nil, err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	q := u.Query()
+	q.Set("sign", SignMD5(DefConfig.AdminSecret, string(data), ts))
+	q.Set("ts", ts)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+type redisSink struct {
+	stream string
+	rdb    *redis.Client
+}
+
+func (s *redisSink) Send(ctx context.Context, m UpstreamMessage) error {
+	return s.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: s.stream,
+		Values: map[string]interface{}{
+			"id": m.ID,
+			"u":  m.User,
+			"m":  m.ClientID,
+			"k":  m.Kind,
+			"d":  m.Data,
+			"ts": m.Ts,
+		},
+	}).Err()
+}
+
+// limiter 令牌桶, 只在连接的读协程中使用
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (l *limiter) allow() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Upstream 校验并转发客户端的上行消息, 转发完成后回复
+func (n *Node) Upstream(c *Client, f *UpstreamFrame) {
+	cfg := DefConfig.Upstream
+	if !cfg.Enable || n.upstream == nil {
+		c.write(resp(f.T, f.I, C_FAIL, "upstream disabled"))
+		return
+	}
+	if cfg.MaxSize > 0 && len(f.D) > cfg.MaxSize {
+		c.write(resp(f.T, f.I, C_PARAM, fmt.Sprintf("field d: exceeds %d bytes", cfg.MaxSize)))
+		return
+	}
+	if c.limiter == nil {
+		c.limiter = newLimiter(cfg.Rate, cfg.Burst)
+	}
+	if !c.limiter.allow() {
+		c.write(resp(f.T, f.I, C_LIMIT, "rate limit"))
+		return
+	}
+
+	m := UpstreamMessage{
+		ID:       fmt.Sprint(time.Now().UnixNano()),
+		User:     c.user,
+		ClientID: c.clientid,
+		Kind:     f.K,
+		Data:     f.D,
+		Ts:       time.Now().Unix(),
+	}
+	timeout := time.Duration(cfg.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	go func() {
+		log := zap.S().With("method", "upstream", "user", c.user, "clientid", c.clientid)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := n.upstream.Send(ctx, m); err != nil {
+			log.Error("upstream:send:", m.ID, err)
+			c.write(resp(f.T, f.I, C_FAIL, "upstream error"))
+			return
+		}
+		log.Info("upstream:", m.ID)
+		c.write(resp(f.T, f.I, C_OK, m.ID))
+	}()
+}
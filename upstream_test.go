@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// withUpstream 开启上行消息并转发到 webhook, 需在创建节点前调用
+func withUpstream(t *testing.T, webhook string) {
+	old := DefConfig.Upstream
+	DefConfig.Upstream = UpstreamConfig{Enable: true, Sink: SinkWebhook, Webhook: webhook, Rate: 1, Burst: 1}
+	t.Cleanup(func() { DefConfig.Upstream = old })
+}
+
+func TestUpstreamWebhook(t *testing.T) {
+	got := make(chan UpstreamMessage, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		q := r.URL.Query()
+		if q.Get("sign") != SignMD5(DefConfig.AdminSecret, string(data), q.Get("ts")) {
+			http.Error(w, "bad sign", http.StatusForbidden)
+			return
+		}
+		m := UpstreamMessage{}
+		json.Unmarshal(data, &m)
+		got <- m
+	}))
+	defer hook.Close()
+	withUpstream(t, hook.URL)
+	tn := newTestNode(t)
+
+	c := connect(t, tn, "u1", "m1")
+	r := c.call(map[string]interface{}{"t": T_UPSTREAM, "k": "chat", "d": "hi"})
+	if r.C != 0 || r.M == "" {
+		t.Fatalf("upstream: %+v", r)
+	}
+	m := <-got
+	if m.ID != r.M || m.User != "u1" || m.ClientID != "m1" || m.Kind != "chat" || m.Data != "hi" {
+		t.Fatalf("webhook got %+v", m)
+	}
+	// 超过限流
+	if r := c.call(map[string]interface{}{"t": T_UPSTREAM, "d": "hi"}); r.C != codeInt(C_LIMIT) {
+		t.Fatalf("rate limit: %+v", r)
+	}
+}
+
+func TestUpstreamSinkConfig(t *testing.T) {
+	withUpstream(t, "")
+	for _, sink := range []string{SinkWebhook, "handler", ""} {
+		DefConfig.Upstream.Sink = sink
+		if _, err := newUpstreamSink(); err == nil {
+			t.Errorf("sink %q: expect error", sink)
+		}
+	}
+}
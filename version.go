@@ -0,0 +1,63 @@
+package main
+
+// Version 服务端版本
+const Version = "1.1.0"
+
+// 协议版本, 登录帧未带 v 时视为 1
+const (
+	ProtoVersionMin = 1
+	ProtoVersionMax = 2
+)
+
+// 协议版本 1 的 tag 回复的 rt, 版本 2 起为请求类型 t
+const legacyTagRt = "a"
+
+// legacy 协议版本 1 的客户端沿用旧的回复方式: ack 不回复, tag 回复的 rt 为 a
+func (c *Client) legacy() bool {
+	return c.version < 2
+}
+
+// 客户端能力, 登录时通过 cs 声明, 服务端在登录回复中返回协商结果
+const (
+	// 多个帧合并为一个 websocket 消息, 以换行分隔, 仅 sw.json
+	CapBatch = "batch"
+	// 启用 permessage-deflate 写压缩
+	CapCompress = "compress"
+	// 二进制编码, 登录回复的 cd 返回服务端支持的编码
+	CapCodec = "codec"
+	// 按登录帧的 s 续传消息
+	CapResume = "resume"
+)
+
+// negotiate 返回客户端与服务端都支持的能力
+func negotiate(c *Client, cs []string) []string {
+	r := []string{}
+	for _, v := range cs {
+		switch v {
+		case CapBatch:
+			if c.codec.Name() != CodecJSON || c.transport != TransportWS {
+				continue
+			}
+		case CapCompress:
+			if !DefConfig.Client.Compression || c.transport != TransportWS {
+				continue
+			}
+		case CapCodec, CapResume:
+		default:
+			continue
+		}
+		if !contains(r, v) {
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}